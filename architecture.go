@@ -1,60 +1,238 @@
 package navm
 
 import (
+	"fmt"
 	"strconv"
 )
 
 const AARCH64_MACOS_NONE = "aarch64-macos-none"
+const AARCH64_LINUX_GNU = "aarch64-linux-gnu"
 const X64_WIN_GNU = "x86_64-windows-gnu"
+const X64_LINUX_GNU = "x86_64-linux-gnu"
+const RISCV64_LINUX_MUSL = "riscv64-linux-musl"
+
+// The byte order of multi-byte values in memory
+type Endianness int
+
+const (
+	LittleEndian Endianness = iota
+	BigEndian    Endianness = iota
+)
+
+// Floating point behaviour that IEEE 754 leaves to the target
+type FloatBehavior int
+
+const (
+	// Invalid operations like 0/0 give a positive NaN. Float to integer
+	// conversions saturate, and NaN converts to 0. This is arm64's behaviour,
+	// and the interpreter's unless it runs for a target.
+	SaturatingFloats FloatBehavior = iota
+	// Invalid operations give a negative NaN, and float to integer
+	// conversions that overflow or are of NaN give the minimum integer, as on
+	// x86-64
+	IndefiniteFloats FloatBehavior = iota
+	// Every NaN result is the positive quiet NaN, whatever the operands.
+	// Conversions saturate, and NaN converts to the maximum integer, as on
+	// RISC-V.
+	CanonicalFloats FloatBehavior = iota
+)
+
+// The object file format the assembly is written for, which decides symbol
+// names and directives
+type ObjectFormat int
+
+const (
+	MachO ObjectFormat = iota
+	COFF  ObjectFormat = iota
+	ELF   ObjectFormat = iota
+)
+
+// The assembler syntax a generator writes
+type Dialect int
+
+const (
+	// The target's usual assembler: NASM on Windows, GNU as on Linux, in
+	// AT&T syntax for x86-64, and Apple's as on macOS
+	DefaultDialect  Dialect = iota
+	NasmDialect     Dialect = iota
+	GasIntelDialect Dialect = iota // GNU as with .intel_syntax noprefix
+	GasAttDialect   Dialect = iota // GNU as in its default AT&T syntax
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case DefaultDialect:
+		return "default"
+	case NasmDialect:
+		return "nasm"
+	case GasIntelDialect:
+		return "gas-intel"
+	case GasAttDialect:
+		return "gas-att"
+	default:
+		return "Dialect(" + strconv.Itoa(int(d)) + ")"
+	}
+}
 
 type Architecture struct {
-	TargetTriple         string
-	Registers64          []string
+	TargetTriple string
+	Registers64  []string
+	// Allocated separately from Registers64. Physical register numbers
+	// continue after the last of Registers64.
+	FloatRegisters       []string
 	ReturnRegister       string
 	StackPointerRegister string
+	ArgumentRegisters    []string // in calling convention order
+	CalleeSavedRegisters []string // must be preserved by a function that uses them
+	ShadowSpace          int      // reserved by the caller for the callee, 32 bytes on Windows
 	IntSize              int
 	StackAlignmentSize   int
+	Endianness           Endianness
+	Floats               FloatBehavior
+	ObjectFormat         ObjectFormat
+	// Binary instructions overwrite their first operand, as on x86-64, so
+	// are rewritten by lowerTwoAddress
+	TwoAddress bool
+	Dialect    Dialect
+	// Besides DefaultDialect, the dialects the generator can write
+	Dialects []Dialect
+	// The number of the exit system call that ends a freestanding _start, or 0
+	// if the target has none
+	ExitSyscall int
 }
 
 var Architectures = map[string]*Architecture{
 	AARCH64_MACOS_NONE: MakeAarch64MacArchitecture(),
+	AARCH64_LINUX_GNU:  MakeAarch64LinuxGnuArchitecture(),
 	X64_WIN_GNU:        MakeX64WinGnuArchitecture(),
+	X64_LINUX_GNU:      MakeX64LinuxGnuArchitecture(),
+	RISCV64_LINUX_MUSL: MakeRiscv64LinuxMuslArchitecture(),
 }
 
-func (a *Architecture) GetGenerator(ir *IR) Generator {
+func (a *Architecture) GetGenerator(ir *IR) (Generator, error) {
 	switch a.TargetTriple {
-	case AARCH64_MACOS_NONE:
+	case AARCH64_MACOS_NONE, AARCH64_LINUX_GNU:
 		return &MacGenerator{
 			arch: a,
 			ir:   ir,
-		}
-	case X64_WIN_GNU:
+		}, nil
+	case X64_WIN_GNU, X64_LINUX_GNU:
 		return &WinGenerator{
 			arch: a,
 			ir:   ir,
-		}
+		}, nil
+	case RISCV64_LINUX_MUSL:
+		return &RiscvGenerator{
+			arch: a,
+			ir:   ir,
+		}, nil
 	default:
-		panic("Unknown target triple: " + a.TargetTriple)
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTarget, a.TargetTriple)
 	}
 }
 
+// Whether add, sub and the comparisons can take the constant c, operating at
+// type t, as an immediate. x86-64 sign extends a 32 bit immediate to 64 bits,
+// and arm64 has 12 bits, which the assembler turns into the opposite
+// instruction when negative. RISC-V generators build wide constants
+// themselves.
+func (a *Architecture) fitsImmediate(t Type, c int) bool {
+	switch a.TargetTriple {
+	case AARCH64_MACOS_NONE, AARCH64_LINUX_GNU:
+		return c > -4096 && c < 4096
+	case X64_WIN_GNU, X64_LINUX_GNU:
+		return t.Size() < 8 || c == int(int32(c))
+	default:
+		return true
+	}
+}
+
+// Looks up one of the supported Architectures by target triple
+func GetArchitecture(targetTriple string) (*Architecture, error) {
+	a := Architectures[targetTriple]
+	if a == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTarget, targetTriple)
+	}
+	return a, nil
+}
+
+// A copy of the architecture that writes assembly in dialect d. Errors wrap
+// ErrUnknownTarget.
+func (a *Architecture) withDialect(d Dialect) (*Architecture, error) {
+	if d == DefaultDialect {
+		return a, nil
+	}
+	for _, supported := range a.Dialects {
+		if supported == d {
+			c := *a
+			c.Dialect = d
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s has no %s dialect", ErrUnknownTarget, a.TargetTriple, d)
+}
+
 var aarchMac64Registers = []string{"X9", "X10", "X11", "X12", "X13", "X14", "X15"}
 var aarchMacReturnRegister = "X0"
 var aarchMacStackPointerRegister = "SP"
+var aarchMacArgumentRegisters = []string{"X0", "X1", "X2", "X3", "X4", "X5", "X6", "X7"}
+
+// D8-D15 are callee-saved, so the caller-saved D16 upwards are used instead
+var aarchMacFloatRegisters = []string{"D16", "D17", "D18", "D19", "D20", "D21", "D22", "D23"}
 
 // use x86_64 registers, not arm
 var x64WinGnuRegisters = []string{"R10", "R11", "R12", "R13", "R14", "R15"}
 var x64WinGnuReturnRegister = "RAX"
 var x64WinGnuStackPointerRegister = "RSP"
+var x64WinGnuArgumentRegisters = []string{"RCX", "RDX", "R8", "R9"}
+var x64WinGnuCalleeSavedRegisters = []string{"R12", "R13", "R14", "R15"}
+
+// XMM6-XMM15 are callee-saved on Windows
+var x64WinGnuFloatRegisters = []string{"XMM0", "XMM1", "XMM2", "XMM3", "XMM4", "XMM5"}
+
+// System V passes six arguments in registers, and only RBX, RBP and R12-R15
+// are callee-saved, XMM registers included
+var x64LinuxGnuArgumentRegisters = []string{"RDI", "RSI", "RDX", "RCX", "R8", "R9"}
+
+// t5 and t6 are kept back as temporaries for the generator
+var riscv64Registers = []string{"t0", "t1", "t2", "t3", "t4", "s1", "s2", "s3", "s4", "s5", "s6", "s7", "s8", "s9", "s10", "s11"}
+var riscv64ReturnRegister = "a0"
+var riscv64StackPointerRegister = "sp"
+var riscv64ArgumentRegisters = []string{"a0", "a1", "a2", "a3", "a4", "a5", "a6", "a7"}
+var riscv64CalleeSavedRegisters = []string{"s1", "s2", "s3", "s4", "s5", "s6", "s7", "s8", "s9", "s10", "s11"}
+var riscv64FloatRegisters = []string{"ft0", "ft1", "ft2", "ft3", "ft4", "ft5", "ft6", "ft7"}
 
 func MakeAarch64MacArchitecture() *Architecture {
 	return &Architecture{
 		TargetTriple:         AARCH64_MACOS_NONE,
 		Registers64:          aarchMac64Registers,
+		FloatRegisters:       aarchMacFloatRegisters,
 		ReturnRegister:       aarchMacReturnRegister,
 		StackPointerRegister: aarchMacStackPointerRegister,
+		ArgumentRegisters:    aarchMacArgumentRegisters,
 		IntSize:              8,
 		StackAlignmentSize:   16,
+		Endianness:           LittleEndian,
+		Floats:               SaturatingFloats,
+		ObjectFormat:         MachO,
+	}
+}
+
+// The same registers as macOS, with ELF output and Linux system calls
+func MakeAarch64LinuxGnuArchitecture() *Architecture {
+	return &Architecture{
+		TargetTriple:         AARCH64_LINUX_GNU,
+		Registers64:          aarchMac64Registers,
+		FloatRegisters:       aarchMacFloatRegisters,
+		ReturnRegister:       aarchMacReturnRegister,
+		StackPointerRegister: aarchMacStackPointerRegister,
+		ArgumentRegisters:    aarchMacArgumentRegisters,
+		IntSize:              8,
+		StackAlignmentSize:   16,
+		Endianness:           LittleEndian,
+		Floats:               SaturatingFloats,
+		ObjectFormat:         ELF,
+		ExitSyscall:          93,
 	}
 }
 
@@ -62,10 +240,62 @@ func MakeX64WinGnuArchitecture() *Architecture {
 	return &Architecture{
 		TargetTriple:         X64_WIN_GNU,
 		Registers64:          x64WinGnuRegisters,
+		FloatRegisters:       x64WinGnuFloatRegisters,
 		ReturnRegister:       x64WinGnuReturnRegister,
 		StackPointerRegister: x64WinGnuStackPointerRegister,
+		ArgumentRegisters:    x64WinGnuArgumentRegisters,
+		CalleeSavedRegisters: x64WinGnuCalleeSavedRegisters,
+		ShadowSpace:          32,
 		IntSize:              8,
 		StackAlignmentSize:   16,
+		Endianness:           LittleEndian,
+		Floats:               IndefiniteFloats,
+		ObjectFormat:         COFF,
+		TwoAddress:           true,
+		Dialect:              NasmDialect,
+		Dialects:             []Dialect{NasmDialect, GasIntelDialect, GasAttDialect},
+	}
+}
+
+// The same registers as Windows, but the System V calling convention and GNU
+// as output
+func MakeX64LinuxGnuArchitecture() *Architecture {
+	return &Architecture{
+		TargetTriple:         X64_LINUX_GNU,
+		Registers64:          x64WinGnuRegisters,
+		FloatRegisters:       x64WinGnuFloatRegisters,
+		ReturnRegister:       x64WinGnuReturnRegister,
+		StackPointerRegister: x64WinGnuStackPointerRegister,
+		ArgumentRegisters:    x64LinuxGnuArgumentRegisters,
+		CalleeSavedRegisters: x64WinGnuCalleeSavedRegisters,
+		IntSize:              8,
+		StackAlignmentSize:   16,
+		Endianness:           LittleEndian,
+		Floats:               IndefiniteFloats,
+		ObjectFormat:         ELF,
+		TwoAddress:           true,
+		Dialect:              GasAttDialect,
+		Dialects:             []Dialect{NasmDialect, GasIntelDialect, GasAttDialect},
+		ExitSyscall:          60,
+	}
+}
+
+// The LP64D calling convention, with GNU as output for zig cc or clang
+func MakeRiscv64LinuxMuslArchitecture() *Architecture {
+	return &Architecture{
+		TargetTriple:         RISCV64_LINUX_MUSL,
+		Registers64:          riscv64Registers,
+		FloatRegisters:       riscv64FloatRegisters,
+		ReturnRegister:       riscv64ReturnRegister,
+		StackPointerRegister: riscv64StackPointerRegister,
+		ArgumentRegisters:    riscv64ArgumentRegisters,
+		CalleeSavedRegisters: riscv64CalleeSavedRegisters,
+		IntSize:              8,
+		StackAlignmentSize:   16,
+		Endianness:           LittleEndian,
+		Floats:               CanonicalFloats,
+		ObjectFormat:         ELF,
+		ExitSyscall:          93,
 	}
 }
 
@@ -79,12 +309,27 @@ func (a *Architecture) GetPhysicalRegister(register int) string {
 	if register == RETURN_REGISTER {
 		return a.ReturnRegister
 	}
+	if register <= ARGUMENT_REGISTER_0 && ARGUMENT_REGISTER_0-register < len(a.ArgumentRegisters) {
+		return a.ArgumentRegisters[ARGUMENT_REGISTER_0-register]
+	}
 	if register < 0 {
 		panic("Invalid register: " + strconv.Itoa(register))
 	}
+	if register > len(a.Registers64) {
+		return a.FloatRegisters[register-len(a.Registers64)-1]
+	}
 	return a.Registers64[register-1]
 }
 
+// The physical register number of FloatRegisters[i]
+func (a *Architecture) floatRegister(i int) int {
+	return len(a.Registers64) + 1 + i
+}
+
+func (a *Architecture) isFloatRegister(register int) bool {
+	return register > len(a.Registers64)
+}
+
 func (a *Architecture) GetReturnRegister() string {
 	return a.ReturnRegister
 }
@@ -0,0 +1,67 @@
+package navm
+
+// A straight-line run of instructions, half open [Start, End). Control only
+// enters at Start and only leaves after End-1.
+type BasicBlock struct {
+	Start      int
+	End        int
+	Successors []int // indices into the slice returned by BasicBlocks
+}
+
+// Maps each label to the index of the instruction placing it, or -1 if the
+// label was never placed
+func labelPositions(ir *IR) []int {
+	positions := make([]int, len(ir.labels))
+	for i := range positions {
+		positions[i] = -1
+	}
+	for idx, instr := range ir.instructions {
+		if instr.op == label && instr.arg2.value >= 0 && instr.arg2.value < len(positions) {
+			positions[instr.arg2.value] = idx
+		}
+	}
+	return positions
+}
+
+func isTerminator(op Op) bool {
+	return op == jmp || op == br || op == ret
+}
+
+// Splits the instructions into basic blocks. A block starts at the first
+// instruction, at every label and after every jump, branch or return.
+func (ir *IR) BasicBlocks() []BasicBlock {
+	blocks := []BasicBlock{}
+	// blockOf maps an instruction index to the block starting there
+	blockOf := make(map[int]int)
+	start := 0
+	for idx, instr := range ir.instructions {
+		if instr.op == label && idx > start {
+			blockOf[start] = len(blocks)
+			blocks = append(blocks, BasicBlock{Start: start, End: idx})
+			start = idx
+		}
+		if isTerminator(instr.op) {
+			blockOf[start] = len(blocks)
+			blocks = append(blocks, BasicBlock{Start: start, End: idx + 1})
+			start = idx + 1
+		}
+	}
+	if start < len(ir.instructions) {
+		blockOf[start] = len(blocks)
+		blocks = append(blocks, BasicBlock{Start: start, End: len(ir.instructions)})
+	}
+
+	positions := labelPositions(ir)
+	for b := range blocks {
+		last := ir.instructions[blocks[b].End-1]
+		if last.op == jmp || last.op == br {
+			if last.arg2.value >= 0 && last.arg2.value < len(positions) && positions[last.arg2.value] >= 0 {
+				blocks[b].Successors = append(blocks[b].Successors, blockOf[positions[last.arg2.value]])
+			}
+		}
+		if last.op != jmp && last.op != ret && b+1 < len(blocks) {
+			blocks[b].Successors = append(blocks[b].Successors, b+1)
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,37 @@
+package navm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+func TestBasicBlocks(t *testing.T) {
+	text := `  %v1 = mov 10
+loop:
+  %v1 = sub %v1, 1
+  br %v1, loop
+  jmp done
+  %v1 = mov 3
+done:
+  ret
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []BasicBlock{
+		{Start: 0, End: 1, Successors: []int{1}},
+		{Start: 1, End: 4, Successors: []int{1, 2}},
+		{Start: 4, End: 5, Successors: []int{4}},
+		{Start: 5, End: 6, Successors: []int{4}},
+		{Start: 6, End: 8},
+	}
+	blocks := ir.BasicBlocks()
+	if !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("Expected %v, got %v", expected, blocks)
+	}
+}
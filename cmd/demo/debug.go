@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	navm "github.com/drellem2/navm"
+)
+
+const debugHelp = `commands:
+  s              step one instruction
+  n              step over a call
+  c              continue to a breakpoint, watchpoint or the end
+  b <index>      break before instruction <index>
+  d <index>      delete the breakpoint at <index>
+  w <register>   watch writes to a register, e.g. w %v2
+  wm <addr> <n>  watch stores to n bytes of memory at addr
+  r              print registers
+  m <addr> <n>   print n bytes of memory at addr
+  bt             print the call stack
+  p              print the program
+  q              quit
+`
+
+// A line-oriented debugger over stdin and stdout
+func debug(d *navm.Debugger, ir *navm.IR, in io.Reader, out io.Writer) {
+	io.WriteString(out, debugHelp)
+	printLocation(d, out)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "(navm) ")
+		if !scanner.Scan() {
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var stop navm.Stop
+		var err error
+		stopped := false
+		switch fields[0] {
+		case "s":
+			stop, err = d.Step()
+			stopped = true
+		case "n":
+			stop, err = d.StepOver()
+			stopped = true
+		case "c":
+			stop, err = d.Continue()
+			stopped = true
+		case "b", "d":
+			index, ok := intArg(fields, 1, out)
+			if !ok {
+				continue
+			}
+			if fields[0] == "b" {
+				d.SetBreakpoint(d.Location().Function, index)
+			} else {
+				d.ClearBreakpoint(d.Location().Function, index)
+			}
+		case "w":
+			if len(fields) < 2 {
+				fmt.Fprintln(out, "usage: w <register>")
+				continue
+			}
+			r, ok := parseRegister(fields[1])
+			if !ok {
+				fmt.Fprintln(out, "unknown register "+fields[1])
+				continue
+			}
+			d.WatchRegister(d.Location().Function, r)
+		case "wm":
+			addr, ok := intArg(fields, 1, out)
+			size, ok2 := intArg(fields, 2, out)
+			if ok && ok2 {
+				d.WatchMemory(addr, size)
+			}
+		case "r":
+			for idx, v := range d.Registers() {
+				if idx > 0 {
+					fmt.Fprintf(out, "%%v%d = %d\n", idx, v)
+				}
+			}
+			ret, _ := d.Register(navm.GetReturnRegister())
+			fmt.Fprintf(out, "%%ret = %d\n", ret)
+		case "m":
+			addr, ok := intArg(fields, 1, out)
+			size, ok2 := intArg(fields, 2, out)
+			if !ok || !ok2 {
+				continue
+			}
+			bytes, err := d.Memory(addr, size)
+			if err != nil {
+				fmt.Fprintln(out, err)
+				continue
+			}
+			fmt.Fprintf(out, "%v\n", bytes)
+		case "bt":
+			for _, l := range d.Backtrace() {
+				fmt.Fprintln(out, l)
+			}
+		case "p":
+			fmt.Fprint(out, ir.Print())
+		case "q":
+			return
+		default:
+			io.WriteString(out, debugHelp)
+		}
+		if !stopped {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(out, "error: "+err.Error())
+			return
+		}
+		if stop.Reason == navm.StopFinished {
+			fmt.Fprintf(out, "finished with %d\n", d.Result())
+			return
+		}
+		if stop.Reason != navm.StopStep {
+			fmt.Fprintln(out, strings.TrimSpace(stop.Reason.String()+" "+stop.Watch))
+		}
+		printLocation(d, out)
+	}
+}
+
+func printLocation(d *navm.Debugger, out io.Writer) {
+	fmt.Fprintf(out, "%s  %s\n", d.Location(), d.Instruction())
+}
+
+func intArg(fields []string, idx int, out io.Writer) (int, bool) {
+	if idx >= len(fields) {
+		fmt.Fprintln(out, "missing argument to "+fields[0])
+		return 0, false
+	}
+	n, err := strconv.Atoi(fields[idx])
+	if err != nil {
+		fmt.Fprintln(out, "not a number: "+fields[idx])
+		return 0, false
+	}
+	return n, true
+}
+
+func parseRegister(s string) (navm.Register, bool) {
+	if s == "%ret" {
+		return navm.GetReturnRegister(), true
+	}
+	if !strings.HasPrefix(s, "%v") {
+		return navm.Register{}, false
+	}
+	n, err := strconv.Atoi(s[2:])
+	if err != nil || n <= 0 {
+		return navm.Register{}, false
+	}
+	return navm.MakeVirtualRegister(n), true
+}
@@ -165,17 +165,31 @@ func compile(expr string) string {
 func main() {
 	args := os.Args
 	if len(args) < 2 {
-		panic("Usage: navm [compile/interpret] <postfix-expression>")
+		panic("Usage: navm [compile/interpret/debug] <postfix-expression>")
 	}
 	switch args[1] {
 	case "compile":
 		ir := toIR(args[2])
-		// result := navm.Compile(ir, navm.AARCH64_MACOS_NONE)
-		result := navm.Compile(ir, navm.X64_WIN_GNU)
+		// result, err := navm.CompileE(ir, navm.AARCH64_MACOS_NONE)
+		result, err := navm.CompileE(ir, navm.X64_WIN_GNU)
+		exitOnError(err)
 		println(result)
 	case "interpret":
 		ir := toIR(args[2])
-		result := navm.Interpret(ir)
+		result, err := navm.InterpretE(ir)
+		exitOnError(err)
 		println(result)
+	case "debug":
+		ir := toIR(args[2])
+		d, err := navm.NewDebugger(ir, navm.InterpretOptions{})
+		exitOnError(err)
+		debug(d, ir, os.Stdin, os.Stdout)
+	}
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		println("error: " + err.Error())
+		os.Exit(1)
 	}
 }
@@ -1,7 +1,7 @@
 package navm
 
 import (
-	"strconv"
+	"fmt"
 
 	q "github.com/drellem2/navm/internal/queue"
 )
@@ -12,20 +12,32 @@ const scratch_register_count = 2
 
 // TODO: In priority order
 // 0. win x86_64 backend
-// 0.1 change tac to use 2-addresses only
-//      e.g. add r0, r1, r2 becomes
-//      - mov r0, r1
-//      - add r0, r0, r1
 // 1. check cross-compilation with zig cc
 
 // Add an initial pass that forces constants certain constants into registers
-// e.g. in arm, both mul operands must be in registers
-func placeConstantsInRegisters(ir *IR) {
-	// Find all constants that are used in mult/div instructions
-	// Place them in registers
-	xns := ir.instructions[:0]
+// e.g. in arm, both mul operands must be in registers, and and/or/xor only
+// take bit pattern immediates
+func placeConstantsInRegisters(a *Architecture, ir *IR) {
+	// Find all constants that are used in mult, division and bitwise instructions
+	// Place them in registers. Inserting moves means this cannot filter in
+	// place.
+	xns := make([]Instruction, 0, len(ir.instructions))
 	for _, instr := range ir.instructions {
-		if instr.op == mult || instr.op == div {
+		// Constants too wide for an immediate are moved into a register of
+		// the operand type, so they wrap as the immediate would
+		if instr.op == add || instr.op == sub || instr.op.isComparison() {
+			if instr.arg2.argType == constant && !a.fitsImmediate(instr.typ, ir.constants[instr.arg2.value]) {
+				vreg := ir.NewVirtualRegister()
+				if instr.typ != noType {
+					ir.SetType(vreg, instr.typ)
+				}
+				xns = append(xns, Instruction{op: mov, ret: vreg, arg2: instr.arg2, typ: instr.typ})
+				instr.arg2 = vreg.ToArg()
+				xns = append(xns, instr)
+				continue
+			}
+		}
+		if instr.op == mult || instr.op.isDivision() || instr.op == and || instr.op == or || instr.op == xor {
 			if instr.arg2.argType == constant {
 				vreg := ir.NewVirtualRegister()
 				// move instruction
@@ -47,18 +59,264 @@ func placeConstantsInRegisters(ir *IR) {
 				continue
 			}
 		}
+		// Float registers cannot be set to a constant, so its bit pattern
+		// is moved in from an integer register. That register is only live
+		// for one instruction, so is never spilled.
+		if instr.op == mov && instr.typ.IsFloat() && instr.arg2.argType == constant {
+			vreg := ir.NewVirtualRegister()
+			xns = append(xns, Instruction{op: mov, ret: vreg, arg2: instr.arg2})
+			instr.arg2 = vreg.ToArg()
+		}
 		xns = append(xns, instr)
 	}
 	ir.instructions = xns
 }
 
+// Replaces calls with moves into the target's argument registers, a bare call
+// and a move out of the return register. Parameters are moved out of the
+// argument registers on entry.
+func lowerCalls(a *Architecture, ir *IR) error {
+	if ir.paramCount > len(a.ArgumentRegisters) || ir.paramCount < 0 {
+		return fmt.Errorf("%w: %s takes %d parameters, %s passes at most %d in registers", ErrInvalidOperand, ir.Name(), ir.paramCount, a.TargetTriple, len(a.ArgumentRegisters))
+	}
+	xns := make([]Instruction, 0, len(ir.instructions)+ir.paramCount)
+	for i := 0; i < ir.paramCount; i++ {
+		xns = append(xns, Instruction{op: mov, ret: ir.Parameter(i), arg2: GetArgumentRegister(i).ToArg()})
+	}
+	for _, instr := range ir.instructions {
+		if instr.op != call {
+			xns = append(xns, instr)
+			continue
+		}
+		if len(instr.args) > len(a.ArgumentRegisters) {
+			return fmt.Errorf("%w: call with %d arguments, %s passes at most %d in registers", ErrInvalidOperand, len(instr.args), a.TargetTriple, len(a.ArgumentRegisters))
+		}
+		// Backwards, since the first argument register can double as the
+		// return register, which may be one of the arguments
+		for i := len(instr.args) - 1; i >= 0; i-- {
+			xns = append(xns, Instruction{op: mov, ret: GetArgumentRegister(i), arg2: instr.args[i].ToArg()})
+		}
+		xns = append(xns, Instruction{op: call, arg2: instr.arg2})
+		if instr.ret.registerType != noRegisterType {
+			xns = append(xns, Instruction{op: mov, ret: instr.ret, arg2: GetReturnRegister().ToArg()})
+		}
+	}
+	ir.instructions = xns
+	return nil
+}
+
+// Like CompileE, but panics on error and does not verify the IR first
 func Compile(ir *IR, architecture string) string {
 	a := Architectures[architecture]
-	g := a.GetGenerator(ir)
 	if a == nil {
 		panic("Unknown or unsupported architecture: " + architecture)
 	}
-	placeConstantsInRegisters(ir)
+	result, err := compile(a, ir, "")
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// Verifies and compiles the IR for the target triple. Errors wrap
+// ErrUnknownTarget or ErrInvalidOperand.
+func CompileE(ir *IR, architecture string) (string, error) {
+	a, err := GetArchitecture(architecture)
+	if err != nil {
+		return "", err
+	}
+	if err := joinVerifyErrors(Verify(ir)); err != nil {
+		return "", err
+	}
+	return compile(a, ir, "")
+}
+
+// Settings for CompileWithOptions. The zero value compiles as CompileE does.
+type CompileOptions struct {
+	// The assembler syntax to write. Targets other than x86-64 only have
+	// DefaultDialect.
+	Dialect Dialect
+	// If set, a freestanding _start is added that calls this function, which
+	// takes no parameters, and exits with its result. Only targets with an
+	// ExitSyscall have one.
+	Entry string
+}
+
+// Like CompileE, with options. Errors wrap ErrUnknownTarget, also for a
+// dialect or _start the target does not have, ErrUnknownFunction or
+// ErrInvalidOperand.
+func CompileWithOptions(ir *IR, architecture string, opts CompileOptions) (string, error) {
+	a, err := getCompileArchitecture(architecture, opts)
+	if err != nil {
+		return "", err
+	}
+	if err := joinVerifyErrors(Verify(ir)); err != nil {
+		return "", err
+	}
+	return compile(a, ir, opts.Entry)
+}
+
+func getCompileArchitecture(architecture string, opts CompileOptions) (*Architecture, error) {
+	a, err := GetArchitecture(architecture)
+	if err != nil {
+		return nil, err
+	}
+	return a.withDialect(opts.Dialect)
+}
+
+// Compiles a copy of the IR, so the caller's IR can be compiled again, for
+// this or another target
+func compile(a *Architecture, ir *IR, entry string) (string, error) {
+	ir = ir.Copy()
+	g, err := a.GetGenerator(ir)
+	if err != nil {
+		return "", err
+	}
+	start, err := compileStart(a, g, []*IR{ir}, entry)
+	if err != nil {
+		return "", err
+	}
+	body, err := compileFunction(a, g, ir)
+	if err != nil {
+		return "", err
+	}
+	return g.GetFileHeader() + start + body, nil
+}
+
+// A _start calling the function named entry, or nothing if entry is empty
+func compileStart(a *Architecture, g Generator, functions []*IR, entry string) (string, error) {
+	if entry == "" {
+		return "", nil
+	}
+	if a.ExitSyscall == 0 {
+		return "", fmt.Errorf("%w: %s has no freestanding entry point", ErrUnknownTarget, a.TargetTriple)
+	}
+	for _, f := range functions {
+		if f.Name() != entry {
+			continue
+		}
+		if f.ParamCount() != 0 {
+			return "", fmt.Errorf("%w: _start calls %s without arguments, but it takes %d", ErrInvalidOperand, entry, f.ParamCount())
+		}
+		return g.GetStart(entry), nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownFunction, entry)
+}
+
+// Like CompileModuleE, but panics on error and does not verify the module
+func CompileModule(m *Module, architecture string) string {
+	a := Architectures[architecture]
+	if a == nil {
+		panic("Unknown or unsupported architecture: " + architecture)
+	}
+	result, err := compileModule(a, m, "")
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// Verifies the module and compiles every function in it into a single
+// assembly file
+func CompileModuleE(m *Module, architecture string) (string, error) {
+	a, err := GetArchitecture(architecture)
+	if err != nil {
+		return "", err
+	}
+	if err := joinVerifyErrors(VerifyModule(m)); err != nil {
+		return "", err
+	}
+	return compileModule(a, m, "")
+}
+
+// Like CompileModuleE, with options
+func CompileModuleWithOptions(m *Module, architecture string, opts CompileOptions) (string, error) {
+	a, err := getCompileArchitecture(architecture, opts)
+	if err != nil {
+		return "", err
+	}
+	if err := joinVerifyErrors(VerifyModule(m)); err != nil {
+		return "", err
+	}
+	return compileModule(a, m, opts.Entry)
+}
+
+// Like compile, works on copies of the module's functions
+func compileModule(a *Architecture, m *Module, entry string) (string, error) {
+	result := ""
+	for idx, f := range m.functions {
+		ir := f.Copy()
+		g, err := a.GetGenerator(ir)
+		if err != nil {
+			return "", err
+		}
+		if idx == 0 {
+			start, err := compileStart(a, g, m.functions, entry)
+			if err != nil {
+				return "", err
+			}
+			result += g.GetFileHeader() + start
+		} else {
+			result += "\n"
+		}
+		body, err := compileFunction(a, g, ir)
+		if err != nil {
+			return "", err
+		}
+		result += body
+	}
+	return result, nil
+}
+
+// Verifies the IR, then runs the compiler's passes up to code generation on a
+// copy of it: call lowering, register allocation and spilling. The result
+// uses the target's physical registers and stack slots, and can be run with
+// InterpretForArchitecture.
+func Lower(ir *IR, architecture string) (*IR, error) {
+	a, err := GetArchitecture(architecture)
+	if err != nil {
+		return nil, err
+	}
+	if err := joinVerifyErrors(Verify(ir)); err != nil {
+		return nil, err
+	}
+	lowered := ir.Copy()
+	if err := lower(a, lowered); err != nil {
+		return nil, err
+	}
+	return lowered, nil
+}
+
+// Like Lower, for every function in a module
+func LowerModule(m *Module, architecture string) (*Module, error) {
+	a, err := GetArchitecture(architecture)
+	if err != nil {
+		return nil, err
+	}
+	if err := joinVerifyErrors(VerifyModule(m)); err != nil {
+		return nil, err
+	}
+	return lowerModule(a, m)
+}
+
+func lowerModule(a *Architecture, m *Module) (*Module, error) {
+	lowered := NewModule()
+	for _, f := range m.functions {
+		ir := f.Copy()
+		if err := lower(a, ir); err != nil {
+			return nil, err
+		}
+		lowered.AddFunction(ir)
+	}
+	return lowered, nil
+}
+
+func lower(a *Architecture, ir *IR) error {
+	annotateTypes(ir)
+	if err := lowerCalls(a, ir); err != nil {
+		return err
+	}
+	placeConstantsInRegisters(a, ir)
 	allocateRegisters(a, ir)
 
 	// Now we need to deal with any spilled registers
@@ -70,9 +328,23 @@ func Compile(ir *IR, architecture string) string {
 	stackMax := makeStackSpace(a, ir)
 	addSpillInstructions(a, ir)
 	freeStackSpace(a, ir, stackMax)
+	if a.TwoAddress {
+		lowerTwoAddress(a, ir)
+	}
+	return nil
+}
+
+func compileFunction(a *Architecture, g Generator, ir *IR) (string, error) {
+	if err := lower(a, ir); err != nil {
+		return "", err
+	}
 
 	result := g.GetHeader()
 	for _, instr := range ir.instructions {
+		if instr.op.isDivision() {
+			// Generators only see the instruction
+			instr.traps = ir.trapPolicy(instr)
+		}
 		switch instr.op {
 		case add:
 			result += g.GetInstruction(addGenOp, instr)
@@ -81,27 +353,97 @@ func Compile(ir *IR, architecture string) string {
 		case mult:
 			result += g.GetInstruction(multGenOp, instr)
 		case div:
-			result += g.GetInstruction(divGenOp, instr)
+			result += g.GetDivision(divGenOp, instr)
+		case udiv:
+			result += g.GetDivision(udivGenOp, instr)
+		case srem:
+			result += g.GetDivision(sremGenOp, instr)
+		case urem:
+			result += g.GetDivision(uremGenOp, instr)
 		case mov:
 			result += g.GetTwoArgInstruction(movGenOp, instr)
 		case load:
 			result += g.GetTwoArgInstruction(loadGenOp, instr)
 		case store:
 			result += g.GetTwoArgNoRetInstruction(storeGenOp, instr)
+		case load8u, load8s, load16u, load16s, load32u, load32s:
+			result += g.GetSizedLoad(instr)
+		case store8, store16, store32:
+			result += g.GetSizedStore(instr)
+		case sext8, sext16, sext32, zext8, zext16, zext32, trunc:
+			result += g.GetConversion(instr)
+		case sitof32, sitof64, f32tosi, f64tosi, f32tof64, f64tof32:
+			result += g.GetConversion(instr)
+		case fadd:
+			result += g.GetFloatInstruction(addGenOp, instr)
+		case fsub:
+			result += g.GetFloatInstruction(subGenOp, instr)
+		case fmul:
+			result += g.GetFloatInstruction(multGenOp, instr)
+		case fdiv:
+			result += g.GetFloatInstruction(divGenOp, instr)
+		case fload32, fload64:
+			result += g.GetFloatLoad(instr)
+		case fstore32, fstore64:
+			result += g.GetFloatStore(instr)
+		case and:
+			result += g.GetInstruction(andGenOp, instr)
+		case or:
+			result += g.GetInstruction(orGenOp, instr)
+		case xor:
+			result += g.GetInstruction(xorGenOp, instr)
+		case shl:
+			result += g.GetShiftInstruction(shlGenOp, instr)
+		case lshr:
+			result += g.GetShiftInstruction(lshrGenOp, instr)
+		case ashr:
+			result += g.GetShiftInstruction(ashrGenOp, instr)
+		case not:
+			result += g.GetUnaryInstruction(notGenOp, instr)
+		case neg:
+			result += g.GetUnaryInstruction(negGenOp, instr)
+		case eq:
+			result += g.GetCompareInstruction(eqGenOp, instr)
+		case ne:
+			result += g.GetCompareInstruction(neGenOp, instr)
+		case lt:
+			result += g.GetCompareInstruction(ltGenOp, instr)
+		case le:
+			result += g.GetCompareInstruction(leGenOp, instr)
+		case gt:
+			result += g.GetCompareInstruction(gtGenOp, instr)
+		case ge:
+			result += g.GetCompareInstruction(geGenOp, instr)
+		case ult:
+			result += g.GetCompareInstruction(ultGenOp, instr)
+		case ule:
+			result += g.GetCompareInstruction(uleGenOp, instr)
+		case ugt:
+			result += g.GetCompareInstruction(ugtGenOp, instr)
+		case uge:
+			result += g.GetCompareInstruction(ugeGenOp, instr)
 		case ret:
 			result += g.GetReturn()
+		case call:
+			result += g.GetCall(instr)
+		case label:
+			result += g.GetLabel(instr)
+		case jmp:
+			result += g.GetJump(instr)
+		case br:
+			result += g.GetBranch(instr)
 		default:
-			panic("Unknown operation: " + strconv.Itoa(int(instr.op)))
+			return "", fmt.Errorf("%w: unknown operation %d", ErrInvalidOperand, int(instr.op))
 		}
 	}
-	return result
+	return result, nil
 }
 
 func makeStackSpace(a *Architecture, ir *IR) int {
 	// Get largest stack position
 	var stackMax int
 	for _, instr := range ir.instructions {
-		if instr.arg2.argType == stackArg {
+		if instr.arg2.argType == stackArg || instr.arg2.spilledBase {
 			if instr.arg2.value > stackMax {
 				stackMax = instr.arg2.value
 			}
@@ -149,57 +491,90 @@ func freeStackSpace(a *Architecture, ir *IR, stackMax int) {
 		arg1: GetStackPointer(),
 		arg2: MakeConstant(ir.GetConstant(stackMax * a.IntSize)),
 	}
-	finalInstr := ir.instructions[len(ir.instructions)-1]
-	if finalInstr.op == ret {
-		ir.instructions = append(ir.instructions[:len(ir.instructions)-1], xrn, finalInstr)
-	} else {
-		ir.instructions = append(ir.instructions, xrn)
+	// Every return needs to free the stack, as does falling off the end
+	xns := make([]Instruction, 0, len(ir.instructions)+1)
+	for _, instr := range ir.instructions {
+		if instr.op == ret {
+			xns = append(xns, xrn)
+		}
+		xns = append(xns, instr)
+	}
+	if len(xns) == 0 || xns[len(xns)-1].op != ret {
+		xns = append(xns, xrn)
 	}
+	ir.instructions = xns
 }
 
+// Spilled operands are reloaded into the scratch registers of their class.
+// Float spills always move all 8 bytes, which is enough for either float type.
 func addSpillInstructions(a *Architecture, ir *IR) {
 	xns := make([]Instruction, 0)
 	for _, instr := range ir.instructions {
+		retFloat, arg1Float, arg2Float := floatOperands(instr)
 		if instr.arg1.registerType == stackRegister {
-			tmpReg1 := MakePhysicalRegister(scratch_register_1)
-			loadXrn := Instruction{
-				op:   load,
-				ret:  tmpReg1,
-				arg2: GetStackAddress(a, ir, instr.arg1.value),
-			}
-			xns = append(xns, loadXrn)
+			tmpReg1 := spillRegister(a, scratch_register_1, arg1Float)
+			xns = append(xns, spillInstruction(load, arg1Float, tmpReg1, GetStackAddress(a, ir, instr.arg1.value)))
 			instr.arg1 = tmpReg1
 		}
 		if instr.arg2.argType == stackArg {
-			tmpReg2 := MakePhysicalRegister(scratch_register_2)
-			loadXrn := Instruction{
-				op:   load,
-				ret:  tmpReg2,
-				arg2: GetStackAddress(a, ir, instr.arg2.value),
-			}
-			xns = append(xns, loadXrn)
+			tmpReg2 := spillRegister(a, scratch_register_2, arg2Float)
+			xns = append(xns, spillInstruction(load, arg2Float, tmpReg2, GetStackAddress(a, ir, instr.arg2.value)))
 			instr.arg2 = tmpReg2.ToArg()
 		}
+		// The base of an address is always an integer, and keeps its offset
+		if instr.arg2.spilledBase {
+			tmpReg2 := spillRegister(a, scratch_register_2, false)
+			xns = append(xns, spillInstruction(load, false, tmpReg2, GetStackAddress(a, ir, instr.arg2.value)))
+			instr.arg2.value = tmpReg2.value
+			instr.arg2.spilledBase = false
+		}
 		var storeNeeded bool
 		var storeStackPos Arg
 		if instr.ret.registerType == stackRegister {
 			storeStackPos = GetStackAddress(a, ir, instr.ret.value)
-			instr.ret = MakePhysicalRegister(scratch_register_1)
+			instr.ret = spillRegister(a, scratch_register_1, retFloat)
 			storeNeeded = true
 		}
 		xns = append(xns, instr)
 		if storeNeeded {
-			storeXrn := Instruction{
-				op:   store,
-				arg1: MakePhysicalRegister(scratch_register_1),
-				arg2: storeStackPos,
-			}
-			xns = append(xns, storeXrn)
+			xns = append(xns, spillInstruction(store, retFloat, spillRegister(a, scratch_register_1, retFloat), storeStackPos))
 		}
 	}
 	ir.instructions = xns
 }
 
+// Which of ret, arg1 and arg2 hold floats, going by the instruction's type.
+// Conversions are the only instructions that mix classes, and the address of
+// a load or store is always an integer.
+func floatOperands(instr Instruction) (ret bool, arg1 bool, arg2 bool) {
+	float := instr.typ.IsFloat()
+	if from, _, ok := instr.op.floatConversion(); ok {
+		return float, false, from.IsFloat()
+	}
+	shape := instr.op.shape()
+	return float, float, float && shape != loadShape && shape != storeShape
+}
+
+func spillRegister(a *Architecture, scratch int, float bool) Register {
+	if float {
+		return MakePhysicalRegister(a.floatRegister(scratch - 1))
+	}
+	return MakePhysicalRegister(scratch)
+}
+
+func spillInstruction(op Op, float bool, reg Register, stackPos Arg) Instruction {
+	if op == load {
+		if float {
+			return Instruction{op: fload64, typ: F64, ret: reg, arg2: stackPos}
+		}
+		return Instruction{op: load, ret: reg, arg2: stackPos}
+	}
+	if float {
+		return Instruction{op: fstore64, typ: F64, arg1: reg, arg2: stackPos}
+	}
+	return Instruction{op: store, arg1: reg, arg2: stackPos}
+}
+
 // Converts our virtual stack pointer into a real address
 func GetStackAddress(a *Architecture, ir *IR, stackPos int) Arg {
 	return GetStackPointer().ToAddress(ir.GetConstant((stackPos - 1) * a.IntSize))
@@ -230,8 +605,6 @@ func allocateRegisters(a *Architecture, ir *IR) {
 	// Build liveness intervals
 	// Perform linear scan register allocation
 
-	activeQueue := LivenessQueue{active: true}
-	inactiveQueue := LivenessQueue{active: false}
 	finishedQueue := LivenessQueue{active: true}
 
 	var virtualStackPointer int
@@ -239,26 +612,94 @@ func allocateRegisters(a *Architecture, ir *IR) {
 	// maps vregisters to physical registers
 	allocated := make([]allocation, ir.registersLength)
 
-	// Free physical registers are just a simple queue, not a priority queue
-	physicalRegisters := q.Queue{}
-	// We skip the first two registers so we can use them later as scratch registers
-	// when restoring spills
+	// We skip the first two registers of each class so we can use them later
+	// as scratch registers when restoring spills
+	intRegisters := []int{}
 	for i := scratch_register_count; i < len(a.Registers64); i++ {
-		physicalRegisters.Push(i + 1)
+		intRegisters = append(intRegisters, i+1)
+	}
+	floatRegisters := []int{}
+	for i := scratch_register_count; i < len(a.FloatRegisters); i++ {
+		floatRegisters = append(floatRegisters, a.floatRegister(i))
 	}
 
 	// First we will make intervals for all virtual registers
 	intervals := makeIntervals(ir)
+	hints := make([]int, len(intervals))
+	if a.TwoAddress {
+		hints = twoAddressHints(ir, intervals)
+	}
 
-	// Push all intervals to inactive queue
+	// Calls clobber every allocatable register, so anything live across one
+	// goes straight to the stack. Everything else is pushed to the inactive
+	// queue of its register class.
+	calls := []int{}
+	for i, instr := range ir.instructions {
+		if instr.op == call {
+			calls = append(calls, i)
+		}
+	}
+	intQueue := LivenessQueue{active: false}
+	floatQueue := LivenessQueue{active: false}
 	for _, val := range intervals[1:] {
-		inactiveQueue.Push(val)
+		if crossesCall(val, calls) {
+			virtualStackPointer = virtualStackPointer + 1
+			val.stackPosition = virtualStackPointer
+			finishedQueue.Push(val)
+			continue
+		}
+		if ir.TypeOf(val.register).IsFloat() {
+			floatQueue.Push(val)
+		} else {
+			intQueue.Push(val)
+		}
+	}
+
+	// Each class is allocated from its own registers, but spills share the
+	// stack
+	linearScan(&intQueue, intRegisters, hints, &finishedQueue, &virtualStackPointer)
+	linearScan(&floatQueue, floatRegisters, hints, &finishedQueue, &virtualStackPointer)
+
+	// Iterate over finished
+	for !finishedQueue.Empty() {
+		finished := finishedQueue.Pop()
+		if finished.stackPosition != 0 {
+			allocated[finished.register.value] = makeStackAlloc(finished.stackPosition)
+		} else {
+			allocated[finished.register.value] = makeRegisterAlloc(finished.physicalRegister)
+		}
+	}
+
+	// Now iterate through instructions and set all virtual registers to physical registers
+	for i, instr := range ir.instructions {
+		ir.instructions[i] = allocateInstruction(instr, allocated)
+	}
+}
+
+// Assigns the registers to the inactive intervals, spilling when they run
+// out. Every interval ends up in finishedQueue. An interval with a hint takes
+// over the register of the hinted one, which ends where it starts.
+func linearScan(inactiveQueue *LivenessQueue, registers []int, hints []int, finishedQueue *LivenessQueue, virtualStackPointer *int) {
+	activeQueue := LivenessQueue{active: true}
+
+	// Free physical registers are just a simple queue, not a priority queue
+	physicalRegisters := q.Queue{}
+	for _, r := range registers {
+		physicalRegisters.Push(r)
 	}
 
 	// Linear scan, we iterate through inactive queue and try to assign
 	// registers
 	for !inactiveQueue.Empty() {
 		interval := inactiveQueue.Pop()
+		if tied := activeQueue.find(hints[interval.register.value]); tied >= 0 {
+			finished := activeQueue.intervals[tied]
+			activeQueue.Remove(tied)
+			finishedQueue.Push(finished)
+			interval.physicalRegister = finished.physicalRegister
+			activeQueue.Push(interval)
+			continue
+		}
 		// Check if we can assign a register
 		if physicalRegisters.Empty() {
 			// Spill register
@@ -268,8 +709,8 @@ func allocateRegisters(a *Architecture, ir *IR) {
 			spill := activeQueue.PopLast()
 			physReg := spill.physicalRegister
 			spill.physicalRegister = 0
-			virtualStackPointer = virtualStackPointer + 1
-			spill.stackPosition = virtualStackPointer
+			*virtualStackPointer = *virtualStackPointer + 1
+			spill.stackPosition = *virtualStackPointer
 			finishedQueue.Push(spill)
 
 			interval.physicalRegister = physReg
@@ -292,21 +733,75 @@ func allocateRegisters(a *Architecture, ir *IR) {
 	for !activeQueue.Empty() {
 		finishedQueue.Push(activeQueue.Pop())
 	}
+}
 
-	// Iterate over finished
-	for !finishedQueue.Empty() {
-		finished := finishedQueue.Pop()
-		if finished.stackPosition != 0 {
-			allocated[finished.register.value] = makeStackAlloc(finished.stackPosition)
-		} else {
-			allocated[finished.register.value] = makeRegisterAlloc(finished.physicalRegister)
+// For each virtual register set by a two-address instruction, the register
+// in its arg1 if that is last used there, or 0. Giving both the same physical
+// register saves lowerTwoAddress a move.
+func twoAddressHints(ir *IR, intervals []Interval) []int {
+	hints := make([]int, len(intervals))
+	for i, instr := range ir.instructions {
+		if !instr.op.isTwoAddress() || instr.ret.registerType != virtualRegister || instr.arg1.registerType != virtualRegister {
+			continue
+		}
+		ret := instr.ret.value
+		arg1 := instr.arg1.value
+		if ret <= 0 || arg1 <= 0 || ret == arg1 {
+			continue
+		}
+		if intervals[ret].start == i && intervals[arg1].end == i+1 {
+			hints[ret] = arg1
 		}
 	}
+	return hints
+}
 
-	// Now iterate through instructions and set all virtual registers to physical registers
-	for i, instr := range ir.instructions {
-		ir.instructions[i] = allocateInstruction(instr, allocated)
+// Rewrites ret = arg1 op arg2 into mov ret, arg1 and ret = ret op arg2, for
+// targets whose binary instructions overwrite their first operand. If ret is
+// also arg2 the move would overwrite it, so commutative integer ops swap
+// their operands and the rest compute into the second scratch register,
+// which spills leave free since arg2 is not spilled.
+func lowerTwoAddress(a *Architecture, ir *IR) {
+	xns := make([]Instruction, 0, len(ir.instructions))
+	for _, instr := range ir.instructions {
+		if !instr.op.isTwoAddress() || instr.ret == instr.arg1 {
+			xns = append(xns, instr)
+			continue
+		}
+		move := func(ret Register, r Register) Instruction {
+			return Instruction{op: mov, typ: instr.typ, ret: ret, arg2: r.ToArg()}
+		}
+		if instr.arg2.argType != registerArg || instr.arg2.register() != instr.ret {
+			xns = append(xns, move(instr.ret, instr.arg1))
+			instr.arg1 = instr.ret
+			xns = append(xns, instr)
+			continue
+		}
+		switch instr.op {
+		case add, mult, and, or, xor:
+			instr.arg2 = instr.arg1.ToArg()
+			instr.arg1 = instr.ret
+			xns = append(xns, instr)
+		default:
+			ret := instr.ret
+			scratch := spillRegister(a, scratch_register_2, instr.typ.IsFloat())
+			xns = append(xns, move(scratch, instr.arg1))
+			instr.ret = scratch
+			instr.arg1 = scratch
+			xns = append(xns, instr, move(ret, scratch))
+		}
 	}
+	ir.instructions = xns
+}
+
+// Whether the interval's value is needed after a call it was set before
+func crossesCall(interval Interval, calls []int) bool {
+	for _, c := range calls {
+		if interval.start < c && interval.end > c+1 {
+			return true
+		}
+	}
+	return false
 }
 
 func allocateInstruction(instr Instruction, allocated []allocation) Instruction {
@@ -316,6 +811,9 @@ func allocateInstruction(instr Instruction, allocated []allocation) Instruction
 	return instr
 }
 
+// Replaces a virtual register operand with its allocation. A spilled operand
+// becomes a stack slot, except the base of an address, which keeps its offset
+// and is reloaded by addSpillInstructions.
 func allocateArg(arg Arg, allocated []allocation) Arg {
 	if arg.isVirtualRegister && (arg.argType == registerArg || arg.argType == address) {
 		arg.isVirtualRegister = false
@@ -323,7 +821,11 @@ func allocateArg(arg Arg, allocated []allocation) Arg {
 			return arg
 		}
 		if allocated[arg.value].allocTyp == stackAlloc {
-			arg.argType = stackArg
+			if arg.argType == address {
+				arg.spilledBase = true
+			} else {
+				arg.argType = stackArg
+			}
 		}
 		arg.value = allocated[arg.value].value
 	}
@@ -1,6 +1,11 @@
 package navm
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -379,10 +384,678 @@ func TestSpill(t *testing.T) {
 	ir.Return()
 	ir.registersLength = 10
 	ir.constants = []int{1}
-	result2 := Interpret(ir)
+	interpreted := Interpret(ir)
 	result := Compile(ir, AARCH64_MACOS_NONE)
-	println("Interpreted result is: ", result2)
+	println("Interpreted result is: ", interpreted)
 	if result == "" {
 		t.Errorf("Unexpected empty string, got %s", result)
 	}
 }
+
+// Runs the mov, movz, movn and movk of an immediate sequence on a single
+// register, keeping the low 32 bits for a W register
+func runArm64ImmediateSequence(t *testing.T, xrn string) int {
+	value := 0
+	for _, line := range strings.Split(strings.TrimSpace(xrn), "\n") {
+		fields := strings.Fields(strings.NewReplacer(",", "", "#", "").Replace(line))
+		imm, err := strconv.Atoi(fields[2])
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		shift := 0
+		if len(fields) == 5 {
+			if shift, err = strconv.Atoi(fields[4]); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+		}
+		if fields[0] != "mov" && (imm < 0 || imm > 0xffff) {
+			t.Errorf("Expected a 16 bit immediate, got %q", line)
+		}
+		switch fields[0] {
+		case "mov":
+			value = imm
+		case "movz":
+			value = imm << uint(shift)
+		case "movn":
+			value = ^(imm << uint(shift))
+		case "movk":
+			value = value&^(0xffff<<uint(shift)) | imm<<uint(shift)
+		default:
+			t.Fatalf("Unexpected instruction %q", line)
+		}
+		if strings.HasPrefix(fields[1], "W") {
+			value = int(uint32(value))
+		}
+	}
+	return value
+}
+
+func TestArm64LoadImmediate(t *testing.T) {
+	values := []int{0, 1, -1, 65535, -65536, 65536, 0x12340000, 5000000000, -5000000000,
+		math.MaxInt64, math.MinInt64, 0x3ff199999999999a, 0x123456789abcdef0, -0x123456789abcdef0}
+	for _, v := range values {
+		xrn := arm64LoadImmediate("X11", v)
+		if result := runArm64ImmediateSequence(t, xrn); result != v {
+			t.Errorf("Expected %d, got %d from\n%s", v, result, xrn)
+		}
+		// A single mov must be a movz or movn
+		if !strings.HasPrefix(xrn, "  mov ") {
+			continue
+		}
+		zeros, ones := 0, 0
+		for i := 0; i < 4; i++ {
+			switch v >> uint(16*i) & 0xffff {
+			case 0:
+				zeros++
+			case 0xffff:
+				ones++
+			}
+		}
+		if zeros < 3 && ones < 3 {
+			t.Errorf("Expected movz or movn for %#x, got\n%s", v, xrn)
+		}
+	}
+	for _, v := range []int{-56, 0x7fffffff, 0x12345678, 0x8000ffff} {
+		xrn := arm64LoadImmediate("W11", v)
+		if result := runArm64ImmediateSequence(t, xrn); result != int(uint32(v)) {
+			t.Errorf("Expected %#x, got %#x from\n%s", uint32(v), result, xrn)
+		}
+	}
+	if xrn := arm64LoadImmediate("X11", -5000000000); xrn != "  movn X11, #61951\n  movk X11, #54778, lsl #16\n  movk X11, #65534, lsl #32\n" {
+		t.Errorf("Expected movn and movk, got\n%s", xrn)
+	}
+}
+
+func TestCompileLoop(t *testing.T) {
+	ir := NewIR()
+	counter := ir.NewVirtualRegister()
+	ir.MoveConstant(counter, 10)
+	ir.MoveConstant(GetReturnRegister(), 0)
+	loop := ir.NewLabel()
+	ir.Label(loop)
+	ir.AddRegisters(GetReturnRegister(), GetReturnRegister(), counter)
+	ir.AddInstruction(Instruction{op: sub, ret: counter, arg1: counter, arg2: MakeConstant(ir.GetConstant(1))})
+	ir.Branch(counter, loop)
+	ir.Return()
+
+	result := Compile(ir, AARCH64_MACOS_NONE)
+	if !strings.Contains(result, "Lmain$L0:\n") || !strings.Contains(result, "  cbnz X11, Lmain$L0\n") {
+		t.Errorf("Expected a label and cbnz, got %s", result)
+	}
+}
+
+func TestCompileJumpWin(t *testing.T) {
+	ir := NewIR()
+	done := ir.NewLabel()
+	cond := ir.NewVirtualRegister()
+	ir.MoveConstant(cond, 1)
+	ir.MoveConstant(GetReturnRegister(), 1)
+	ir.Branch(cond, done)
+	ir.MoveConstant(GetReturnRegister(), 2)
+	ir.Jump(done)
+	ir.Label(done)
+	ir.Return()
+
+	result := Compile(ir, X64_WIN_GNU)
+	if !strings.Contains(result, "  test R12, R12\n  jnz .L0\n") || !strings.Contains(result, "  jmp .L0\n.L0:\n") {
+		t.Errorf("Expected test/jnz and jmp, got %s", result)
+	}
+}
+
+func TestCompileCompare(t *testing.T) {
+	makeIR := func() *IR {
+		ir := NewIR()
+		a := ir.NewVirtualRegister()
+		b := ir.NewVirtualRegister()
+		ir.MoveConstant(a, 1)
+		ir.MoveConstant(b, 2)
+		ir.UltRegisters(GetReturnRegister(), a, b)
+		ir.Return()
+		return ir
+	}
+
+	result := Compile(makeIR(), AARCH64_MACOS_NONE)
+	if !strings.Contains(result, "  cmp X11, X12\n  cset X0, lo\n") {
+		t.Errorf("Expected cmp and cset, got %s", result)
+	}
+	result = Compile(makeIR(), X64_WIN_GNU)
+	if !strings.Contains(result, "  cmp R12, R13\n  setb AL\n  movzx RAX, AL\n") {
+		t.Errorf("Expected cmp, setb and movzx, got %s", result)
+	}
+}
+
+const sizedProgram = `.constants 16, 0
+  %v1 = mov 16
+  %v2 = load8u [%v1 + 0]
+  %v3 = load16s [%v1 + 0]
+  %v4 = load32u [%v1 + 0]
+  %ret = load32s [%v1 + 0]
+  store8 %v2, [%v1 + 0]
+  store16 %v3, [%v1 + 0]
+  store32 %v4, [%v1 + 0]
+  ret
+`
+
+func TestCompileSizedLoadsAndStores(t *testing.T) {
+	cases := []struct {
+		target   string
+		expected []string
+	}{
+		{AARCH64_MACOS_NONE, []string{
+			"  ldrb W12, [X11, #0]\n",
+			"  ldrsh X13, [X11, #0]\n",
+			"  ldr W14, [X11, #0]\n",
+			"  ldrsw X0, [X11, #0]\n",
+			"  strb W12, [X11, #0]\n",
+			"  strh W13, [X11, #0]\n",
+			"  str W14, [X11, #0]\n",
+		}},
+		{X64_WIN_GNU, []string{
+			"  movzx R13, byte [R12]\n",
+			"  movsx R14, word [R12]\n",
+			"  mov R15D, dword [R12]\n",
+			"  movsxd RAX, dword [R12]\n",
+			"  mov byte [R12], R13B\n",
+			"  mov word [R12], R14W\n",
+			"  mov dword [R12], R15D\n",
+		}},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(sizedProgram))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result := Compile(ir, c.target)
+		for _, e := range c.expected {
+			if !strings.Contains(result, e) {
+				t.Errorf("Expected %q for %s, got\n%s", e, c.target, result)
+			}
+		}
+	}
+}
+
+const bitwiseProgram = `.types %v4 i8, %v5 i8
+  %v1 = mov 12
+  %v2 = mov 3
+  %v3 = and %v1, 10
+  %v3 = or %v3, %v1
+  %v3 = xor %v3, %v2
+  %v3 = shl %v3, %v2
+  %v3 = lshr %v3, 1
+  %v3 = ashr %v3, %v2
+  %v4 = trunc %v3
+  %v5 = trunc %v2
+  %v4 = lshr %v4, %v5
+  %v4 = not %v4
+  %v3 = sext8 %v4
+  %ret = neg %v3
+  ret
+`
+
+func TestCompileBitwise(t *testing.T) {
+	cases := []struct {
+		target   string
+		expected []string
+	}{
+		{AARCH64_MACOS_NONE, []string{
+			"  mov X13, #10\n  and X14, X11, X13\n",
+			"  orr X14, X14, X11\n",
+			"  eor X14, X14, X12\n",
+			"  lsl X14, X14, X12\n",
+			"  lsr X14, X14, #1\n",
+			"  asr X14, X14, X12\n",
+			// i8 values are sign extended, so are zero extended to shift right
+			"  uxtb W9, W15\n  lsr W15, W9, W13\n  sxtb W15, W15\n",
+			"  mvn W15, W15\n  sxtb W15, W15\n",
+			"  neg X0, X14\n",
+		}},
+		{X64_WIN_GNU, []string{
+			"  mov R10, R12\n  and R10, R14\n",
+			"  mov RCX, R13\n  shl R10, CL\n",
+			"  shr R10, 1\n",
+			"  mov RCX, R13\n  sar R10, CL\n",
+			"  mov RCX, R15\n  shr R10B, CL\n",
+			"  mov R10B, R11B\n  not R10B\n",
+			"  mov RAX, R11\n  neg RAX\n",
+		}},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(bitwiseProgram))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := CompileE(ir, c.target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, e := range c.expected {
+			if !strings.Contains(result, e) {
+				t.Errorf("Expected %q for %s, got\n%s", e, c.target, result)
+			}
+		}
+	}
+}
+
+// With undefined traps, so there are no checks around the divisions
+const divisionProgram = `.types %v3 i8, %v4 i8
+.traps undefined
+  %v1 = mov -7
+  %v2 = mov 2
+  %v1 = srem %v1, %v2
+  %v2 = udiv %v1, %v2
+  %v3 = trunc %v1
+  %v4 = trunc %v2
+  %v3 = urem %v3, %v4
+  %ret = sext8 %v3
+  %ret = div %ret, %v2
+  ret
+`
+
+func TestCompileDivision(t *testing.T) {
+	cases := []struct {
+		target   string
+		expected []string
+	}{
+		{AARCH64_MACOS_NONE, []string{
+			"  sdiv X16, X11, X12\n  msub X11, X16, X12, X11\n",
+			"  udiv X12, X11, X12\n",
+			"  uxtb W16, W13\n  uxtb W17, W14\n  udiv W13, W16, W17\n  msub W13, W13, W17, W16\n  sxtb W13, W13\n",
+			"  sdiv X0, X0, X12\n",
+		}},
+		{X64_WIN_GNU, []string{
+			"  mov R9, RAX\n  mov RCX, R13\n  mov RAX, R12\n  cqo\n  idiv RCX\n  mov R12, RDX\n  mov RAX, R9\n",
+			"  xor EDX, EDX\n  div RCX\n  mov R13, RAX\n",
+			"  movzx ECX, R15B\n  movzx EAX, R14B\n  xor EDX, EDX\n  div ECX\n  mov R14B, DL\n",
+			// The result is already in RAX
+			"  movsx RAX, R14B\n  mov RCX, R13\n  cqo\n  idiv RCX\n  pop R15\n",
+		}},
+		{RISCV64_LINUX_MUSL, []string{
+			"  rem t2, t2, t3\n  divu t3, t2, t3\n",
+			"  andi t5, t4, 255\n  andi t6, s1, 255\n  remu t4, t5, t6\n  slli t4, t4, 56\n  srai t4, t4, 56\n",
+			"  div a0, a0, t3\n",
+		}},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(divisionProgram))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := CompileE(ir, c.target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, e := range c.expected {
+			if !strings.Contains(result, e) {
+				t.Errorf("Expected %q for %s, got\n%s", e, c.target, result)
+			}
+		}
+	}
+}
+
+// The same divisions with the default policy, trapping, and with wrapping
+func TestCompileTrapPolicies(t *testing.T) {
+	cases := []struct {
+		traps    string
+		target   string
+		expected []string
+	}{
+		{"trap", AARCH64_MACOS_NONE, []string{
+			"  cbnz X12, Ldiv1_main\n  brk #1\nLdiv1_main:\n  sdiv X16, X11, X12\n",
+			"  cbnz X12, Ldiv2_main\n  brk #1\nLdiv2_main:\n  udiv X12, X11, X12\n",
+			"  cbz X12, Ltrap4_main\n  mov X16, #-9223372036854775808\n  cmn X12, #1\n  ccmp X0, X16, #0, eq\n  b.ne Ldiv4_main\nLtrap4_main:\n  brk #1\nLdiv4_main:\n  sdiv X0, X0, X12\n",
+		}},
+		{"wrap", AARCH64_MACOS_NONE, []string{
+			"  mov X12, #2\n  sdiv X16, X11, X12\n",
+		}},
+		{"trap", X64_WIN_GNU, []string{
+			// srem's quotient must not fault
+			"  cmp RCX, -1\n  je .neg@1\n  cqo\n  idiv RCX\n  jmp .div@1\n.neg@1:\n  neg RAX\n  xor EDX, EDX\n.div@1:\n  mov R12, RDX\n",
+			"  mov RAX, R12\n  xor EDX, EDX\n  div RCX\n  mov R13, RAX\n",
+			"  movsx RAX, R14B\n  mov RCX, R13\n  cqo\n  idiv RCX\n",
+		}},
+		{"wrap", X64_WIN_GNU, []string{
+			"  test RCX, RCX\n  jz .zero@1\n  cmp RCX, -1\n  je .neg@1\n  cqo\n  idiv RCX\n  jmp .div@1\n" +
+				".zero@1:\n  mov RDX, RAX\n  xor EAX, EAX\n  jmp .div@1\n.neg@1:\n  neg RAX\n  xor EDX, EDX\n.div@1:\n",
+			"  test RCX, RCX\n  jz .zero@2\n  xor EDX, EDX\n  div RCX\n  jmp .div@2\n.zero@2:\n  mov RDX, RAX\n  xor EAX, EAX\n.div@2:\n",
+		}},
+		{"trap", RISCV64_LINUX_MUSL, []string{
+			"  bnez t3, .Lmain$div$1\n  ebreak\n.Lmain$div$1:\n  rem t2, t2, t3\n",
+			"  beqz t3, .Lmain$trap$4\n  li t6, -1\n  bne t3, t6, .Lmain$div$4\n  li t6, -1\n  slli t6, t6, 63\n" +
+				"  bne a0, t6, .Lmain$div$4\n.Lmain$trap$4:\n  ebreak\n.Lmain$div$4:\n  div a0, a0, t3\n",
+		}},
+		// rem and remu already give the dividend for a zero divisor
+		{"wrap", RISCV64_LINUX_MUSL, []string{
+			"  li t3, 2\n  rem t2, t2, t3\n",
+			"  beqz t3, .Lmain$zero$1\n  divu t3, t2, t3\n  j .Lmain$div$1\n.Lmain$zero$1:\n  li t3, 0\n.Lmain$div$1:\n",
+		}},
+	}
+	for _, c := range cases {
+		text := strings.Replace(divisionProgram, ".traps undefined", ".traps "+c.traps, 1)
+		ir, err := ParseIR(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := CompileE(ir, c.target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, e := range c.expected {
+			if !strings.Contains(result, e) {
+				t.Errorf("Expected %q for %s with %s, got\n%s", e, c.target, c.traps, result)
+			}
+		}
+		if c.traps == "wrap" && c.target == AARCH64_MACOS_NONE && strings.Contains(result, "brk") {
+			t.Errorf("Expected no checks for %s with wrap, got\n%s", c.target, result)
+		}
+	}
+
+	// i8 and i16 are divided as 32 bit values, so only overflow needs a check
+	ir, err := ParseIR(strings.NewReader(".types %v1 i16\n%v1 = mov 7\n%v1 = div %v1, %v1\n%ret = sext16 %v1\nret\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := CompileE(ir, X64_WIN_GNU)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "  cdq\n  idiv ECX\n  cmp EAX, 32768\n  jne .div@1\n  ud2\n.div@1:\n"
+	if !strings.Contains(result, expected) {
+		t.Errorf("Expected %q, got\n%s", expected, result)
+	}
+}
+
+func TestLowerTwoAddress(t *testing.T) {
+	cases := []struct {
+		text     string
+		result   int
+		expected []string
+	}{
+		// %v1 is last used by the sub, so %v3 takes over its register
+		{"%v1 = mov 10\n%v2 = mov 3\n%v3 = sub %v1, %v2\n%ret = add %v3, %v2\nret\n", 10, []string{
+			"  mov R13, 3\n  sub R12, R13\n  mov RAX, R12\n  add RAX, R13\n",
+		}},
+		// Moving %v1 into %v2 would overwrite it, so sub computes into a
+		// scratch register and add swaps its operands
+		{"%v1 = mov 10\n%v2 = mov 3\n%v2 = sub %v1, %v2\n%v3 = add %v1, %v2\n%v3 = add %v1, %v3\n%ret = shl %v3, %v3\nret\n", 3623878656, []string{
+			"  mov R11, R12\n  sub R11, R13\n  mov R13, R11\n",
+			"  add R14, R13\n  add R14, R12\n",
+			"  mov RAX, R14\n  mov RCX, R14\n  shl RAX, CL\n",
+		}},
+		{".types %v1 f64, %v2 f64\n%v1 = mov 4621819117588971520\n%v2 = mov 4613937818241073152\n%v2 = fsub %v1, %v2\n%v1 = fadd %v1, %v2\n%ret = f64tosi %v1\nret\n", 17, []string{
+			"  movaps XMM1, XMM2\n  subsd XMM1, XMM3\n  movaps XMM3, XMM1\n  addsd XMM2, XMM3\n",
+		}},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(c.text))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := InterpretForArchitecture(ir, X64_WIN_GNU, InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if result != c.result {
+			t.Errorf("Expected %d for %q, got %d", c.result, c.text, result)
+		}
+		lowered, err := Lower(ir, X64_WIN_GNU)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for idx, instr := range lowered.instructions {
+			if instr.op.isTwoAddress() && instr.ret != instr.arg1 {
+				t.Errorf("Expected ret to be arg1, got %s", lowered.PrintInstruction(idx))
+			}
+		}
+		compiled, err := CompileE(ir, X64_WIN_GNU)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, e := range c.expected {
+			if !strings.Contains(compiled, e) {
+				t.Errorf("Expected %q, got\n%s", e, compiled)
+			}
+		}
+	}
+}
+
+// Enough values live at once to force spills on the arm64 and x86-64 targets
+const spillProgram = `.constants 1, 2, 3, 4, 5, 6, 7, 8
+  %v1 = mov 1
+  %v2 = mov 2
+  %v3 = mov 3
+  %v4 = mov 4
+  %v5 = mov 5
+  %v6 = mov 6
+  %v7 = mov 7
+  %v8 = mov 8
+  %v9 = mul %v1, %v2
+  %v9 = add %v9, %v3
+  %v9 = mul %v9, %v4
+  %v9 = sub %v9, %v5
+  %v9 = mul %v9, %v6
+  %v9 = add %v9, %v7
+  %v9 = div %v9, %v8
+  %ret = add %v9, %v1
+  ret
+`
+
+// Keeps n values live at once, then adds them up. riscv64 has registers
+// enough for spillProgram, so needs a wider one.
+func liveValuesProgram(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "  %%v%d = mov %d\n", i, i)
+	}
+	b.WriteString("  %ret = mov 0\n")
+	for i := n; i >= 1; i-- {
+		fmt.Fprintf(&b, "  %%ret = add %%ret, %%v%d\n", i)
+	}
+	b.WriteString("  ret\n")
+	return b.String()
+}
+
+const dialectProgram = `.types %v3 i8
+  %v1 = mov 7
+  %v2 = mov 2
+  %v3 = mov -128
+  %v3 = div %v3, %v3
+loop:
+  %v1 = mul %v1, %v2
+  store %v1, [%v2 + 8]
+  %v2 = load [%v2 + 8]
+  %ret = sext8 %v3
+  br %v1, loop
+  ret
+`
+
+func TestCompileDialects(t *testing.T) {
+	cases := []struct {
+		dialect  Dialect
+		expected string
+	}{
+		{DefaultDialect, "section .text\n\tglobal main\n\nmain:\n  push R12\n  push R13\n  push R14\n  mov R12, 7\n  mov R13, 2\n  mov R14B, -128\n" +
+			"  mov R9, RAX\n  movsx ECX, R14B\n  movsx EAX, R14B\n  cdq\n  idiv ECX\n  cmp EAX, 128\n  jne .div@1\n  ud2\n.div@1:\n" +
+			"  mov R14B, AL\n  mov RAX, R9\n.loop:\n  imul R12, R13\n  mov qword [R13 + 8], R12\n  mov R13, qword [R13 + 8]\n" +
+			"  movsx RAX, R14B\n  test R12, R12\n  jnz .loop\n  pop R14\n  pop R13\n  pop R12\n  ret\n"},
+		{GasIntelDialect, ".intel_syntax noprefix\n.text\n\t.globl main\n\nmain:\n  push r12\n  push r13\n  push r14\n  mov r12, 7\n  mov r13, 2\n  mov r14b, -128\n" +
+			"  mov r9, rax\n  movsx ecx, r14b\n  movsx eax, r14b\n  cdq\n  idiv ecx\n  cmp eax, 128\n  jne .Lmain$div$1\n  ud2\n.Lmain$div$1:\n" +
+			"  mov r14b, al\n  mov rax, r9\n.Lmain$loop:\n  imul r12, r13\n  mov qword ptr [r13 + 8], r12\n  mov r13, qword ptr [r13 + 8]\n" +
+			"  movsx rax, r14b\n  test r12, r12\n  jnz .Lmain$loop\n  pop r14\n  pop r13\n  pop r12\n  ret\n"},
+		{GasAttDialect, ".text\n\t.globl main\n\nmain:\n  push %r12\n  push %r13\n  push %r14\n  mov $7, %r12\n  mov $2, %r13\n  mov $-128, %r14b\n" +
+			"  mov %rax, %r9\n  movsbl %r14b, %ecx\n  movsbl %r14b, %eax\n  cltd\n  idiv %ecx\n  cmp $128, %eax\n  jne .Lmain$div$1\n  ud2\n.Lmain$div$1:\n" +
+			"  mov %al, %r14b\n  mov %r9, %rax\n.Lmain$loop:\n  imul %r13, %r12\n  mov %r12, 8(%r13)\n  mov 8(%r13), %r13\n" +
+			"  movsbq %r14b, %rax\n  test %r12, %r12\n  jnz .Lmain$loop\n  pop %r14\n  pop %r13\n  pop %r12\n  ret\n"},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(dialectProgram))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := CompileWithOptions(ir, X64_WIN_GNU, CompileOptions{Dialect: c.dialect})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", c.dialect, err)
+		}
+		if result != c.expected {
+			t.Errorf("Expected\n%s\nfor %s, got\n%s", c.expected, c.dialect, result)
+		}
+	}
+
+	// AT&T syntax names the sizes of extensions
+	ir, err := ParseIR(strings.NewReader(sizedProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := CompileWithOptions(ir, X64_WIN_GNU, CompileOptions{Dialect: GasAttDialect})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{"  movzbq (%r12), %r13\n", "  movswq (%r12), %r14\n", "  movslq (%r12), %rax\n", "  mov %r13b, (%r12)\n"} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %q, got\n%s", expected, result)
+		}
+	}
+	ir, err = ParseIR(strings.NewReader("%v1 = mov 16\n%ret = load8u [%v1 + -8]\nret\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result = Compile(ir, X64_WIN_GNU)
+	if !strings.Contains(result, "  movzx RAX, byte [R12 - 8]\n") {
+		t.Errorf("Expected a negative displacement, got\n%s", result)
+	}
+
+	// The arm64 backend only writes Apple's assembler syntax
+	ir, err = ParseIR(strings.NewReader(dialectProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := CompileWithOptions(ir, AARCH64_MACOS_NONE, CompileOptions{Dialect: GasAttDialect}); !errors.Is(err, ErrUnknownTarget) {
+		t.Errorf("Expected ErrUnknownTarget, got %v", err)
+	}
+	if _, err := CompileWithOptions(ir, AARCH64_MACOS_NONE, CompileOptions{}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestCompileWideImmediates(t *testing.T) {
+	text := `  %v1 = mov 7
+  %v2 = sub %v1, -5000000000
+  %v3 = lt %v2, 5000000008
+  %ret = add %v3, 5000000000
+  ret
+`
+	cases := []struct {
+		target   string
+		dialect  Dialect
+		expected []string
+	}{
+		{X64_WIN_GNU, NasmDialect, []string{
+			"  mov R13, -5000000000\n  sub R12, R13\n",
+			"  mov R14, 5000000008\n  cmp R12, R14\n",
+			"  mov R13, 5000000000\n  mov RAX, R15\n  add RAX, R13\n",
+		}},
+		{X64_LINUX_GNU, GasIntelDialect, []string{
+			"  mov r13, -5000000000\n  sub r12, r13\n",
+			"  mov r14, 5000000008\n  cmp r12, r14\n",
+			"  mov r13, 5000000000\n  mov rax, r15\n  add rax, r13\n",
+		}},
+		{X64_LINUX_GNU, GasAttDialect, []string{
+			"  mov $-5000000000, %r13\n  sub %r13, %r12\n",
+			"  mov $5000000008, %r14\n  cmp %r14, %r12\n",
+			"  mov $5000000000, %r13\n  mov %r15, %rax\n  add %r13, %rax\n",
+		}},
+		{AARCH64_MACOS_NONE, DefaultDialect, []string{
+			"  movk X12, #65534, lsl #32\n  sub X13, X11, X12\n",
+			"  movk X14, #1, lsl #32\n  cmp X13, X14\n",
+			"  movk X11, #1, lsl #32\n  add X0, X15, X11\n",
+		}},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := CompileWithOptions(ir, c.target, CompileOptions{Dialect: c.dialect})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, e := range c.expected {
+			if !strings.Contains(result, e) {
+				t.Errorf("Expected %q for %s, got\n%s", e, c.target, result)
+			}
+		}
+		interpreted, err := InterpretForArchitecture(ir, c.target, InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", c.target, err)
+		}
+		if interpreted != 5000000001 {
+			t.Errorf("Expected 5000000001 for %s, got %d", c.target, interpreted)
+		}
+	}
+}
+
+func TestInterpretForArchitecture(t *testing.T) {
+	for target, text := range map[string]string{
+		AARCH64_MACOS_NONE: spillProgram,
+		AARCH64_LINUX_GNU:  spillProgram,
+		X64_WIN_GNU:        spillProgram,
+		X64_LINUX_GNU:      spillProgram,
+		RISCV64_LINUX_MUSL: liveValuesProgram(20),
+	} {
+		ir, err := ParseIR(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		expected := Interpret(ir)
+		before := ir.Print()
+		lowered, err := Lower(ir, target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		spills := 0
+		for _, instr := range lowered.instructions {
+			if instr.op == store {
+				spills++
+			}
+		}
+		if spills == 0 {
+			t.Errorf("Expected spills for %s, got\n%s", target, lowered.Print())
+		}
+		result, err := InterpretForArchitecture(ir, target, InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if result != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, target, result)
+		}
+		// Lowering works on a copy
+		if ir.Print() != before {
+			t.Errorf("Expected the IR to be unchanged, got\n%s", ir.Print())
+		}
+	}
+}
+
+func TestInterpretModuleForArchitecture(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, target := range []string{AARCH64_MACOS_NONE, AARCH64_LINUX_GNU, X64_WIN_GNU, X64_LINUX_GNU, RISCV64_LINUX_MUSL} {
+		result, err := InterpretModuleForArchitecture(m, target, "main", InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if result != 117 {
+			t.Errorf("Expected 117 for %s, got %d", target, result)
+		}
+		result, err = InterpretModuleForArchitecture(m, target, "fact", InterpretOptions{}, 6)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if result != 720 {
+			t.Errorf("Expected 720 for %s, got %d", target, result)
+		}
+	}
+	if _, err := InterpretModuleForArchitecture(m, "pdp11-unix-none", "main", InterpretOptions{}); !errors.Is(err, ErrUnknownTarget) {
+		t.Errorf("Expected ErrUnknownTarget, got %v", err)
+	}
+}
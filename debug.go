@@ -0,0 +1,328 @@
+////////////////////////////////////////////////////////////////////////////////
+// Step debugger for the interpreter. //////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////
+
+package navm
+
+import (
+	"fmt"
+)
+
+// Why the debugger handed control back
+type StopReason int
+
+const (
+	StopStep       StopReason = iota
+	StopBreakpoint StopReason = iota
+	StopWatchpoint StopReason = iota
+	StopFinished   StopReason = iota
+)
+
+var stopReasonNames = []string{"step", "breakpoint", "watchpoint", "finished"}
+
+func (s StopReason) String() string {
+	if int(s) < 0 || int(s) >= len(stopReasonNames) {
+		return "unknown"
+	}
+	return stopReasonNames[s]
+}
+
+// An instruction in a function
+type Location struct {
+	Function string
+	Index    int
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("%s:%d", l.Function, l.Index)
+}
+
+// Where and why execution stopped. Location is the next instruction to run,
+// and is zero once the program has finished.
+type Stop struct {
+	Reason   StopReason
+	Location Location
+	Watch    string // the watchpoint that fired, e.g. "fact %v1" or "[16, 24)"
+}
+
+type registerWatch struct {
+	function string
+	register int
+}
+
+type memoryWatch struct {
+	addr int
+	size int
+}
+
+// Runs a program one instruction at a time. Breakpoints stop before the
+// instruction at a location runs; watchpoints stop after any instruction
+// that writes a watched register or memory range.
+type Debugger struct {
+	mc          *machine
+	tracer      Tracer // the caller's tracer, if any
+	breakpoints map[Location]bool
+	registers   map[registerWatch]bool
+	memory      []memoryWatch
+	hit         string // the watchpoint fired by the current instruction
+}
+
+// Verifies ir and prepares to debug it. Nothing runs until the first Step or
+// Continue. If opts sets Fuel, stepping past it returns ErrOutOfFuel.
+func NewDebugger(ir *IR, opts InterpretOptions) (*Debugger, error) {
+	if err := joinVerifyErrors(Verify(ir)); err != nil {
+		return nil, err
+	}
+	return newDebugger(&Module{functions: []*IR{ir}}, ir, nil, opts)
+}
+
+// Verifies m and prepares to debug its entry function with the given
+// arguments
+func NewModuleDebugger(m *Module, entry string, opts InterpretOptions, args ...int) (*Debugger, error) {
+	f := m.Function(entry)
+	if f == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFunction, entry)
+	}
+	if err := joinVerifyErrors(VerifyModule(m)); err != nil {
+		return nil, err
+	}
+	return newDebugger(m, f, args, opts)
+}
+
+func newDebugger(m *Module, entry *IR, args []int, opts InterpretOptions) (*Debugger, error) {
+	d := &Debugger{
+		tracer:      opts.Tracer,
+		breakpoints: make(map[Location]bool),
+		registers:   make(map[registerWatch]bool),
+	}
+	opts.Tracer = &debugTracer{d: d}
+	mc, err := newMachine(m, entry, args, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	d.mc = mc
+	return d, nil
+}
+
+func (d *Debugger) SetBreakpoint(function string, index int) {
+	d.breakpoints[Location{Function: function, Index: index}] = true
+}
+
+func (d *Debugger) ClearBreakpoint(function string, index int) {
+	delete(d.breakpoints, Location{Function: function, Index: index})
+}
+
+// Stops after any write to r in any activation of function
+func (d *Debugger) WatchRegister(function string, r Register) {
+	d.registers[registerWatch{function: function, register: r.value}] = true
+}
+
+// Stops after any store overlapping [addr, addr+size)
+func (d *Debugger) WatchMemory(addr int, size int) {
+	d.memory = append(d.memory, memoryWatch{addr: addr, size: size})
+}
+
+func (d *Debugger) ClearWatchpoints() {
+	d.registers = make(map[registerWatch]bool)
+	d.memory = nil
+}
+
+// Runs a single instruction
+func (d *Debugger) Step() (Stop, error) {
+	if d.mc.done {
+		return d.stop(StopFinished), nil
+	}
+	if err := d.step(); err != nil {
+		return d.stop(StopStep), err
+	}
+	if d.mc.done {
+		return d.stop(StopFinished), nil
+	}
+	if d.hit != "" {
+		return d.stop(StopWatchpoint), nil
+	}
+	return d.stop(StopStep), nil
+}
+
+// Like Step, but runs a call to completion unless a breakpoint or watchpoint
+// inside it stops first
+func (d *Debugger) StepOver() (Stop, error) {
+	if d.mc.done {
+		return d.stop(StopFinished), nil
+	}
+	f := d.mc.stack[len(d.mc.stack)-1]
+	if f.pc >= len(f.ir.instructions) || f.ir.instructions[f.pc].op != call {
+		return d.Step()
+	}
+	return d.runUntil(len(d.mc.stack))
+}
+
+// Runs until a breakpoint, a watchpoint or the end of the program
+func (d *Debugger) Continue() (Stop, error) {
+	return d.runUntil(0)
+}
+
+// Runs at least one instruction, then stops at a breakpoint, a watchpoint, the
+// end of the program or once the call stack is no deeper than depth
+func (d *Debugger) runUntil(depth int) (Stop, error) {
+	for first := true; ; first = false {
+		if d.mc.done {
+			return d.stop(StopFinished), nil
+		}
+		if !first && d.breakpoints[d.Location()] {
+			return d.stop(StopBreakpoint), nil
+		}
+		if !first && len(d.mc.stack) <= depth {
+			return d.stop(StopStep), nil
+		}
+		if err := d.step(); err != nil {
+			return d.stop(StopStep), err
+		}
+		if d.hit != "" && !d.mc.done {
+			return d.stop(StopWatchpoint), nil
+		}
+	}
+}
+
+func (d *Debugger) step() error {
+	d.hit = ""
+	return d.mc.step()
+}
+
+func (d *Debugger) stop(reason StopReason) Stop {
+	s := Stop{Reason: reason, Watch: d.hit}
+	if !d.mc.done {
+		s.Location = d.Location()
+	}
+	return s
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Inspection
+
+func (d *Debugger) Finished() bool {
+	return d.mc.done
+}
+
+// The entry function's return value, once Finished
+func (d *Debugger) Result() int {
+	return d.mc.result
+}
+
+// The next instruction to run
+func (d *Debugger) Location() Location {
+	if d.mc.done {
+		return Location{}
+	}
+	f := d.mc.stack[len(d.mc.stack)-1]
+	return Location{Function: f.ir.Name(), Index: f.pc}
+}
+
+// The text of the next instruction to run, or "" if the current function has
+// run off its end
+func (d *Debugger) Instruction() string {
+	if d.mc.done {
+		return ""
+	}
+	f := d.mc.stack[len(d.mc.stack)-1]
+	if f.pc >= len(f.ir.instructions) {
+		return ""
+	}
+	return f.ir.PrintInstruction(f.pc)
+}
+
+// The active call stack, innermost call last. Each location is the next
+// instruction to run in that frame.
+func (d *Debugger) Backtrace() []Location {
+	locations := make([]Location, len(d.mc.stack))
+	for idx, f := range d.mc.stack {
+		locations[idx] = Location{Function: f.ir.Name(), Index: f.pc}
+	}
+	return locations
+}
+
+// The registers of the current frame, indexed by virtual register number
+func (d *Debugger) Registers() []int {
+	if d.mc.done {
+		return nil
+	}
+	r := d.mc.stack[len(d.mc.stack)-1].runtime
+	registers := make([]int, len(r.registers))
+	copy(registers, r.registers)
+	return registers
+}
+
+// Reads a virtual register or %ret in the current frame, or %sp
+func (d *Debugger) Register(reg Register) (int, error) {
+	if reg.registerType == physicalRegister && reg.value == STACK_POINTER_REGISTER {
+		return d.mc.stackPointer, nil
+	}
+	if d.mc.done {
+		if reg.registerType == virtualRegister && reg.value == RETURN_REGISTER {
+			return d.mc.result, nil
+		}
+		return 0, fmt.Errorf("%w: program has finished", ErrInvalidOperand)
+	}
+	r := d.mc.stack[len(d.mc.stack)-1].runtime
+	if reg.registerType != virtualRegister || (reg.value != RETURN_REGISTER && (reg.value <= 0 || reg.value >= len(r.registers))) {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidOperand, printRegister(reg))
+	}
+	return r.getRegister(reg.value), nil
+}
+
+// A copy of the bytes in [addr, addr+size)
+func (d *Debugger) Memory(addr int, size int) ([]byte, error) {
+	if addr < 0 || size < 0 || size > len(d.mc.memory) || addr > len(d.mc.memory)-size {
+		return nil, fmt.Errorf("%w: [%d, %d)", ErrOutOfBounds, addr, addr+size)
+	}
+	bytes := make([]byte, size)
+	copy(bytes, d.mc.memory[addr:addr+size])
+	return bytes, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Watchpoints
+
+// Checks writes against the watchpoints, then passes every event on to the
+// caller's tracer
+type debugTracer struct {
+	d *Debugger
+}
+
+func (t *debugTracer) BeforeInstruction(ir *IR, index int) {
+	if t.d.tracer != nil {
+		t.d.tracer.BeforeInstruction(ir, index)
+	}
+}
+
+func (t *debugTracer) AfterInstruction(ir *IR, index int) {
+	if t.d.tracer != nil {
+		t.d.tracer.AfterInstruction(ir, index)
+	}
+}
+
+func (t *debugTracer) RegisterWrite(ir *IR, r Register, old int, value int) {
+	if t.d.registers[registerWatch{function: ir.Name(), register: r.value}] {
+		t.d.hit = ir.Name() + " " + printRegister(r)
+	}
+	if t.d.tracer != nil {
+		t.d.tracer.RegisterWrite(ir, r, old, value)
+	}
+}
+
+func (t *debugTracer) MemoryRead(ir *IR, addr int, size int, value int) {
+	if t.d.tracer != nil {
+		t.d.tracer.MemoryRead(ir, addr, size, value)
+	}
+}
+
+func (t *debugTracer) MemoryWrite(ir *IR, addr int, size int, value int) {
+	for _, w := range t.d.memory {
+		if addr < w.addr+w.size && w.addr < addr+size {
+			t.d.hit = fmt.Sprintf("[%d, %d)", w.addr, w.addr+w.size)
+		}
+	}
+	if t.d.tracer != nil {
+		t.d.tracer.MemoryWrite(ir, addr, size, value)
+	}
+}
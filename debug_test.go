@@ -0,0 +1,156 @@
+package navm
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+func newFactorialDebugger(t *testing.T, n int) *Debugger {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	d, err := NewModuleDebugger(m, "fact", InterpretOptions{}, n)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return d
+}
+
+func callIndex(t *testing.T, d *Debugger) int {
+	for !d.Finished() {
+		if strings.Contains(d.Instruction(), "call") {
+			return d.Location().Index
+		}
+		if _, err := d.Step(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	t.Fatalf("Expected a call instruction")
+	return 0
+}
+
+func TestDebuggerStep(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(traceProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	d, err := NewDebugger(ir, InterpretOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if d.Instruction() != "%v1 = mov 5" {
+		t.Errorf("Expected %%v1 = mov 5, got %s", d.Instruction())
+	}
+	stop, err := d.Step()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if stop.Reason != StopStep || stop.Location != (Location{Function: "main", Index: 1}) {
+		t.Errorf("Expected a step to main:1, got %s at %s", stop.Reason, stop.Location)
+	}
+	if v, _ := d.Register(MakeVirtualRegister(1)); v != 5 {
+		t.Errorf("Expected %%v1 = 5, got %d", v)
+	}
+	d.Step()
+	mem, err := d.Memory(21, 8)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if mem[0] != 5 {
+		t.Errorf("Expected 5 stored little-endian at 21, got %v", mem)
+	}
+	if _, err := d.Memory(1020, 8); !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Expected ErrOutOfBounds, got %v", err)
+	}
+	if _, err := d.Memory(math.MaxInt-2, 8); !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Expected ErrOutOfBounds, got %v", err)
+	}
+	stop, _ = d.Continue()
+	if stop.Reason != StopFinished || d.Result() != 5 {
+		t.Errorf("Expected to finish with 5, got %s with %d", stop.Reason, d.Result())
+	}
+	stop, _ = d.Step()
+	if stop.Reason != StopFinished {
+		t.Errorf("Expected finished, got %s", stop.Reason)
+	}
+}
+
+func TestDebuggerBreakpoint(t *testing.T) {
+	d := newFactorialDebugger(t, 3)
+	d.SetBreakpoint("fact", 0)
+	// fact(3) -> fact(2) -> fact(1), so three activations hit the breakpoint
+	// and the first is already past it
+	for depth := 2; depth <= 3; depth++ {
+		stop, err := d.Continue()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if stop.Reason != StopBreakpoint || stop.Location.Index != 0 {
+			t.Fatalf("Expected a breakpoint at fact:0, got %s at %s", stop.Reason, stop.Location)
+		}
+		if len(d.Backtrace()) != depth {
+			t.Errorf("Expected %d frames, got %d", depth, len(d.Backtrace()))
+		}
+	}
+	d.ClearBreakpoint("fact", 0)
+	stop, _ := d.Continue()
+	if stop.Reason != StopFinished || d.Result() != 6 {
+		t.Errorf("Expected to finish with 6, got %s with %d", stop.Reason, d.Result())
+	}
+}
+
+func TestDebuggerStepOver(t *testing.T) {
+	d := newFactorialDebugger(t, 4)
+	index := callIndex(t, d)
+	stop, err := d.StepOver()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if stop.Reason != StopStep || stop.Location.Index != index+1 || len(d.Backtrace()) != 1 {
+		t.Errorf("Expected to stop after the call in the outer frame, got %s at %s with %d frames", stop.Reason, stop.Location, len(d.Backtrace()))
+	}
+
+	d = newFactorialDebugger(t, 4)
+	callIndex(t, d)
+	d.Step()
+	if len(d.Backtrace()) != 2 {
+		t.Errorf("Expected Step to enter the call, got %d frames", len(d.Backtrace()))
+	}
+}
+
+func TestDebuggerWatchpoints(t *testing.T) {
+	d := newFactorialDebugger(t, 3)
+	d.WatchRegister("fact", GetReturnRegister())
+	stop, err := d.Continue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if stop.Reason != StopWatchpoint || stop.Watch != "fact %ret" {
+		t.Errorf("Expected the %%ret watchpoint, got %s %q", stop.Reason, stop.Watch)
+	}
+
+	ir, err := ParseIR(strings.NewReader(traceProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	d, err = NewDebugger(ir, InterpretOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	d.WatchMemory(24, 4)
+	stop, _ = d.Continue()
+	if stop.Reason != StopWatchpoint || stop.Location.Index != 2 || stop.Watch != "[24, 28)" {
+		t.Errorf("Expected the memory watchpoint after the store, got %s at %s %q", stop.Reason, stop.Location, stop.Watch)
+	}
+	d.ClearWatchpoints()
+	stop, _ = d.Continue()
+	if stop.Reason != StopFinished {
+		t.Errorf("Expected finished, got %s", stop.Reason)
+	}
+}
@@ -0,0 +1,463 @@
+////////////////////////////////////////////////////////////////////////////////
+// Binary serialization of IR. /////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////
+
+package navm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Layout, all integers are varints (signed values zig-zag encoded):
+//
+//	magic       "NAVM"
+//	version     uvarint
+//	function
+//
+// A module is the magic "NMOD", a uvarint version, a uvarint count and then
+// that many functions. A function is:
+//
+//	name        uvarint length and the name, then uvarint parameter count
+//	            (since version 3)
+//	registers   uvarint, IR.registersLength
+//	types       uvarint count, then one uvarint Type per virtual register
+//	            (since version 4)
+//	traps       uvarint TrapPolicy (since version 5)
+//	constants   uvarint count, then one varint per constant
+//	labels      uvarint count, then per label a uvarint length and the name
+//	            (since version 2)
+//	functions   uvarint count, then per called function a uvarint length and
+//	            the name (since version 3)
+//	xrns        uvarint count, then per instruction:
+//	  op        uvarint
+//	  typ       uvarint Type (since version 4)
+//	  ret       register
+//	  arg1      register
+//	  arg2      uvarint argType<<2 | spilledBase<<1 | isVirtualRegister
+//	            (argType<<1 | isVirtualRegister before version 6), then if
+//	            argType is set varint value, and for addresses varint
+//	            offsetConstant
+//	  traps     for divisions only, uvarint TrapPolicy (since version 5)
+//	  args      for calls only, uvarint count and then registers (since
+//	            version 3)
+//
+// A register is a uvarint registerType, followed by a varint value unless the
+// type is noRegisterType. Lowered IR can be encoded too, so physical registers
+// include the argument registers, with values from ARGUMENT_REGISTER_0 down.
+//
+// Compatibility policy: Op, Type, RegisterType and ArgType values are never
+// renumbered, new values are only appended, so an older file never contains a
+// value that means something else today. The version is bumped whenever the
+// layout itself changes, and UnmarshalBinary keeps decoding every version up
+// to encodingVersion. Files with a newer version are rejected.
+
+const encodingMagic = "NAVM"
+const moduleEncodingMagic = "NMOD"
+const encodingVersion = 6
+
+var ErrInvalidEncoding = errors.New("invalid navm encoding")
+
+func (ir *IR) MarshalBinary() ([]byte, error) {
+	buf := []byte(encodingMagic)
+	buf = binary.AppendUvarint(buf, encodingVersion)
+	return appendFunction(buf, ir), nil
+}
+
+func (m *Module) MarshalBinary() ([]byte, error) {
+	buf := []byte(moduleEncodingMagic)
+	buf = binary.AppendUvarint(buf, encodingVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(m.functions)))
+	for _, f := range m.functions {
+		buf = appendFunction(buf, f)
+	}
+	return buf, nil
+}
+
+func appendFunction(buf []byte, ir *IR) []byte {
+	buf = appendString(buf, ir.name)
+	buf = binary.AppendUvarint(buf, uint64(ir.paramCount))
+	buf = binary.AppendUvarint(buf, uint64(ir.registersLength))
+	buf = binary.AppendUvarint(buf, uint64(len(ir.types)))
+	for _, t := range ir.types {
+		buf = binary.AppendUvarint(buf, uint64(t))
+	}
+	buf = binary.AppendUvarint(buf, uint64(ir.traps))
+	buf = binary.AppendUvarint(buf, uint64(len(ir.constants)))
+	for _, c := range ir.constants {
+		buf = binary.AppendVarint(buf, int64(c))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(ir.labels)))
+	for _, l := range ir.labels {
+		buf = appendString(buf, l)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(ir.functions)))
+	for _, f := range ir.functions {
+		buf = appendString(buf, f)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(ir.instructions)))
+	for _, instr := range ir.instructions {
+		buf = binary.AppendUvarint(buf, uint64(instr.op))
+		buf = binary.AppendUvarint(buf, uint64(instr.typ))
+		buf = appendRegister(buf, instr.ret)
+		buf = appendRegister(buf, instr.arg1)
+		buf = appendArg(buf, instr.arg2)
+		if instr.op.isDivision() {
+			buf = binary.AppendUvarint(buf, uint64(instr.traps))
+		}
+		if instr.op == call {
+			buf = binary.AppendUvarint(buf, uint64(len(instr.args)))
+			for _, a := range instr.args {
+				buf = appendRegister(buf, a)
+			}
+		}
+	}
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendRegister(buf []byte, r Register) []byte {
+	buf = binary.AppendUvarint(buf, uint64(r.registerType))
+	if r.registerType == noRegisterType {
+		return buf
+	}
+	return binary.AppendVarint(buf, int64(r.value))
+}
+
+func appendArg(buf []byte, a Arg) []byte {
+	header := uint64(a.argType) << 2
+	if a.spilledBase {
+		header |= 2
+	}
+	if a.isVirtualRegister {
+		header |= 1
+	}
+	buf = binary.AppendUvarint(buf, header)
+	if a.argType == noArgType {
+		return buf
+	}
+	buf = binary.AppendVarint(buf, int64(a.value))
+	if a.argType == address {
+		buf = binary.AppendVarint(buf, int64(a.offsetConstant))
+	}
+	return buf
+}
+
+// Decodes IR written by MarshalBinary, replacing the contents of ir. The
+// decoded IR is validated, so indices into the constant pool and register
+// numbers are known to be in range.
+func (ir *IR) UnmarshalBinary(data []byte) error {
+	d, version, err := newDecoder(data, encodingMagic)
+	if err != nil {
+		return err
+	}
+	decoded := d.function(version)
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if err := validateDecoded(decoded); err != nil {
+		return err
+	}
+	*ir = *decoded
+	return nil
+}
+
+// Decodes a module written by Module.MarshalBinary, replacing its contents
+func (m *Module) UnmarshalBinary(data []byte) error {
+	d, version, err := newDecoder(data, moduleEncodingMagic)
+	if err != nil {
+		return err
+	}
+	decoded := Module{}
+	functionsLength := d.length()
+	for i := 0; i < functionsLength && d.err == nil; i++ {
+		decoded.functions = append(decoded.functions, d.function(version))
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	for idx, f := range decoded.functions {
+		if err := validateDecoded(f); err != nil {
+			return err
+		}
+		for _, other := range decoded.functions[:idx] {
+			if other.Name() == f.Name() {
+				return fmt.Errorf("%w: duplicate function %s", ErrInvalidEncoding, f.Name())
+			}
+		}
+	}
+	*m = decoded
+	return nil
+}
+
+func newDecoder(data []byte, magic string) (*decoder, uint64, error) {
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, 0, fmt.Errorf("%w: missing magic header", ErrInvalidEncoding)
+	}
+	d := &decoder{r: bytes.NewReader(data[len(magic):])}
+	version := d.uvarint()
+	if d.err != nil {
+		return nil, 0, d.err
+	}
+	if version == 0 || version > encodingVersion {
+		return nil, 0, fmt.Errorf("%w: unsupported version %d", ErrInvalidEncoding, version)
+	}
+	return d, version, nil
+}
+
+// Checks that everything was decoded without error, and nothing is left over
+func (d *decoder) finish() error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.r.Len() != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidEncoding, d.r.Len())
+	}
+	return nil
+}
+
+func (d *decoder) function(version uint64) *IR {
+	decoded := &IR{}
+	if version >= 3 {
+		decoded.name = d.string()
+		decoded.paramCount = d.count()
+	}
+	decoded.registersLength = d.count()
+	if version >= 4 {
+		typesLength := d.length()
+		for i := 0; i < typesLength && d.err == nil; i++ {
+			decoded.types = append(decoded.types, Type(d.count()))
+		}
+	}
+	if version >= 5 {
+		decoded.traps = TrapPolicy(d.count())
+	}
+	constantsLength := d.length()
+	for i := 0; i < constantsLength && d.err == nil; i++ {
+		decoded.constants = append(decoded.constants, d.varint())
+	}
+	if version >= 2 {
+		labelsLength := d.length()
+		for i := 0; i < labelsLength && d.err == nil; i++ {
+			decoded.labels = append(decoded.labels, d.string())
+		}
+	}
+	if version >= 3 {
+		functionsLength := d.length()
+		for i := 0; i < functionsLength && d.err == nil; i++ {
+			decoded.functions = append(decoded.functions, d.string())
+		}
+	}
+	instructionsLength := d.length()
+	for i := 0; i < instructionsLength && d.err == nil; i++ {
+		instr := Instruction{}
+		instr.op = Op(d.uvarint())
+		if version >= 4 {
+			instr.typ = Type(d.count())
+		}
+		instr.ret = d.register()
+		instr.arg1 = d.register()
+		instr.arg2 = d.arg(version)
+		if instr.op.isDivision() && version >= 5 {
+			instr.traps = TrapPolicy(d.count())
+		}
+		if instr.op == call && version >= 3 {
+			argsLength := d.length()
+			for j := 0; j < argsLength && d.err == nil; j++ {
+				instr.args = append(instr.args, d.register())
+			}
+		}
+		decoded.instructions = append(decoded.instructions, instr)
+	}
+	return decoded
+}
+
+func validateDecoded(ir *IR) error {
+	if ir.registersLength < ir.paramCount+1 {
+		return fmt.Errorf("%w: register count must be at least the parameter count plus 1", ErrInvalidEncoding)
+	}
+	if len(ir.types) > ir.registersLength {
+		return fmt.Errorf("%w: more register types than registers", ErrInvalidEncoding)
+	}
+	for r, t := range ir.types {
+		if !t.valid() {
+			return fmt.Errorf("%w: register %d has unknown type %d", ErrInvalidEncoding, r, t)
+		}
+	}
+	if !ir.traps.valid() {
+		return fmt.Errorf("%w: unknown trap policy %d", ErrInvalidEncoding, ir.traps)
+	}
+	validRegister := func(r Register) bool {
+		switch r.registerType {
+		case noRegisterType:
+			return true
+		case virtualRegister:
+			return r.value < ir.registersLength && (r.value > 0 || r.value == RETURN_REGISTER || r.value == STACK_POINTER_REGISTER)
+		case physicalRegister:
+			return r.value > 0 || r.value == RETURN_REGISTER || r.value == STACK_POINTER_REGISTER || r.value <= ARGUMENT_REGISTER_0
+		case stackRegister:
+			return r.value > 0 || r.value == RETURN_REGISTER || r.value == STACK_POINTER_REGISTER
+		default:
+			return false
+		}
+	}
+	validConstant := func(c int) bool {
+		return c >= 0 && c < len(ir.constants)
+	}
+	for idx, instr := range ir.instructions {
+		if instr.op <= noOp || int(instr.op) >= len(opNames) {
+			return fmt.Errorf("%w: instruction %d has unknown op %d", ErrInvalidEncoding, idx, instr.op)
+		}
+		if !instr.typ.valid() {
+			return fmt.Errorf("%w: instruction %d has unknown type %d", ErrInvalidEncoding, idx, instr.typ)
+		}
+		if !instr.traps.valid() {
+			return fmt.Errorf("%w: instruction %d has unknown trap policy %d", ErrInvalidEncoding, idx, instr.traps)
+		}
+		if instr.arg2.spilledBase && instr.arg2.argType != address {
+			return fmt.Errorf("%w: instruction %d has a spilled base outside an address", ErrInvalidEncoding, idx)
+		}
+		if !validRegister(instr.ret) || !validRegister(instr.arg1) {
+			return fmt.Errorf("%w: instruction %d has an invalid register", ErrInvalidEncoding, idx)
+		}
+		for _, a := range instr.args {
+			if !validRegister(a) {
+				return fmt.Errorf("%w: instruction %d has an invalid register", ErrInvalidEncoding, idx)
+			}
+		}
+		switch instr.arg2.argType {
+		case noArgType:
+		case constant:
+			if !validConstant(instr.arg2.value) {
+				return fmt.Errorf("%w: instruction %d references constant %d out of range", ErrInvalidEncoding, idx, instr.arg2.value)
+			}
+		case registerArg, stackArg:
+			if !validRegister(instr.arg2.register()) {
+				return fmt.Errorf("%w: instruction %d has an invalid register", ErrInvalidEncoding, idx)
+			}
+		case labelArg:
+			if instr.arg2.value < 0 || instr.arg2.value >= len(ir.labels) {
+				return fmt.Errorf("%w: instruction %d references label %d out of range", ErrInvalidEncoding, idx, instr.arg2.value)
+			}
+		case functionArg:
+			if instr.arg2.value < 0 || instr.arg2.value >= len(ir.functions) {
+				return fmt.Errorf("%w: instruction %d references function %d out of range", ErrInvalidEncoding, idx, instr.arg2.value)
+			}
+		case address:
+			if !validRegister(instr.arg2.register()) {
+				return fmt.Errorf("%w: instruction %d has an invalid register", ErrInvalidEncoding, idx)
+			}
+			if !validConstant(instr.arg2.offsetConstant) {
+				return fmt.Errorf("%w: instruction %d references constant %d out of range", ErrInvalidEncoding, idx, instr.arg2.offsetConstant)
+			}
+		default:
+			return fmt.Errorf("%w: instruction %d has unknown argument type %d", ErrInvalidEncoding, idx, instr.arg2.argType)
+		}
+	}
+	return nil
+}
+
+// Reads varints, remembering the first error so callers can check once
+type decoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err != nil {
+		return
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	d.err = fmt.Errorf("%w: %s", ErrInvalidEncoding, err.Error())
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return v
+}
+
+func (d *decoder) varint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return int(v)
+}
+
+// Reads a number that must fit comfortably in an int
+func (d *decoder) count() int {
+	v := d.uvarint()
+	if d.err == nil && v > 1<<31 {
+		d.fail(errors.New("count out of range"))
+		return 0
+	}
+	return int(v)
+}
+
+// Reads the length of a list, which can never exceed the number of
+// remaining bytes
+func (d *decoder) length() int {
+	v := d.uvarint()
+	if d.err == nil && v > uint64(d.r.Len()) {
+		d.fail(errors.New("length out of range"))
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) string() string {
+	n := d.length()
+	if d.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.fail(err)
+	}
+	return string(b)
+}
+
+func (d *decoder) register() Register {
+	r := Register{registerType: RegisterType(d.uvarint())}
+	if r.registerType != noRegisterType {
+		r.value = d.varint()
+	}
+	return r
+}
+
+func (d *decoder) arg(version uint64) Arg {
+	header := d.uvarint()
+	a := Arg{isVirtualRegister: header&1 == 1}
+	if version >= 6 {
+		a.argType = ArgType(header >> 2)
+		a.spilledBase = header&2 != 0
+	} else {
+		a.argType = ArgType(header >> 1)
+	}
+	if a.argType == noArgType {
+		return a
+	}
+	a.value = d.varint()
+	if a.argType == address {
+		a.offsetConstant = d.varint()
+	}
+	return a
+}
@@ -0,0 +1,283 @@
+package navm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	text := `.registers 5
+.constants 1, -2, 16, 1234567890123
+  %sp = sub %sp, 16
+  %v1 = mov 1234567890123
+  %v2 = add %v1, -2
+  %v3 = div %v2, %v1
+  store %v3, [%sp + 16]
+  %v4 = load [%v1 - 2]
+  %ret = sub %v4, %v1
+  %p3 = mov %s1
+loop:
+  br %v1, loop
+  jmp end
+end:
+  ret
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, err := ir.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	decoded := &IR{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if decoded.Print() != text {
+		t.Errorf("Expected\n%s\ngot\n%s", text, decoded.Print())
+	}
+}
+
+func TestUnmarshalVersion1(t *testing.T) {
+	// %ret = add %ret, 2; ret, as written by version 1
+	data := []byte{'N', 'A', 'V', 'M', 1, 2, 2, 2, 4, 2, 1, 1, 3, 1, 3, 4, 2, 8, 0, 0, 0}
+	ir := &IR{}
+	if err := ir.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result := Interpret(ir)
+	if result != 2 {
+		t.Errorf("Expected 2, got %d", result)
+	}
+}
+
+// Payloads written by earlier versions of MarshalBinary, which must keep
+// decoding to the same IR
+func TestUnmarshalOlderVersions(t *testing.T) {
+	cases := []struct {
+		data     []byte
+		expected string
+	}{
+		// Version 1: instructions, constants and addresses
+		{[]byte{
+			'N', 'A', 'V', 'M', 1, 5, 4, 2, 3, 32, 150, 147, 216, 159, 238, 71, 9, 3, 2, 1, 2, 1,
+			4, 4, 2, 1, 2, 0, 4, 6, 1, 1, 4, 1, 2, 4, 2, 5, 1, 6, 1, 4, 3, 2, 7, 0, 1, 6, 6, 1,
+			4, 6, 1, 8, 0, 7, 2, 2, 3, 1, 3, 1, 8, 3, 2, 2, 2, 6, 0, 8, 2, 8, 0, 0, 0,
+		}, `.registers 5
+.constants 1, -2, 16, 1234567890123
+  %sp = sub %sp, 16
+  %v1 = mov 1234567890123
+  %v2 = add %v1, -2
+  %v3 = div %v2, %v1
+  store %v3, [%sp + 16]
+  %v4 = load [%v1 - 2]
+  %ret = sub %v4, %v1
+  %p3 = mov %s1
+  ret
+`},
+		// Version 2: labels, jmp and br
+		{[]byte{
+			'N', 'A', 'V', 'M', 2, 3, 2, 6, 2, 2, 4, 108, 111, 111, 112, 3, 101, 110, 100, 9, 2,
+			1, 2, 0, 4, 0, 9, 0, 0, 10, 0, 3, 1, 2, 1, 2, 4, 2, 11, 0, 1, 2, 10, 0, 10, 0, 0, 10,
+			2, 2, 1, 4, 0, 4, 2, 9, 0, 0, 10, 2, 2, 1, 3, 0, 3, 2, 8, 0, 0, 0,
+		}, `.registers 3
+.constants 3, 1
+  %v1 = mov 3
+loop:
+  %v1 = sub %v1, 1
+  br %v1, loop
+  jmp end
+  %v2 = mov 1
+end:
+  %ret = mov %v1
+  ret
+`},
+		// Version 3: a named function with a parameter and a call
+		{[]byte{
+			'N', 'A', 'V', 'M', 3, 4, 102, 97, 99, 116, 1, 5, 1, 2, 1, 4, 98, 97, 115, 101, 1, 4,
+			102, 97, 99, 116, 9, 15, 1, 4, 1, 2, 4, 0, 11, 0, 1, 4, 10, 0, 3, 1, 6, 1, 2, 4, 0,
+			22, 1, 8, 0, 12, 0, 1, 1, 6, 4, 1, 3, 1, 2, 3, 8, 8, 0, 0, 0, 9, 0, 0, 10, 0, 2, 1,
+			3, 0, 4, 0, 8, 0, 0, 0,
+		}, `.func fact 1
+.registers 5
+.constants 1
+  %v2 = le %v1, 1
+  br %v2, base
+  %v3 = sub %v1, 1
+  %v4 = call @fact(%v3)
+  %ret = mul %v1, %v4
+  ret
+base:
+  %ret = mov 1
+  ret
+`},
+		// Version 4: register and instruction types
+		{[]byte{
+			'N', 'A', 'V', 'M', 4, 0, 0, 5, 5, 0, 2, 2, 4, 3, 2, 200, 1, 0, 0, 0, 7, 2, 0, 1, 2,
+			0, 4, 0, 1, 0, 1, 4, 1, 2, 3, 2, 32, 0, 1, 6, 0, 3, 4, 38, 0, 1, 8, 0, 3, 6, 5, 0, 1,
+			6, 1, 6, 3, 6, 36, 0, 1, 3, 0, 3, 8, 8, 0, 0, 0, 0,
+		}, `.registers 5
+.types %v1 i8, %v2 i8, %v3 i32, %v4 i16
+.constants 100, 0
+  %v1 = mov 100
+  %v2 = add %v1, %v1
+  %v3 = sext8 %v2
+  %v4 = trunc %v3
+  %v3 = div %v3, %v3
+  %ret = zext16 %v4
+  ret
+`},
+		// Version 5: trap policies
+		{[]byte{
+			'N', 'A', 'V', 'M', 5, 0, 0, 3, 0, 2, 1, 14, 0, 0, 4, 2, 0, 1, 2, 0, 4, 0, 5, 0, 1, 4, 1,
+			2, 3, 2, 1, 63, 0, 1, 3, 1, 2, 3, 4, 0, 8, 0, 0, 0, 0,
+		}, `.registers 3
+.traps wrap
+.constants 7
+  %v1 = mov 7
+  %v2 = div.trap %v1, %v1
+  %ret = urem %v1, %v2
+  ret
+`},
+	}
+	for _, c := range cases {
+		decoded := &IR{}
+		if err := decoded.UnmarshalBinary(c.data); err != nil {
+			t.Fatalf("Unexpected error for version %d: %s", c.data[4], err)
+		}
+		if decoded.Print() != c.expected {
+			t.Errorf("Expected\n%s\ngot\n%s", c.expected, decoded.Print())
+		}
+	}
+}
+
+// IR from Lower uses physical, argument and stack registers
+func TestMarshalLowered(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, target := range []string{AARCH64_MACOS_NONE, X64_WIN_GNU, RISCV64_LINUX_MUSL} {
+		lowered, err := LowerModule(m, target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		data, err := lowered.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		decoded := &Module{}
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if decoded.Print() != lowered.Print() {
+			t.Errorf("Expected\n%s\ngot\n%s", lowered.Print(), decoded.Print())
+		}
+	}
+
+	// Addresses with a spilled base only exist during allocation, but are
+	// encoded all the same
+	ir := NewIR()
+	arg := Arg{argType: address, value: 2, offsetConstant: ir.GetConstant(8), spilledBase: true}
+	ir.AddInstruction(Instruction{op: load, ret: MakePhysicalRegister(1), arg2: arg})
+	ir.Return()
+	data, _ := ir.MarshalBinary()
+	decoded := &IR{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if decoded.instructions[0].arg2 != arg {
+		t.Errorf("Expected %v, got %v", arg, decoded.instructions[0].arg2)
+	}
+}
+
+func TestUnmarshalFutureVersion(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(typedProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, _ := ir.MarshalBinary()
+	if data[4] != encodingVersion {
+		t.Fatalf("Expected version %d, got %d", encodingVersion, data[4])
+	}
+	data[4] = encodingVersion + 1
+	decoded := NewIR()
+	err = decoded.UnmarshalBinary(data)
+	if !errors.Is(err, ErrInvalidEncoding) || !strings.Contains(err.Error(), "unsupported version") {
+		t.Errorf("Expected an unsupported version error, got %v", err)
+	}
+	if len(decoded.instructions) != 0 {
+		t.Errorf("IR should be unchanged after a failed decode")
+	}
+
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, _ = m.MarshalBinary()
+	data[4] = encodingVersion + 1
+	if err := (&Module{}).UnmarshalBinary(data); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Expected ErrInvalidEncoding, got %v", err)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	ir := NewIR()
+	r1 := ir.NewVirtualRegister()
+	ir.MoveConstant(r1, 7)
+	ir.AddRegisters(GetReturnRegister(), r1, r1)
+	ir.Return()
+	valid, _ := ir.MarshalBinary()
+
+	cases := map[string][]byte{
+		"empty":            {},
+		"bad magic":        append([]byte("MVAN"), valid[4:]...),
+		"future version":   append([]byte("NAVM\x7f"), valid[5:]...),
+		"truncated":        valid[:len(valid)-1],
+		"trailing bytes":   append(append([]byte{}, valid...), 0),
+		"unknown op":       {'N', 'A', 'V', 'M', 1, 1, 0, 1, 100, 0, 0, 0},
+		"constant range":   {'N', 'A', 'V', 'M', 1, 2, 0, 1, 2, 1, 2, 0, 4, 2},
+		"register range":   {'N', 'A', 'V', 'M', 1, 2, 0, 1, 2, 1, 4, 0, 0},
+		"huge constants":   {'N', 'A', 'V', 'M', 1, 2, 0xff, 0xff, 0xff, 0x0f},
+		"unknown arg type": {'N', 'A', 'V', 'M', 1, 2, 0, 1, 2, 1, 2, 0, 40, 0},
+	}
+	for name, data := range cases {
+		decoded := NewIR()
+		err := decoded.UnmarshalBinary(data)
+		if !errors.Is(err, ErrInvalidEncoding) {
+			t.Errorf("%s: expected ErrInvalidEncoding, got %v", name, err)
+		}
+		if decoded.registersLength != 1 || len(decoded.instructions) != 0 {
+			t.Errorf("%s: IR should be unchanged after a failed decode", name)
+		}
+	}
+}
+
+func TestMarshalTypes(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(typedProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	lowered, err := Lower(ir, AARCH64_MACOS_NONE)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, f := range []*IR{ir, lowered} {
+		data, err := f.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		decoded := &IR{}
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if decoded.Print() != f.Print() {
+			t.Errorf("Expected\n%s\ngot\n%s", f.Print(), decoded.Print())
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package navm
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrUnknownTarget   = errors.New("unknown target")
+	ErrInvalidOperand  = errors.New("invalid operand")
+	ErrUnknownFunction = errors.New("unknown function")
+	ErrDivideByZero    = errors.New("division by zero")
+	ErrIntegerOverflow = errors.New("integer overflow")
+	ErrOutOfBounds     = errors.New("memory access out of bounds")
+	ErrOutOfFuel       = errors.New("out of fuel")
+	ErrMisaligned      = errors.New("misaligned memory access")
+)
+
+// An error raised while interpreting, pointing at the instruction that
+// caused it. Unwraps to one of the sentinel errors above.
+type RuntimeError struct {
+	Function string
+	Index    int
+	Err      error
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Function + ": instruction " + strconv.Itoa(e.Index) + ": " + e.Err.Error()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// A trap raised by a load or store the memory layout does not allow.
+// Unwraps to ErrOutOfBounds or ErrMisaligned.
+type MemoryFault struct {
+	Function string
+	Index    int // of the faulting instruction
+	Address  int
+	Size     int // in bytes
+	Err      error
+}
+
+func (e *MemoryFault) Error() string {
+	return e.Function + ": instruction " + strconv.Itoa(e.Index) + ": " + e.Err.Error() + ": " + strconv.Itoa(e.Size) + " bytes at " + strconv.Itoa(e.Address)
+}
+
+func (e *MemoryFault) Unwrap() error {
+	return e.Err
+}
+
+// Returned when interpreting stops before the program finishes, because it
+// ran out of fuel or its context was done. Unwraps to ErrOutOfFuel or the
+// context's error.
+type InterruptedError struct {
+	Err   error
+	State MachineState
+}
+
+func (e *InterruptedError) Error() string {
+	return "interrupted after " + strconv.Itoa(e.State.Steps) + " instructions: " + e.Err.Error()
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,125 @@
+package navm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+func TestCompileEUnknownTarget(t *testing.T) {
+	ir := NewIR()
+	ir.Return()
+	_, err := CompileE(ir, "pdp11-unix-none")
+	if !errors.Is(err, ErrUnknownTarget) {
+		t.Errorf("Expected ErrUnknownTarget, got %v", err)
+	}
+	_, err = CompileModuleE(NewModule(), "pdp11-unix-none")
+	if !errors.Is(err, ErrUnknownTarget) {
+		t.Errorf("Expected ErrUnknownTarget, got %v", err)
+	}
+}
+
+func TestCompileEInvalidIR(t *testing.T) {
+	ir := NewIR()
+	ir.AddInstruction(Instruction{op: add, ret: GetReturnRegister(), arg2: Arg{argType: constant, value: ir.GetConstant(1)}})
+	ir.Return()
+	_, err := CompileE(ir, AARCH64_MACOS_NONE)
+	if !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+	var verifyErr VerifyError
+	if !errors.As(err, &verifyErr) || verifyErr.Index != 0 {
+		t.Errorf("Expected a VerifyError at instruction 0, got %v", err)
+	}
+}
+
+func TestCompileETooManyParameters(t *testing.T) {
+	ir := NewFunction("wide", 5)
+	ir.Return()
+	_, err := CompileE(ir, X64_WIN_GNU)
+	if !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+}
+
+func TestCompileE(t *testing.T) {
+	ir := NewIR()
+	ir.MoveConstant(GetReturnRegister(), 3)
+	ir.Return()
+	result, err := CompileE(ir, AARCH64_MACOS_NONE)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(result, "mov X0, #3") {
+		t.Errorf("Expected mov X0, #3 in\n%s", result)
+	}
+}
+
+func TestInterpretEDivideByZero(t *testing.T) {
+	ir := NewIR()
+	r1 := ir.NewVirtualRegister()
+	ir.MoveConstant(r1, 0)
+	ir.DivRegisters(GetReturnRegister(), r1, r1)
+	ir.Return()
+	_, err := InterpretE(ir)
+	if !errors.Is(err, ErrDivideByZero) {
+		t.Fatalf("Expected ErrDivideByZero, got %v", err)
+	}
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || runtimeErr.Index != 1 || runtimeErr.Function != "main" {
+		t.Errorf("Expected a RuntimeError at main instruction 1, got %v", err)
+	}
+}
+
+func TestInterpretEOutOfBounds(t *testing.T) {
+	ir := NewIR()
+	r1 := ir.NewVirtualRegister()
+	ir.MoveConstant(r1, 4096)
+	if err := ir.Load(GetReturnRegister(), r1.ToAddress(ir.GetConstant(0))); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ir.Return()
+	_, err := InterpretE(ir)
+	if !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Expected ErrOutOfBounds, got %v", err)
+	}
+}
+
+func TestInterpretModuleEErrors(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = InterpretModuleE(m, "missing")
+	if !errors.Is(err, ErrUnknownFunction) {
+		t.Errorf("Expected ErrUnknownFunction, got %v", err)
+	}
+	_, err = InterpretModuleE(m, "fact")
+	if !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+	result, err := InterpretModuleE(m, "fact", 5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != 120 {
+		t.Errorf("Expected 120, got %d", result)
+	}
+}
+
+func TestLoadStoreRejectNonAddress(t *testing.T) {
+	ir := NewIR()
+	r1 := ir.NewVirtualRegister()
+	if err := ir.Load(r1, r1.ToArg()); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand from Load, got %v", err)
+	}
+	if err := ir.Store(r1, Arg{argType: constant, value: ir.GetConstant(0)}); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand from Store, got %v", err)
+	}
+	if len(ir.instructions) != 0 {
+		t.Errorf("Expected no instructions, got %d", len(ir.instructions))
+	}
+}
@@ -0,0 +1,152 @@
+////////////////////////////////////////////////////////////////////////////////
+// IEEE 754 arithmetic for the interpreter. Floats are held as their bit ///////
+// pattern. Go's own arithmetic gives the right values, but NaN results are ////
+// chosen here so they do not depend on the host. /////////////////////////////
+////////////////////////////////////////////////////////////////////////////////
+
+package navm
+
+import (
+	"math"
+)
+
+const f32QuietBit = 1 << 22
+const f64QuietBit = 1 << 51
+
+func isNaN(bits int, t Type) bool {
+	if t == F32 {
+		return math.IsNaN(float64(math.Float32frombits(uint32(bits))))
+	}
+	return math.IsNaN(math.Float64frombits(uint64(bits)))
+}
+
+func isSignalling(bits int, t Type) bool {
+	return isNaN(bits, t) && quiet(bits, t) != bits
+}
+
+func quiet(bits int, t Type) int {
+	if t == F32 {
+		return bits | f32QuietBit
+	}
+	return bits | f64QuietBit
+}
+
+// The NaN an invalid operation like 0/0 produces
+func defaultNaN(t Type, b FloatBehavior) int {
+	var bits uint64 = 0x7ff8000000000000
+	if t == F32 {
+		bits = 0x7fc00000
+	}
+	if b == IndefiniteFloats {
+		if t == F32 {
+			bits |= 1 << 31
+		} else {
+			bits |= 1 << 63
+		}
+	}
+	return int(bits)
+}
+
+// A NaN operand is returned quieted. If both are NaNs x86-64 returns the
+// first, while arm64 prefers a signalling NaN. RISC-V returns neither.
+func floatArithmetic(op Op, t Type, a int, b int, behavior FloatBehavior) int {
+	if behavior == CanonicalFloats && (isNaN(a, t) || isNaN(b, t)) {
+		return defaultNaN(t, behavior)
+	}
+	if behavior == SaturatingFloats && !isSignalling(a, t) && isSignalling(b, t) {
+		return quiet(b, t)
+	}
+	if isNaN(a, t) {
+		return quiet(a, t)
+	}
+	if isNaN(b, t) {
+		return quiet(b, t)
+	}
+	var result int
+	if t == F32 {
+		x, y := math.Float32frombits(uint32(a)), math.Float32frombits(uint32(b))
+		var z float32
+		switch op {
+		case fadd:
+			z = x + y
+		case fsub:
+			z = x - y
+		case fmul:
+			z = x * y
+		case fdiv:
+			z = x / y
+		}
+		result = int(math.Float32bits(z))
+	} else {
+		x, y := math.Float64frombits(uint64(a)), math.Float64frombits(uint64(b))
+		var z float64
+		switch op {
+		case fadd:
+			z = x + y
+		case fsub:
+			z = x - y
+		case fmul:
+			z = x * y
+		case fdiv:
+			z = x / y
+		}
+		result = int(math.Float64bits(z))
+	}
+	if isNaN(result, t) {
+		return defaultNaN(t, behavior)
+	}
+	return result
+}
+
+// Rounds towards zero. NaN and values outside the range of an i64 depend on
+// the target.
+func floatToInt(value float64, behavior FloatBehavior) int {
+	switch {
+	case value >= -(1<<63) && value < 1<<63:
+		return int(value)
+	case behavior == IndefiniteFloats:
+		return math.MinInt64
+	case math.IsNaN(value) && behavior == CanonicalFloats:
+		return math.MaxInt64
+	case math.IsNaN(value):
+		return 0
+	case value > 0:
+		return math.MaxInt64
+	default:
+		return math.MinInt64
+	}
+}
+
+func runFloatConversion(op Op, value int, behavior FloatBehavior) int {
+	switch op {
+	case sitof32:
+		return int(math.Float32bits(float32(value)))
+	case sitof64:
+		return int(math.Float64bits(float64(value)))
+	case f32tosi:
+		return floatToInt(float64(math.Float32frombits(uint32(value))), behavior)
+	case f64tosi:
+		return floatToInt(math.Float64frombits(uint64(value)), behavior)
+	case f32tof64:
+		// The payload of a NaN moves to the top of the wider mantissa
+		if isNaN(value, F32) && behavior == CanonicalFloats {
+			return defaultNaN(F64, behavior)
+		}
+		if isNaN(value, F32) {
+			sign := value >> 31 & 1
+			return int(uint64(sign)<<63 | 0x7ff8000000000000 | uint64(value&0x3fffff)<<29)
+		}
+		return int(math.Float64bits(float64(math.Float32frombits(uint32(value)))))
+	case f64tof32:
+		if isNaN(value, F64) && behavior == CanonicalFloats {
+			return defaultNaN(F32, behavior)
+		}
+		if isNaN(value, F64) {
+			sign := uint64(value) >> 63
+			return int(uint32(sign)<<31 | 0x7fc00000 | uint32(uint64(value)>>29&0x3fffff))
+		}
+		return int(math.Float32bits(float32(math.Float64frombits(uint64(value)))))
+	default:
+		panic("Unknown float conversion: " + op.String())
+	}
+}
@@ -0,0 +1,401 @@
+package navm
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+// 1.5 / 0.25 = 6, squared is 36, then in f32 36 - 0.5 = 35.5, doubled is 71
+const floatProgram = `.registers 7
+.types %v1 f64, %v2 f64, %v3 f64, %v4 f32, %v5 f32
+.constants 4609434218613702656, 4598175219545276416, 1056964608, 3
+  %v1 = mov 4609434218613702656
+  %v2 = mov 4598175219545276416
+  %v3 = fdiv %v1, %v2
+  %v3 = fmul %v3, %v3
+  %v4 = f64tof32 %v3
+  %v5 = mov 1056964608
+  %v4 = fsub %v4, %v5
+  %v4 = fadd %v4, %v4
+  %v3 = f32tof64 %v4
+  %v6 = mov 3
+  %v1 = sitof64 %v6
+  %v3 = fadd %v3, %v1
+  %ret = f64tosi %v3
+  ret
+`
+
+func TestFloats(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(floatProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ir.Print() != floatProgram {
+		t.Errorf("Expected\n%s\ngot\n%s", floatProgram, ir.Print())
+	}
+	if errs := Verify(ir); errs != nil {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	result, err := InterpretE(ir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != 74 {
+		t.Errorf("Expected 74, got %d", result)
+	}
+	for _, target := range []string{AARCH64_MACOS_NONE, X64_WIN_GNU} {
+		result, err := InterpretForArchitecture(ir, target, InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if result != 74 {
+			t.Errorf("Expected 74 for %s, got %d", target, result)
+		}
+	}
+}
+
+func TestFloatBehavior(t *testing.T) {
+	nan := int(math.Float64bits(math.NaN()))
+	cases := []struct {
+		behavior FloatBehavior
+		op       Op
+		t        Type
+		a        int
+		b        int
+		expected int
+	}{
+		// 0/0 gives the default NaN, which is negative on x86-64
+		{SaturatingFloats, fdiv, F64, 0, 0, 0x7ff8000000000000},
+		{IndefiniteFloats, fdiv, F64, 0, 0, -0x8000000000000},
+		{SaturatingFloats, fdiv, F32, 0, 0, 0x7fc00000},
+		{IndefiniteFloats, fdiv, F32, 0, 0, 0xffc00000},
+		// NaN operands are quieted, and a signalling NaN wins on arm64
+		{SaturatingFloats, fadd, F64, 0x7ff0000000000001, 0, 0x7ff8000000000001},
+		{SaturatingFloats, fadd, F32, 0x7fc00001, 0x7f800002, 0x7fc00002},
+		{IndefiniteFloats, fadd, F32, 0x7fc00001, 0x7f800002, 0x7fc00001},
+		{SaturatingFloats, fmul, F64, int(math.Float64bits(1.5)), int(math.Float64bits(-2)), int(math.Float64bits(-3))},
+		// RISC-V never propagates a NaN's payload or sign
+		{CanonicalFloats, fdiv, F64, 0, 0, 0x7ff8000000000000},
+		{CanonicalFloats, fadd, F64, 0x7ff0000000000001, 0, 0x7ff8000000000000},
+		{CanonicalFloats, fadd, F32, 0xffc00001, 0x7f800000, 0x7fc00000},
+	}
+	for _, c := range cases {
+		if result := floatArithmetic(c.op, c.t, c.a, c.b, c.behavior); result != c.expected {
+			t.Errorf("Expected %#x for %s %s of %#x and %#x, got %#x", c.expected, c.op, c.t, c.a, c.b, result)
+		}
+	}
+
+	conversions := []struct {
+		behavior FloatBehavior
+		value    int
+		expected int
+	}{
+		{SaturatingFloats, nan, 0},
+		{IndefiniteFloats, nan, math.MinInt64},
+		{SaturatingFloats, int(math.Float64bits(1e300)), math.MaxInt64},
+		{IndefiniteFloats, int(math.Float64bits(1e300)), math.MinInt64},
+		{SaturatingFloats, int(math.Float64bits(-1e300)), math.MinInt64},
+		{SaturatingFloats, int(math.Float64bits(-2.75)), -2},
+		{CanonicalFloats, nan, math.MaxInt64},
+		{CanonicalFloats, int(math.Float64bits(-1e300)), math.MinInt64},
+	}
+	for _, c := range conversions {
+		if result := runFloatConversion(f64tosi, c.value, c.behavior); result != c.expected {
+			t.Errorf("Expected %d converting %#x, got %d", c.expected, c.value, result)
+		}
+	}
+	if result := runFloatConversion(f32tof64, 0x7fc00001, SaturatingFloats); result != 0x7ff8000020000000 {
+		t.Errorf("Expected %#x, got %#x", 0x7ff8000020000000, result)
+	}
+	if result := runFloatConversion(f64tof32, 0x7ff8000020000000, SaturatingFloats); result != 0x7fc00001 {
+		t.Errorf("Expected %#x, got %#x", 0x7fc00001, result)
+	}
+	if result := runFloatConversion(f32tof64, 0x7fc00001, CanonicalFloats); result != 0x7ff8000000000000 {
+		t.Errorf("Expected %#x, got %#x", 0x7ff8000000000000, result)
+	}
+}
+
+func TestFloatBehaviorForArchitecture(t *testing.T) {
+	text := `.types %v1 f64, %v2 f64
+  %v1 = mov 0
+  %v2 = fdiv %v1, %v1
+  %ret = f64tosi %v2
+  ret
+`
+	cases := []struct {
+		target   string
+		expected int
+	}{
+		{AARCH64_MACOS_NONE, 0},
+		{X64_WIN_GNU, math.MinInt64},
+		{RISCV64_LINUX_MUSL, math.MaxInt64},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := InterpretForArchitecture(ir, c.target, InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", c.target, err)
+		}
+		if result != c.expected {
+			t.Errorf("Expected %d for %s, got %d", c.expected, c.target, result)
+		}
+	}
+}
+
+func TestFloatMemory(t *testing.T) {
+	ir := NewFunction("f", 0)
+	a := ir.NewTypedRegister(F32)
+	b := ir.NewTypedRegister(F64)
+	if err := ir.MoveFloat(a, 2.5); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := ir.StoreFloat(a, GetStackPointer().ToAddress(ir.GetConstant(-8))); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := ir.LoadFloat(a, GetStackPointer().ToAddress(ir.GetConstant(-8))); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := ir.ConvertFloat(b, a); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ir.FMultRegisters(b, b, b)
+	if err := ir.StoreFloat(b, GetStackPointer().ToAddress(ir.GetConstant(-16))); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ir.Load(GetReturnRegister(), GetStackPointer().ToAddress(ir.GetConstant(-16)))
+	ir.Return()
+	if errs := Verify(ir); errs != nil {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	result, err := InterpretE(ir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if math.Float64frombits(uint64(result)) != 6.25 {
+		t.Errorf("Expected 6.25, got %v", math.Float64frombits(uint64(result)))
+	}
+
+	if err := ir.MoveFloat(GetReturnRegister(), 1); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+	if err := ir.LoadFloat(GetReturnRegister(), GetStackPointer().ToAddress(ir.GetConstant(0))); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+	if err := ir.ConvertFloat(a, a); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+}
+
+func TestCompileFloatConstant(t *testing.T) {
+	// 1.1 is 0x3ff199999999999a, which no single mov can write
+	ir := NewFunction("main", 0)
+	a := ir.NewTypedRegister(F64)
+	if err := ir.MoveFloat(a, 1.1); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ir.FAddRegisters(a, a, a)
+	ir.Return()
+	result, err := CompileE(ir, AARCH64_MACOS_NONE)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "  movz X11, #39322\n  movk X11, #39321, lsl #16\n  movk X11, #39321, lsl #32\n" +
+		"  movk X11, #16369, lsl #48\n  fmov D18, X11\n"
+	if !strings.Contains(result, expected) {
+		t.Errorf("Expected %q in\n%s", expected, result)
+	}
+}
+
+func TestFloatTypeErrors(t *testing.T) {
+	cases := []struct {
+		text string
+		msg  string
+	}{
+		{".types %v1 f64\n%v2 = add %v1, 1\n", "add does not take f64 operands"},
+		{".types %v1 f32\n%v2 = lt %v1, %v1\n", "lt does not take f32 operands"},
+		{".types %v1 f32, %v2 f64\n%v2 = fadd %v1, %v2\n", "fadd of f32 into f64"},
+		{".types %v1 f32, %v2 f64\n%v1 = fadd %v1, %v2\n", "fadd operands have types f32 and f64"},
+		{"%v1 = fadd %v1, %v1\n", "fadd takes f32 or f64 operands, got i64"},
+		{".types %v1 f32\n%v1 = fadd %v1, 1\n", "arg2 of fadd must be a register"},
+		{".types %v1 f32\n%v1 = fload64 [%sp + 0]\n", "fload64 moves f64, not f32"},
+		{".types %v1 f64\nfstore32 %v1, [%sp + 0]\n", "fstore32 moves f32, not f64"},
+		{".types %v1 f32\n%v2 = f64tosi %v1\n", "f64tosi converts from f64, not f32"},
+		{".types %v1 f32\n%v1 = sitof64 %v2\n", "sitof64 converts to f64, not f32"},
+		{".types %v1 f64\n%v2 = mov %v1\n", "mov operands have types i64 and f64"},
+		{".types %v1 f32\n%v1 = mov 4294967296\n", "constant 4294967296 does not fit in f32"},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(c.text))
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", c.text, err)
+		}
+		errs := Verify(ir)
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), c.msg) {
+			t.Errorf("Expected one error containing %q, got %v", c.msg, errs)
+		}
+	}
+
+	ir, err := ParseIR(strings.NewReader(".func f 1\n.types %v1 f64\n  ret\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	errs := Verify(ir)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "floats cannot be passed to functions") {
+		t.Errorf("Expected a parameter type error, got %v", errs)
+	}
+}
+
+// More live floats than either target has float registers for
+func TestFloatRegisterAllocation(t *testing.T) {
+	ir := NewFunction("f", 0)
+	values := []Register{}
+	for i := 0; i < 10; i++ {
+		r := ir.NewTypedRegister(F64)
+		if err := ir.MoveFloat(r, float64(i)+0.5); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		values = append(values, r)
+	}
+	// Integers are live alongside, in their own registers
+	count := ir.NewVirtualRegister()
+	ir.MoveConstant(count, 100)
+	sum := ir.NewTypedRegister(F64)
+	if err := ir.MoveFloat(sum, 0); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, r := range values {
+		ir.FAddRegisters(sum, sum, r)
+	}
+	if err := ir.ConvertFloat(GetReturnRegister(), sum); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ir.AddRegisters(GetReturnRegister(), GetReturnRegister(), count)
+	ir.Return()
+
+	for _, target := range []string{AARCH64_MACOS_NONE, X64_WIN_GNU} {
+		result, err := InterpretForArchitecture(ir, target, InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if result != 150 {
+			t.Errorf("Expected 150 for %s, got %d", target, result)
+		}
+		lowered, err := Lower(ir, target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		a := Architectures[target]
+		for _, instr := range lowered.instructions {
+			float := instr.op.isFloatArithmetic() || instr.op.floatAccess() != noType
+			if float && instr.ret.registerType == physicalRegister && !a.isFloatRegister(instr.ret.value) {
+				t.Errorf("Expected a float register for %s, got %s", target, a.GetPhysicalRegister(instr.ret.value))
+			}
+			if instr.op == add && instr.ret.registerType == physicalRegister && a.isFloatRegister(instr.ret.value) {
+				t.Errorf("Expected an integer register for %s, got %s", target, a.GetPhysicalRegister(instr.ret.value))
+			}
+		}
+		if !strings.Contains(lowered.Print(), "fstore64") {
+			t.Errorf("Expected float spills for %s, got\n%s", target, lowered.Print())
+		}
+	}
+}
+
+func TestCompileFloats(t *testing.T) {
+	cases := []struct {
+		target   string
+		expected []string
+	}{
+		{AARCH64_MACOS_NONE, []string{
+			"  mov X11, #4609434218613702656\n  fmov D18, X11\n",
+			"  fdiv D20, D18, D19\n",
+			"  fmul D20, D20, D20\n",
+			"  fcvt S21, D20\n",
+			"  mov X13, #1056964608\n  fmov S22, W13\n",
+			"  fsub S21, S21, S22\n",
+			"  fadd S21, S21, S21\n",
+			"  fcvt D20, S21\n",
+			"  scvtf D18, X14\n",
+			"  fcvtzs X0, D20\n",
+		}},
+		{X64_WIN_GNU, []string{
+			"  mov R12, 4609434218613702656\n  movq XMM2, R12\n",
+			"  movaps XMM4, XMM2\n  divsd XMM4, XMM3\n",
+			"  mulsd XMM4, XMM4\n",
+			"  cvtsd2ss XMM5, XMM4\n",
+			"  mov R14, 1056964608\n  movd XMM3, R14D\n",
+			"  subss XMM5, XMM3\n",
+			"  cvtss2sd XMM4, XMM5\n",
+			"  cvtsi2sd XMM2, R15\n",
+			"  cvttsd2si RAX, XMM4\n",
+		}},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(floatProgram))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := CompileE(ir, c.target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, e := range c.expected {
+			if !strings.Contains(result, e) {
+				t.Errorf("Expected %q for %s, got\n%s", e, c.target, result)
+			}
+		}
+	}
+
+	text := `.types %v1 f32, %v2 f64
+  %v1 = fload32 [%sp + 4]
+  %v2 = fload64 [%sp + 8]
+  fstore32 %v1, [%sp + 16]
+  fstore64 %v2, [%sp + 24]
+  %v3 = f32tosi %v1
+  %v1 = sitof32 %v3
+  ret
+`
+	accesses := []struct {
+		target   string
+		expected []string
+	}{
+		{AARCH64_MACOS_NONE, []string{
+			"  ldr S18, [SP, #4]\n",
+			"  ldr D19, [SP, #8]\n",
+			"  str S18, [SP, #16]\n",
+			"  str D19, [SP, #24]\n",
+			"  fcvtzs X11, S18\n",
+			"  scvtf S18, X11\n",
+		}},
+		{X64_WIN_GNU, []string{
+			"  movss XMM2, dword [RSP + 4]\n",
+			"  movsd XMM3, qword [RSP + 8]\n",
+			"  movss dword [RSP + 16], XMM2\n",
+			"  movsd qword [RSP + 24], XMM3\n",
+			"  cvttss2si R12, XMM2\n",
+			"  cvtsi2ss XMM2, R12\n",
+		}},
+	}
+	for _, c := range accesses {
+		ir, err := ParseIR(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := CompileE(ir, c.target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, e := range c.expected {
+			if !strings.Contains(result, e) {
+				t.Errorf("Expected %q for %s, got\n%s", e, c.target, result)
+			}
+		}
+	}
+}
@@ -7,13 +7,39 @@ package navm
 
 type Generator interface {
 	Init(a *Architecture, ir *IR)
-	GetHeader() string
-	GetReturn() string
+	GetFileHeader() string
+	GetHeader() string // starts the function, including any prologue
+	GetReturn() string // includes any epilogue
+	// A freestanding _start that calls entry and passes its result to the
+	// Architecture's ExitSyscall
+	GetStart(entry string) string
+	GetCall(instr Instruction) string
 	GetTwoArgInstruction(op GenOp, instr Instruction) string
 	GetTwoArgNoRetInstruction(op GenOp, instr Instruction) string
 	GetInstruction(op GenOp, instr Instruction) string
 	GetArg(arg Arg) string
 	GetTargetInstruction(op GenOp) string
+	GetLabel(instr Instruction) string
+	GetJump(instr Instruction) string
+	GetBranch(instr Instruction) string
+	GetCompareInstruction(op GenOp, instr Instruction) string
+	// Loads and stores narrower than 8 bytes, see Op.memoryAccess
+	GetSizedLoad(instr Instruction) string
+	GetSizedStore(instr Instruction) string
+	// Sign and zero extensions and truncation, see Op.isConversion, and the
+	// float conversions, see Op.floatConversion
+	GetConversion(instr Instruction) string
+	// fadd, fsub, fmul and fdiv, as addGenOp to divGenOp
+	GetFloatInstruction(op GenOp, instr Instruction) string
+	GetFloatLoad(instr Instruction) string
+	GetFloatStore(instr Instruction) string
+	// shl, lshr and ashr, whose count may have to be in a fixed register
+	GetShiftInstruction(op GenOp, instr Instruction) string
+	// not and neg, of the register in arg2
+	GetUnaryInstruction(op GenOp, instr Instruction) string
+	// div, udiv, srem and urem. arg2 is always a register, and the
+	// instruction's trap policy is never DefaultTraps.
+	GetDivision(op GenOp, instr Instruction) string
 }
 
 type GenOp int
@@ -27,4 +53,59 @@ const (
 	movGenOp   GenOp = iota
 	loadGenOp  GenOp = iota
 	storeGenOp GenOp = iota
+	eqGenOp    GenOp = iota
+	neGenOp    GenOp = iota
+	ltGenOp    GenOp = iota
+	leGenOp    GenOp = iota
+	gtGenOp    GenOp = iota
+	geGenOp    GenOp = iota
+	ultGenOp   GenOp = iota
+	uleGenOp   GenOp = iota
+	ugtGenOp   GenOp = iota
+	ugeGenOp   GenOp = iota
+	andGenOp   GenOp = iota
+	orGenOp    GenOp = iota
+	xorGenOp   GenOp = iota
+	shlGenOp   GenOp = iota
+	lshrGenOp  GenOp = iota
+	ashrGenOp  GenOp = iota
+	notGenOp   GenOp = iota
+	negGenOp   GenOp = iota
+	udivGenOp  GenOp = iota
+	sremGenOp  GenOp = iota
+	uremGenOp  GenOp = iota
 )
+
+func hasCalls(ir *IR) bool {
+	for _, instr := range ir.instructions {
+		if instr.op == call {
+			return true
+		}
+	}
+	return false
+}
+
+// The physical registers written or read by the (allocated) IR, in the order
+// they are first used
+func usedPhysicalRegisters(a *Architecture, ir *IR) []string {
+	used := []string{}
+	seen := make(map[int]bool)
+	use := func(value int) {
+		if value > 0 && !seen[value] {
+			seen[value] = true
+			used = append(used, a.GetPhysicalRegister(value))
+		}
+	}
+	for _, instr := range ir.instructions {
+		if instr.ret.registerType == physicalRegister {
+			use(instr.ret.value)
+		}
+		if instr.arg1.registerType == physicalRegister {
+			use(instr.arg1.value)
+		}
+		if (instr.arg2.argType == registerArg || instr.arg2.argType == address) && !instr.arg2.isVirtualRegister {
+			use(instr.arg2.value)
+		}
+	}
+	return used
+}
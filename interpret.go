@@ -1,58 +1,425 @@
 package navm
 
+import (
+	"context"
+	"fmt"
+)
+
 type Runtime struct {
 	returnRegister int
 	registers      []int
-	memory         []byte
+	stackPointer   *int // shared by every frame
+	// When interpreting lowered IR, the target's register file, shared by
+	// every frame and keyed by register name
+	arch       *Architecture
+	physical   map[string]int
+	memory     []byte
+	layout     *MemoryLayout
+	endianness Endianness
+	ir         *IR
+	tracer     Tracer
 }
 
-func validateRegister(r Register) {
-	switch r.registerType {
+func (r *Runtime) validateRegister(reg Register) {
+	switch reg.registerType {
 	case noRegisterType:
 		panic("No register type")
 	case virtualRegister:
-		// do nothing
+		if r.arch != nil {
+			panic("Virtual register not legal when interpreting for " + r.arch.TargetTriple)
+		}
 	case physicalRegister:
-		panic("Physical register not legal when interpreting")
+		if r.arch == nil && reg.value != STACK_POINTER_REGISTER {
+			panic("Physical register not legal when interpreting")
+		}
 	default:
 		panic("Unknown register type")
 	}
 }
 
+// A function activation on the interpreter's call stack
+type frame struct {
+	ir      *IR
+	pc      int // index of the next instruction
+	labels  []int
+	runtime *Runtime
+}
+
+// Continues at label l. Verify rejects jumps to labels that are never
+// placed, but Interpret runs unverified IR.
+func (f *frame) jump(l int) error {
+	if l < 0 || l >= len(f.labels) {
+		return fmt.Errorf("%w: label %d out of range", ErrInvalidOperand, l)
+	}
+	if f.labels[l] < 0 {
+		return fmt.Errorf("%w: label %s is never placed", ErrInvalidOperand, f.ir.labels[l])
+	}
+	f.pc = f.labels[l]
+	return nil
+}
+
+// Lowered IR passes arguments in the argument registers, so only the entry
+// frame is given args
+func newFrame(ir *IR, args []int, mc *machine) (*frame, error) {
+	if (mc.arch == nil || len(mc.stack) == 0) && len(args) != ir.paramCount {
+		return nil, fmt.Errorf("%w: %s expects %d arguments, got %d", ErrInvalidOperand, ir.Name(), ir.paramCount, len(args))
+	}
+	r := &Runtime{
+		registers:    make([]int, ir.registersLength),
+		stackPointer: &mc.stackPointer,
+		arch:         mc.arch,
+		physical:     mc.physical,
+		memory:       mc.memory,
+		layout:       mc.layout,
+		endianness:   mc.endianness,
+		ir:           ir,
+		tracer:       mc.tracer}
+	for idx, a := range args {
+		if r.arch != nil {
+			r.physical[r.arch.ArgumentRegisters[idx]] = a
+		} else {
+			r.registers[idx+1] = ir.TypeOf(ir.Parameter(idx)).wrap(a)
+		}
+	}
+	return &frame{ir: ir, labels: labelPositions(ir), runtime: r}, nil
+}
+
+// Interprets a single function. It may call itself, but no other functions.
+// Like InterpretE, but panics on error and does not verify the IR first.
 func Interpret(ir *IR) int {
-	r := Runtime{
-		registers: make([]int, ir.registersLength),
-		memory:    make([]byte, 1024)}
-	for _, i := range ir.instructions {
-		(&r).print()
-		switch i.op {
-		case add:
-			runAdd(i, &r, ir)
-		case sub:
-			runSub(i, &r, ir)
-		case mult:
-			runMult(i, &r, ir)
-		case div:
-			runDiv(i, &r, ir)
-		case mov:
-			runMov(i, &r, ir)
-		case load:
-			runLoad(i, &r, ir)
-		case store:
-			runStore(i, &r, ir)
-		case ret:
-			return r.returnRegister
-
-		default:
-			panic("Unknown operation")
+	result, err := interpret(context.Background(), &Module{functions: []*IR{ir}}, ir, nil, nil, InterpretOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// Verifies and interprets a single function. Runtime failures are returned
+// as a *RuntimeError.
+func InterpretE(ir *IR) (int, error) {
+	return InterpretWithOptions(ir, InterpretOptions{})
+}
+
+// Like InterpretE, with tracing and other settings given by opts
+func InterpretWithOptions(ir *IR, opts InterpretOptions) (int, error) {
+	return InterpretContext(context.Background(), ir, opts)
+}
+
+// Like InterpretWithOptions, but stops early once ctx is done. Running out of
+// fuel or being cancelled returns an *InterruptedError holding the state
+// of the machine at that point.
+func InterpretContext(ctx context.Context, ir *IR, opts InterpretOptions) (int, error) {
+	if err := joinVerifyErrors(Verify(ir)); err != nil {
+		return 0, err
+	}
+	return interpret(ctx, &Module{functions: []*IR{ir}}, ir, nil, nil, opts)
+}
+
+// Interprets the named function of a module with the given arguments. Like
+// InterpretModuleE, but panics on error and does not verify the module first.
+func InterpretModule(m *Module, entry string, args ...int) int {
+	f := m.Function(entry)
+	if f == nil {
+		panic("Unknown function: " + entry)
+	}
+	result, err := interpret(context.Background(), m, f, args, nil, InterpretOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// Verifies the module and interprets the named function with the given
+// arguments
+func InterpretModuleE(m *Module, entry string, args ...int) (int, error) {
+	return InterpretModuleWithOptions(m, entry, InterpretOptions{}, args...)
+}
+
+// Like InterpretModuleE, with tracing and other settings given by opts
+func InterpretModuleWithOptions(m *Module, entry string, opts InterpretOptions, args ...int) (int, error) {
+	return InterpretModuleContext(context.Background(), m, entry, opts, args...)
+}
+
+// Like InterpretModuleWithOptions, but stops early once ctx is done, as
+// InterpretContext does
+func InterpretModuleContext(ctx context.Context, m *Module, entry string, opts InterpretOptions, args ...int) (int, error) {
+	f := m.Function(entry)
+	if f == nil {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownFunction, entry)
+	}
+	if err := joinVerifyErrors(VerifyModule(m)); err != nil {
+		return 0, err
+	}
+	return interpret(ctx, m, f, args, nil, opts)
+}
+
+// Lowers the IR for the target, as Lower does, and interprets the result
+// with the target's register file. Comparing the result with InterpretE
+// checks register allocation and spilling without running on the target.
+func InterpretForArchitecture(ir *IR, architecture string, opts InterpretOptions) (int, error) {
+	return InterpretForArchitectureContext(context.Background(), ir, architecture, opts)
+}
+
+// Like InterpretForArchitecture, but stops early once ctx is done, as
+// InterpretContext does
+func InterpretForArchitectureContext(ctx context.Context, ir *IR, architecture string, opts InterpretOptions) (int, error) {
+	lowered, err := Lower(ir, architecture)
+	if err != nil {
+		return 0, err
+	}
+	a := Architectures[architecture]
+	return interpret(ctx, &Module{functions: []*IR{lowered}}, lowered, nil, a, opts)
+}
+
+// Like InterpretForArchitecture, for the named function of a module. The
+// arguments are passed in the target's argument registers.
+func InterpretModuleForArchitecture(m *Module, architecture string, entry string, opts InterpretOptions, args ...int) (int, error) {
+	return InterpretModuleForArchitectureContext(context.Background(), m, architecture, entry, opts, args...)
+}
+
+// Like InterpretModuleForArchitecture, but stops early once ctx is done, as
+// InterpretContext does
+func InterpretModuleForArchitectureContext(ctx context.Context, m *Module, architecture string, entry string, opts InterpretOptions, args ...int) (int, error) {
+	lowered, err := LowerModule(m, architecture)
+	if err != nil {
+		return 0, err
+	}
+	f := lowered.Function(entry)
+	if f == nil {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownFunction, entry)
+	}
+	a := Architectures[architecture]
+	return interpret(ctx, lowered, f, args, a, opts)
+}
+
+// How many instructions run between checks of the context
+const contextCheckInterval = 1024
+
+func interpret(ctx context.Context, m *Module, entry *IR, args []int, a *Architecture, opts InterpretOptions) (int, error) {
+	mc, err := newMachine(m, entry, args, a, opts)
+	if err != nil {
+		return 0, err
+	}
+	for !mc.done {
+		if mc.steps%contextCheckInterval == 0 && ctx.Err() != nil {
+			return 0, &InterruptedError{Err: ctx.Err(), State: mc.state()}
+		}
+		if err := mc.step(); err == ErrOutOfFuel {
+			return 0, &InterruptedError{Err: err, State: mc.state()}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return mc.result, nil
+}
+
+// The whole interpreter state, advanced one instruction at a time by step
+type machine struct {
+	module       *Module
+	stack        []*frame
+	memory       []byte
+	layout       *MemoryLayout
+	endianness   Endianness
+	stackPointer int
+	arch         *Architecture  // set when interpreting lowered IR
+	physical     map[string]int // the register file of arch
+	tracer       Tracer
+	fuel         int // 0 for no limit
+	steps        int // instructions run so far
+	done         bool
+	result       int // the entry function's return value, once done
+}
+
+// a is nil for IR using virtual registers, or the target that m has been
+// lowered for
+func newMachine(m *Module, entry *IR, args []int, a *Architecture, opts InterpretOptions) (*machine, error) {
+	layout := opts.Memory
+	if err := layout.validate(); err != nil {
+		return nil, err
+	}
+	mc := &machine{
+		module:       m,
+		memory:       make([]byte, layout.size()),
+		layout:       &layout,
+		endianness:   opts.Endianness,
+		stackPointer: layout.stackTop(),
+		arch:         a,
+		tracer:       opts.Tracer,
+		fuel:         opts.Fuel}
+	if a != nil {
+		mc.endianness = a.Endianness
+		mc.physical = make(map[string]int)
+		if len(args) > len(a.ArgumentRegisters) {
+			return nil, fmt.Errorf("%w: %d arguments, %s passes at most %d in registers", ErrInvalidOperand, len(args), a.TargetTriple, len(a.ArgumentRegisters))
+		}
+	}
+	first, err := newFrame(entry, args, mc)
+	if err != nil {
+		return nil, err
+	}
+	mc.stack = []*frame{first}
+	return mc, nil
+}
+
+// Executes the next instruction. Falling off the end of a function counts as
+// a step that returns from it. Returns ErrOutOfFuel, without running
+// anything, once the fuel is used up.
+func (mc *machine) step() error {
+	if mc.fuel > 0 && mc.steps >= mc.fuel {
+		return ErrOutOfFuel
+	}
+	mc.steps++
+	f := mc.stack[len(mc.stack)-1]
+	r := f.runtime
+	ir := f.ir
+	if f.pc >= len(ir.instructions) {
+		mc.popFrame()
+		return nil
+	}
+	index := f.pc
+	i := ir.instructions[index]
+	f.pc++
+	if mc.tracer != nil {
+		mc.tracer.BeforeInstruction(ir, index)
+	}
+	var err error
+	switch i.op {
+	case add:
+		runAdd(i, r, ir)
+	case sub:
+		runSub(i, r, ir)
+	case mult:
+		runMult(i, r, ir)
+	case div, udiv, srem, urem:
+		err = runDiv(i, r, ir)
+	case mov:
+		runMov(i, r, ir)
+	case sext8, sext16, sext32, zext8, zext16, zext32, trunc:
+		runConversion(i, r)
+	case sitof32, sitof64, f32tosi, f64tosi, f32tof64, f64tof32:
+		runConversion(i, r)
+	case fadd, fsub, fmul, fdiv:
+		runFloat(i, r)
+	case and, or, xor, shl, lshr, ashr:
+		runBitwise(i, r, ir)
+	case not, neg:
+		runUnary(i, r)
+	case load, load8u, load8s, load16u, load16s, load32u, load32s, fload32, fload64:
+		err = runLoad(i, r, ir)
+	case store, store8, store16, store32, fstore32, fstore64:
+		err = runStore(i, r, ir)
+	case eq, ne, lt, le, gt, ge, ult, ule, ugt, uge:
+		runCompare(i, r, ir)
+	case ret:
+		mc.popFrame()
+	case label:
+		// nothing to do, labels only mark jump targets
+	case jmp:
+		err = f.jump(i.arg2.value)
+	case br:
+		r.validateRegister(i.arg1)
+		if r.getRegister(i.arg1.value) != 0 {
+			err = f.jump(i.arg2.value)
+		}
+	case call:
+		name := ir.functions[i.arg2.value]
+		callee := mc.module.Function(name)
+		if callee == nil {
+			err = ErrUnknownFunction
+			break
+		}
+		callArgs := make([]int, len(i.args))
+		for idx, a := range i.args {
+			r.validateRegister(a)
+			callArgs[idx] = r.getRegister(a.value)
+		}
+		var next *frame
+		next, err = newFrame(callee, callArgs, mc)
+		if err == nil {
+			mc.stack = append(mc.stack, next)
 		}
+
+	default:
+		err = ErrInvalidOperand
+	}
+	if fault, ok := err.(*MemoryFault); ok {
+		fault.Function = ir.Name()
+		fault.Index = index
+		return fault
+	}
+	if err != nil {
+		return &RuntimeError{Function: ir.Name(), Index: index, Err: err}
+	}
+	if mc.tracer != nil {
+		mc.tracer.AfterInstruction(ir, index)
+	}
+	return nil
+}
+
+// A snapshot of the interpreter, for reporting where it stopped
+type MachineState struct {
+	Steps          int        // instructions run
+	Backtrace      []Location // innermost call last, each at its next instruction
+	Registers      []int      // the innermost frame's, indexed by virtual register number
+	ReturnRegister int        // the innermost frame's
+	StackPointer   int
+	// The target's registers by name, when interpreting lowered IR
+	PhysicalRegisters map[string]int
+	Memory            []byte
+}
+
+func (mc *machine) state() MachineState {
+	s := MachineState{Steps: mc.steps, StackPointer: mc.stackPointer, Memory: make([]byte, len(mc.memory))}
+	copy(s.Memory, mc.memory)
+	for _, f := range mc.stack {
+		s.Backtrace = append(s.Backtrace, Location{Function: f.ir.Name(), Index: f.pc})
+	}
+	if len(mc.stack) > 0 {
+		r := mc.stack[len(mc.stack)-1].runtime
+		s.Registers = make([]int, len(r.registers))
+		copy(s.Registers, r.registers)
+		s.ReturnRegister = r.getRegister(RETURN_REGISTER)
+	}
+	if mc.arch != nil {
+		s.PhysicalRegisters = make(map[string]int)
+		for name, value := range mc.physical {
+			s.PhysicalRegisters[name] = value
+		}
+	}
+	return s
+}
+
+func (mc *machine) popFrame() {
+	if len(mc.stack) == 1 {
+		mc.result = mc.stack[0].runtime.getRegister(RETURN_REGISTER)
+	}
+	mc.stack = returnFromFrame(mc.stack)
+	mc.done = len(mc.stack) == 0
+}
+
+// Pops the current frame, passing its return value to the calling frame.
+// Lowered IR shares one register file, so there is nothing to pass.
+func returnFromFrame(stack []*frame) []*frame {
+	result := stack[len(stack)-1].runtime.returnRegister
+	stack = stack[:len(stack)-1]
+	if len(stack) == 0 || stack[len(stack)-1].runtime.arch != nil {
+		return stack
+	}
+	caller := stack[len(stack)-1]
+	xrn := caller.ir.instructions[caller.pc-1]
+	caller.runtime.setRegister(RETURN_REGISTER, result)
+	if xrn.ret.registerType != noRegisterType {
+		caller.runtime.setRegister(xrn.ret.value, result)
 	}
-	return r.returnRegister
+	return stack
 }
 
 func (r *Runtime) getRegister(i int) int {
 	if i == STACK_POINTER_REGISTER {
-		panic("Stack pointer not implemented in interpreter")
+		return *r.stackPointer
+	}
+	if r.arch != nil {
+		return r.physical[r.arch.GetPhysicalRegister(i)]
 	}
 	if i == RETURN_REGISTER {
 		return r.returnRegister
@@ -61,8 +428,20 @@ func (r *Runtime) getRegister(i int) int {
 }
 
 func (r *Runtime) setRegister(i int, value int) {
+	if r.tracer != nil {
+		reg := MakeVirtualRegister(i)
+		if i == STACK_POINTER_REGISTER || r.arch != nil {
+			reg = MakePhysicalRegister(i)
+		}
+		r.tracer.RegisterWrite(r.ir, reg, r.getRegister(i), value)
+	}
 	if i == STACK_POINTER_REGISTER {
-		panic("Stack pointer not implemented in interpreter")
+		*r.stackPointer = value
+		return
+	}
+	if r.arch != nil {
+		r.physical[r.arch.GetPhysicalRegister(i)] = value
+		return
 	}
 	if i == RETURN_REGISTER {
 		r.returnRegister = value
@@ -71,9 +450,32 @@ func (r *Runtime) setRegister(i int, value int) {
 	r.registers[i] = value
 }
 
+// Writes the result of i to its ret register, wrapped to the instruction's
+// type. Lowered IR records the type on the instruction, otherwise it is the
+// ret register's.
+func (r *Runtime) setResult(i Instruction, value int) {
+	r.setRegister(i.ret.value, r.resultType(i).wrap(value))
+}
+
+// Lowered IR has lost the register types, but keeps them on the instructions
+func (r *Runtime) resultType(i Instruction) Type {
+	if i.typ != noType {
+		return i.typ
+	}
+	return r.ir.TypeOf(i.ret)
+}
+
+// The type a comparison operates at, that of its first operand
+func (r *Runtime) operandType(i Instruction) Type {
+	if i.typ != noType {
+		return i.typ
+	}
+	return r.ir.TypeOf(i.arg1)
+}
+
 func runMov(i Instruction, r *Runtime, ir *IR) {
 	arg2 := 0
-	validateRegister(i.ret)
+	r.validateRegister(i.ret)
 	if i.arg1.registerType != noRegisterType {
 		panic("arg1 should not be set for MOV instructions")
 	}
@@ -83,129 +485,306 @@ func runMov(i Instruction, r *Runtime, ir *IR) {
 	case constant:
 		arg2 = ir.constants[i.arg2.value]
 	case registerArg:
-		if !i.arg2.isVirtualRegister {
-			panic("Physical register not legal when interpreting")
-		}
+		r.validateRegister(i.arg2.register())
 		arg2 = r.getRegister(i.arg2.value)
 	default:
 		panic("Unknown argument type")
 	}
-	r.setRegister(i.ret.value, arg2)
+	r.setResult(i, arg2)
 }
 
 func runAdd(i Instruction, r *Runtime, ir *IR) {
 	arg2 := 0
-	validateRegister(i.ret)
-	validateRegister(i.arg1)
+	r.validateRegister(i.ret)
+	r.validateRegister(i.arg1)
 	switch i.arg2.argType {
 	case noArgType:
 		panic("No argument type for add op")
 	case constant:
 		arg2 = ir.constants[i.arg2.value]
 	case registerArg:
-		if !i.arg2.isVirtualRegister {
-			panic("Physical register not legal when interpreting")
-		}
+		r.validateRegister(i.arg2.register())
 		arg2 = r.getRegister(i.arg2.value)
 	default:
 		panic("Unknown argument type")
 	}
-	r.setRegister(i.ret.value, r.getRegister(i.arg1.value)+arg2)
+	r.setResult(i, r.getRegister(i.arg1.value)+arg2)
 }
 
 func runSub(i Instruction, r *Runtime, ir *IR) {
 	arg2 := 0
-	validateRegister(i.ret)
-	validateRegister(i.arg1)
+	r.validateRegister(i.ret)
+	r.validateRegister(i.arg1)
 	switch i.arg2.argType {
 	case noArgType:
 		panic("No argument type for add op")
 	case constant:
 		arg2 = ir.constants[i.arg2.value]
 	case registerArg:
-		if !i.arg2.isVirtualRegister {
-			panic("Physical register not legal when interpreting")
-		}
+		r.validateRegister(i.arg2.register())
 		arg2 = r.getRegister(i.arg2.value)
 	default:
 		panic("Unknown argument type")
 	}
-	r.setRegister(i.ret.value, r.getRegister(i.arg1.value)-arg2)
+	r.setResult(i, r.getRegister(i.arg1.value)-arg2)
 }
 
 func runMult(i Instruction, r *Runtime, ir *IR) {
 	arg2 := 0
-	validateRegister(i.ret)
-	validateRegister(i.arg1)
+	r.validateRegister(i.ret)
+	r.validateRegister(i.arg1)
 	switch i.arg2.argType {
 	case noArgType:
 		panic("No argument type for add op")
 	case constant:
 		arg2 = ir.constants[i.arg2.value]
 	case registerArg:
-		if !i.arg2.isVirtualRegister {
-			panic("Physical register not legal when interpreting")
-		}
+		r.validateRegister(i.arg2.register())
 		arg2 = r.getRegister(i.arg2.value)
 	default:
 		panic("Unknown argument type")
 	}
-	r.setRegister(i.ret.value, r.getRegister(i.arg1.value)*arg2)
+	r.setResult(i, r.getRegister(i.arg1.value)*arg2)
 }
 
-func runDiv(i Instruction, r *Runtime, ir *IR) {
+func runDiv(i Instruction, r *Runtime, ir *IR) error {
 	arg2 := 0
-	validateRegister(i.ret)
-	validateRegister(i.arg1)
+	r.validateRegister(i.ret)
+	r.validateRegister(i.arg1)
 	switch i.arg2.argType {
 	case noArgType:
-		panic("No argument type for add op")
+		panic("No argument type for " + i.op.String() + " op")
 	case constant:
 		arg2 = ir.constants[i.arg2.value]
 	case registerArg:
-		if !i.arg2.isVirtualRegister {
-			panic("Physical register not legal when interpreting")
+		r.validateRegister(i.arg2.register())
+		arg2 = r.getRegister(i.arg2.value)
+	default:
+		panic("Unknown argument type")
+	}
+	arg1 := r.getRegister(i.arg1.value)
+	t := r.resultType(i)
+	wrap := ir.trapPolicy(i) == WrapFaults
+	if arg2 == 0 {
+		if !wrap {
+			return ErrDivideByZero
+		}
+		if i.op == div || i.op == udiv {
+			r.setResult(i, 0)
+		} else {
+			r.setResult(i, arg1)
 		}
+		return nil
+	}
+	if i.op == div && !wrap && divisionOverflows(t, arg1, arg2) {
+		return ErrIntegerOverflow
+	}
+	// Go wraps the most negative value divided by -1, as WrapFaults does
+	switch i.op {
+	case div:
+		r.setResult(i, arg1/arg2)
+	case udiv:
+		r.setResult(i, int(t.unsigned(arg1)/t.unsigned(arg2)))
+	case srem:
+		r.setResult(i, arg1%arg2)
+	case urem:
+		r.setResult(i, int(t.unsigned(arg1)%t.unsigned(arg2)))
+	}
+	return nil
+}
+
+// Narrow values are held sign extended, so lshr first zero extends them
+func runBitwise(i Instruction, r *Runtime, ir *IR) {
+	arg2 := 0
+	r.validateRegister(i.ret)
+	r.validateRegister(i.arg1)
+	switch i.arg2.argType {
+	case noArgType:
+		panic("No argument type for " + i.op.String() + " op")
+	case constant:
+		arg2 = ir.constants[i.arg2.value]
+	case registerArg:
+		r.validateRegister(i.arg2.register())
 		arg2 = r.getRegister(i.arg2.value)
 	default:
 		panic("Unknown argument type")
 	}
-	r.setRegister(i.ret.value, r.getRegister(i.arg1.value)/arg2)
+	arg1 := r.getRegister(i.arg1.value)
+	t := r.resultType(i)
+	count := uint(arg2 & t.shiftMask())
+	var value int
+	switch i.op {
+	case and:
+		value = arg1 & arg2
+	case or:
+		value = arg1 | arg2
+	case xor:
+		value = arg1 ^ arg2
+	case shl:
+		value = arg1 << count
+	case lshr:
+		value = int(t.unsigned(arg1) >> count)
+	case ashr:
+		value = arg1 >> count
+	}
+	r.setResult(i, value)
 }
 
-func runLoad(i Instruction, r *Runtime, ir *IR) {
-	validateRegister(i.ret)
-	if i.arg2.argType != address {
-		panic("Load arg2 should be an address")
+func runUnary(i Instruction, r *Runtime) {
+	r.validateRegister(i.ret)
+	if i.arg2.argType != registerArg {
+		panic(i.op.String() + " arg2 should be a register")
+	}
+	r.validateRegister(i.arg2.register())
+	value := r.getRegister(i.arg2.value)
+	if i.op == not {
+		value = ^value
+	} else {
+		value = -value
+	}
+	r.setResult(i, value)
+}
+
+func runCompare(i Instruction, r *Runtime, ir *IR) {
+	arg2 := 0
+	r.validateRegister(i.ret)
+	r.validateRegister(i.arg1)
+	switch i.arg2.argType {
+	case noArgType:
+		panic("No argument type for compare op")
+	case constant:
+		// Constants may be written unsigned, so are wrapped like a register
+		// of the type
+		arg2 = r.operandType(i).wrap(ir.constants[i.arg2.value])
+	case registerArg:
+		r.validateRegister(i.arg2.register())
+		arg2 = r.getRegister(i.arg2.value)
+	default:
+		panic("Unknown argument type")
+	}
+	arg1 := r.getRegister(i.arg1.value)
+	var result bool
+	switch i.op {
+	case eq:
+		result = arg1 == arg2
+	case ne:
+		result = arg1 != arg2
+	case lt:
+		result = arg1 < arg2
+	case le:
+		result = arg1 <= arg2
+	case gt:
+		result = arg1 > arg2
+	case ge:
+		result = arg1 >= arg2
+	case ult:
+		result = uint64(arg1) < uint64(arg2)
+	case ule:
+		result = uint64(arg1) <= uint64(arg2)
+	case ugt:
+		result = uint64(arg1) > uint64(arg2)
+	case uge:
+		result = uint64(arg1) >= uint64(arg2)
+	default:
+		panic("Unknown comparison")
+	}
+	if result {
+		r.setRegister(i.ret.value, 1)
+	} else {
+		r.setRegister(i.ret.value, 0)
 	}
-	r.setRegister(i.ret.value, 0)
-	for t := 0; t < 8; t++ {
-		r.setRegister(i.ret.value, r.getRegister(i.ret.value)<<8)
-		r.setRegister(i.ret.value, r.getRegister(i.ret.value)|int(r.memory[r.getRegister(i.arg2.value)+ir.constants[i.arg2.offsetConstant]+t]))
+}
+
+func runConversion(i Instruction, r *Runtime) {
+	r.validateRegister(i.ret)
+	if i.arg2.argType != registerArg {
+		panic("Conversion arg2 should be a register")
+	}
+	r.validateRegister(i.arg2.register())
+	value := r.getRegister(i.arg2.value)
+	switch i.op {
+	case sext8:
+		value = int(int8(value))
+	case sext16:
+		value = int(int16(value))
+	case sext32:
+		value = int(int32(value))
+	case zext8:
+		value = int(uint8(value))
+	case zext16:
+		value = int(uint16(value))
+	case zext32:
+		value = int(uint32(value))
+	case sitof32, sitof64, f32tosi, f64tosi, f32tof64, f64tof32:
+		value = runFloatConversion(i.op, value, r.floatBehavior())
+	}
+	r.setResult(i, value)
+}
+
+func runFloat(i Instruction, r *Runtime) {
+	r.validateRegister(i.ret)
+	r.validateRegister(i.arg1)
+	if i.arg2.argType != registerArg {
+		panic("Float arithmetic arg2 should be a register")
 	}
+	r.validateRegister(i.arg2.register())
+	r.setResult(i, floatArithmetic(i.op, r.resultType(i), r.getRegister(i.arg1.value), r.getRegister(i.arg2.value), r.floatBehavior()))
 }
 
-func runStore(i Instruction, r *Runtime, ir *IR) {
-	validateRegister(i.arg1)
-	// TODO validateAddress(i.arg2)
+// The target's, when interpreting lowered IR
+func (r *Runtime) floatBehavior() FloatBehavior {
+	if r.arch == nil {
+		return SaturatingFloats
+	}
+	return r.arch.Floats
+}
+
+// The first byte of an access of size bytes, or a fault if the layout
+// forbids it
+func (r *Runtime) effectiveAddress(i Instruction, ir *IR, size int) (int, error) {
+	addr := r.getRegister(i.arg2.value) + ir.constants[i.arg2.offsetConstant]
+	if fault := r.layout.check(addr, size); fault != nil {
+		return 0, fault
+	}
+	return addr, nil
+}
+
+func runLoad(i Instruction, r *Runtime, ir *IR) error {
+	r.validateRegister(i.ret)
 	if i.arg2.argType != address {
-		panic("Store arg2 should be an address")
+		panic("Load arg2 should be an address")
+	}
+	size, signed := i.op.memoryAccess()
+	addr, err := r.effectiveAddress(i, ir, size)
+	if err != nil {
+		return err
+	}
+	value := r.endianness.get(r.memory[addr : addr+size])
+	if signed {
+		shift := uint(64 - 8*size)
+		value = value << shift >> shift
 	}
-	// Now we do the opposite and store 8 bytes
-	for t := 0; t < 8; t++ {
-		r.memory[r.getRegister(i.arg2.value)+ir.constants[i.arg2.offsetConstant]+t] = byte(r.getRegister(i.arg1.value) >> uint(8*(7-t)))
+	if r.tracer != nil {
+		r.tracer.MemoryRead(r.ir, addr, size, value)
 	}
+	r.setResult(i, value)
+	return nil
 }
 
-func (r *Runtime) print() {
-	for idx, i := range r.registers {
-		if i != 0 {
-			println("Register ", idx, " = ", i)
-		}
+func runStore(i Instruction, r *Runtime, ir *IR) error {
+	r.validateRegister(i.arg1)
+	if i.arg2.argType != address {
+		panic("Store arg2 should be an address")
 	}
-	for idx, i := range r.memory {
-		if i != 0 {
-			println("Memory ", idx, " = ", i)
-		}
+	size, _ := i.op.memoryAccess()
+	addr, err := r.effectiveAddress(i, ir, size)
+	if err != nil {
+		return err
+	}
+	value := r.getRegister(i.arg1.value)
+	if r.tracer != nil {
+		r.tracer.MemoryWrite(r.ir, addr, size, value)
 	}
+	r.endianness.put(r.memory[addr:addr+size], value)
+	return nil
 }
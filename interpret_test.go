@@ -1,7 +1,12 @@
 package navm
 
 import (
+	"context"
+	"errors"
+	"math"
+	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -246,3 +251,378 @@ func TestLoadAndStore(t *testing.T) {
 // 	}
 
 // }
+
+func TestLoop(t *testing.T) {
+	// Sums 1..10
+	ir := NewIR()
+	counter := ir.NewVirtualRegister()
+	ir.MoveConstant(counter, 10)
+	ir.MoveConstant(GetReturnRegister(), 0)
+	loop := ir.NewLabel()
+	ir.Label(loop)
+	ir.AddRegisters(GetReturnRegister(), GetReturnRegister(), counter)
+	ir.AddInstruction(Instruction{op: sub, ret: counter, arg1: counter, arg2: MakeConstant(ir.GetConstant(1))})
+	ir.Branch(counter, loop)
+	ir.Return()
+	result := Interpret(ir)
+	if result != 55 {
+		t.Errorf("Expected 55, got %d", result)
+	}
+}
+
+func TestJump(t *testing.T) {
+	ir := NewIR()
+	skip := ir.NewLabel()
+	ir.MoveConstant(GetReturnRegister(), 1)
+	ir.Jump(skip)
+	ir.MoveConstant(GetReturnRegister(), 2)
+	ir.Label(skip)
+	ir.Return()
+	result := Interpret(ir)
+	if result != 1 {
+		t.Errorf("Expected 1, got %d", result)
+	}
+}
+
+func TestJumpToUnplacedLabel(t *testing.T) {
+	ir := NewIR()
+	nowhere := ir.NewLabel()
+	ir.MoveConstant(GetReturnRegister(), 1)
+	ir.Branch(GetReturnRegister(), nowhere)
+	ir.Return()
+	_, err := interpret(context.Background(), &Module{functions: []*IR{ir}}, ir, nil, nil, InterpretOptions{})
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || !errors.Is(err, ErrInvalidOperand) {
+		t.Fatalf("Expected a RuntimeError wrapping ErrInvalidOperand, got %v", err)
+	}
+	if runtimeErr.Index != 1 {
+		t.Errorf("Expected instruction 1, got %d", runtimeErr.Index)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected Interpret to panic")
+		}
+	}()
+	Interpret(ir)
+}
+
+func TestCompareRegisters(t *testing.T) {
+	builders := map[string]func(ir *IR, ret Register, r1 Register, r2 Register){
+		"eq":  (*IR).EqRegisters,
+		"ne":  (*IR).NeRegisters,
+		"lt":  (*IR).LtRegisters,
+		"le":  (*IR).LeRegisters,
+		"gt":  (*IR).GtRegisters,
+		"ge":  (*IR).GeRegisters,
+		"ult": (*IR).UltRegisters,
+		"ule": (*IR).UleRegisters,
+		"ugt": (*IR).UgtRegisters,
+		"uge": (*IR).UgeRegisters,
+	}
+	cases := []struct {
+		op       string
+		a, b     int
+		expected int
+	}{
+		{"eq", 3, 3, 1}, {"eq", 3, 4, 0},
+		{"ne", 3, 3, 0}, {"ne", 3, 4, 1},
+		{"lt", -1, 1, 1}, {"lt", 1, 1, 0},
+		{"le", 1, 1, 1}, {"le", 2, 1, 0},
+		{"gt", 1, -1, 1}, {"gt", 1, 1, 0},
+		{"ge", 1, 1, 1}, {"ge", -2, 1, 0},
+		{"ult", 1, -1, 1}, {"ult", -1, 1, 0},
+		{"ule", -1, -1, 1}, {"ule", -1, 1, 0},
+		{"ugt", -1, 1, 1}, {"ugt", 1, -1, 0},
+		{"uge", -1, 1, 1}, {"uge", 1, 2, 0},
+	}
+	for _, c := range cases {
+		ir := NewIR()
+		a := ir.NewVirtualRegister()
+		b := ir.NewVirtualRegister()
+		ir.MoveConstant(a, c.a)
+		ir.MoveConstant(b, c.b)
+		builders[c.op](ir, GetReturnRegister(), a, b)
+		ir.Return()
+		result := Interpret(ir)
+		if result != c.expected {
+			t.Errorf("Expected %d %s %d to be %d, got %d", c.a, c.op, c.b, c.expected, result)
+		}
+	}
+}
+
+const infiniteLoop = `.constants 1
+loop:
+  %ret = add %ret, 1
+  jmp loop
+`
+
+func TestInterpretOutOfFuel(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(infiniteLoop))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = InterpretWithOptions(ir, InterpretOptions{Fuel: 10})
+	if !errors.Is(err, ErrOutOfFuel) {
+		t.Fatalf("Expected ErrOutOfFuel, got %v", err)
+	}
+	var interrupted *InterruptedError
+	if !errors.As(err, &interrupted) {
+		t.Fatalf("Expected an InterruptedError, got %v", err)
+	}
+	// Each pass runs the label, add and jmp, so 10 steps is three passes and
+	// the next label
+	if interrupted.State.Steps != 10 {
+		t.Errorf("Expected 10 steps, got %d", interrupted.State.Steps)
+	}
+	if interrupted.State.ReturnRegister != 3 {
+		t.Errorf("Expected %%ret = 3, got %d", interrupted.State.ReturnRegister)
+	}
+	if len(interrupted.State.Backtrace) != 1 || interrupted.State.Backtrace[0].Index != 1 {
+		t.Errorf("Expected to stop at main:1, got %v", interrupted.State.Backtrace)
+	}
+}
+
+func TestInterpretContextCancelled(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(infiniteLoop))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = InterpretContext(ctx, ir, InterpretOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if errors.Is(err, ErrOutOfFuel) {
+		t.Errorf("Expected cancellation to be distinct from running out of fuel")
+	}
+	var interrupted *InterruptedError
+	if !errors.As(err, &interrupted) || interrupted.State.Steps == 0 {
+		t.Errorf("Expected an InterruptedError with progress, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = InterpretContext(ctx, ir, InterpretOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestInterpretForArchitectureContextCancelled(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(infiniteLoop))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	m, err := ParseModule(strings.NewReader(".func loop 0\n" + infiniteLoop))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, target := range []string{AARCH64_MACOS_NONE, X64_LINUX_GNU, RISCV64_LINUX_MUSL} {
+		_, err = InterpretForArchitectureContext(ctx, ir, target, InterpretOptions{})
+		var interrupted *InterruptedError
+		if !errors.Is(err, context.Canceled) || !errors.As(err, &interrupted) {
+			t.Errorf("Expected a cancelled InterruptedError for %s, got %v", target, err)
+		}
+		_, err = InterpretModuleForArchitectureContext(ctx, m, target, "loop", InterpretOptions{})
+		if !errors.Is(err, context.Canceled) || !errors.As(err, &interrupted) {
+			t.Errorf("Expected a cancelled InterruptedError for %s, got %v", target, err)
+		}
+	}
+}
+
+func TestInterpretWithinFuel(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := InterpretModuleContext(context.Background(), m, "main", InterpretOptions{Fuel: 1000})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != 117 {
+		t.Errorf("Expected 117, got %d", result)
+	}
+}
+
+func TestStackPointer(t *testing.T) {
+	text := `.constants 16, 8, 0, 3, 4
+  %sp = sub %sp, 16
+  %v1 = mov 3
+  store %v1, [%sp + 8]
+  %v1 = mov 4
+  store %v1, [%sp + 0]
+  %v2 = load [%sp + 8]
+  %v3 = load [%sp + 0]
+  %ret = mul %v2, %v3
+  %sp = add %sp, 16
+  ret
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result := Interpret(ir); result != 12 {
+		t.Errorf("Expected 12, got %d", result)
+	}
+
+	// The stack starts at the top of the stack segment, and running past its
+	// bottom hits the guard region below
+	layout := SegmentedLayout(0, 64, 32, 16)
+	d, err := NewDebugger(ir, InterpretOptions{Memory: layout})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	d.Step()
+	sp, _ := d.Register(GetStackPointer())
+	if sp != layout.Size-16 {
+		t.Errorf("Expected %%sp = %d, got %d", layout.Size-16, sp)
+	}
+	d.Continue()
+	sp, _ = d.Register(GetStackPointer())
+	if sp != layout.Size {
+		t.Errorf("Expected %%sp = %d, got %d", layout.Size, sp)
+	}
+
+	overflow := strings.Replace(text, "sub %sp, 16", "sub %sp, 48", 1)
+	ir, err = ParseIR(strings.NewReader(overflow))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = InterpretWithOptions(ir, InterpretOptions{Memory: layout})
+	if !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Expected ErrOutOfBounds, got %v", err)
+	}
+}
+
+func TestBitwise(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected int
+	}{
+		{"%v1 = mov 12\n%ret = and %v1, 10\nret\n", 8},
+		{"%v1 = mov 12\n%ret = or %v1, 3\nret\n", 15},
+		{"%v1 = mov 12\n%ret = xor %v1, 10\nret\n", 6},
+		{"%v1 = mov 12\n%ret = not %v1\nret\n", -13},
+		{"%v1 = mov 12\n%ret = neg %v1\nret\n", -12},
+		{"%v1 = mov 3\n%ret = shl %v1, 62\nret\n", -1 << 62},
+		{"%v1 = mov -16\n%ret = lshr %v1, 60\nret\n", 15},
+		{"%v1 = mov -16\n%ret = ashr %v1, 2\nret\n", -4},
+		// Counts are taken modulo 64
+		{"%v1 = mov 1\n%v2 = mov 65\n%ret = shl %v1, %v2\nret\n", 2},
+		// and modulo 32 for narrower types, which shift at their own width
+		{".types %v1 i8, %v2 i8\n%v1 = mov -128\n%v2 = mov 33\n%v1 = lshr %v1, %v2\n%ret = sext8 %v1\nret\n", 64},
+		{".types %v1 i8, %v2 i8\n%v1 = mov -128\n%v1 = ashr %v1, 3\n%ret = sext8 %v1\nret\n", -16},
+		{".types %v1 i8, %v2 i8\n%v1 = mov 1\n%v2 = mov 9\n%v1 = shl %v1, %v2\n%ret = sext8 %v1\nret\n", 0},
+		{".types %v1 i16\n%v1 = mov -32768\n%v1 = neg %v1\n%ret = sext16 %v1\nret\n", -32768},
+		{".types %v1 i32\n%v1 = mov 1\n%v1 = shl %v1, 31\n%v1 = lshr %v1, 30\n%ret = zext32 %v1\nret\n", 2},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(c.text))
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", c.text, err)
+		}
+		if errs := Verify(ir); errs != nil {
+			t.Fatalf("Expected no errors for %q, got %v", c.text, errs)
+		}
+		if result := Interpret(ir); result != c.expected {
+			t.Errorf("Expected %d for %q, got %d", c.expected, c.text, result)
+		}
+		for _, target := range []string{AARCH64_MACOS_NONE, X64_WIN_GNU} {
+			result, err := InterpretForArchitecture(ir, target, InterpretOptions{})
+			if err != nil {
+				t.Fatalf("Unexpected error for %s: %s", target, err)
+			}
+			if result != c.expected {
+				t.Errorf("Expected %d for %q on %s, got %d", c.expected, c.text, target, result)
+			}
+		}
+	}
+}
+
+func TestBitwiseBuilders(t *testing.T) {
+	// An FNV-1a style step: (h ^ b) * prime, then folded with a shift
+	ir := NewFunction("hash", 2)
+	h := ir.Parameter(0)
+	b := ir.Parameter(1)
+	ir.XorRegisters(h, h, b)
+	prime := ir.NewVirtualRegister()
+	ir.MoveConstant(prime, 1099511628211)
+	ir.MultRegisters(h, h, prime)
+	shift := ir.NewVirtualRegister()
+	ir.MoveConstant(shift, 32)
+	folded := ir.NewVirtualRegister()
+	ir.LshrRegisters(folded, h, shift)
+	ir.XorRegisters(GetReturnRegister(), h, folded)
+	ir.Not(GetReturnRegister(), GetReturnRegister())
+	ir.Neg(GetReturnRegister(), GetReturnRegister())
+	ir.Return()
+	m := NewModule()
+	m.AddFunction(ir)
+	offset := uint64(14695981039346656037)
+	result, err := InterpretModuleE(m, "hash", int(offset), 'a')
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	hash := (offset ^ 'a') * 1099511628211
+	// neg of not adds one
+	expected := int(hash^hash>>32) + 1
+	if result != expected {
+		t.Errorf("Expected %d, got %d", expected, result)
+	}
+}
+
+func TestDivision(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected int
+	}{
+		{"%v1 = mov -7\n%ret = div %v1, 2\nret\n", -3},
+		{"%v1 = mov -7\n%ret = srem %v1, 2\nret\n", -1},
+		{"%v1 = mov 7\n%ret = srem %v1, -2\nret\n", 1},
+		{"%v1 = mov -8\n%ret = udiv %v1, 2\nret\n", math.MaxInt64 - 3},
+		{"%v1 = mov -7\n%ret = urem %v1, 2\nret\n", 1},
+		// The most negative value divided by -1 wraps around when asked to
+		{"%v1 = mov -9223372036854775808\n%ret = div.wrap %v1, -1\nret\n", math.MinInt64},
+		{"%v1 = mov -9223372036854775808\n%ret = srem %v1, -1\nret\n", 0},
+		{".types %v1 i8\n%v1 = mov -128\n%v1 = div.wrap %v1, -1\n%ret = sext8 %v1\nret\n", -128},
+		// Narrow unsigned division is of the type's own bits
+		{".types %v1 i8\n%v1 = mov -2\n%v1 = udiv %v1, 16\n%ret = sext8 %v1\nret\n", 15},
+		{".types %v1 i16\n%v1 = mov -1\n%v1 = urem %v1, 1000\n%ret = sext16 %v1\nret\n", 535},
+		{".types %v1 i32\n%v1 = mov -1\n%v1 = udiv %v1, 2\n%ret = sext32 %v1\nret\n", math.MaxInt32},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(c.text))
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", c.text, err)
+		}
+		result, err := InterpretE(ir)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", c.text, err)
+		}
+		if result != c.expected {
+			t.Errorf("Expected %d for %q, got %d", c.expected, c.text, result)
+		}
+		for _, target := range []string{AARCH64_MACOS_NONE, X64_WIN_GNU} {
+			result, err := InterpretForArchitecture(ir, target, InterpretOptions{})
+			if err != nil {
+				t.Fatalf("Unexpected error for %s: %s", target, err)
+			}
+			if result != c.expected {
+				t.Errorf("Expected %d for %q on %s, got %d", c.expected, c.text, target, result)
+			}
+		}
+	}
+
+	for _, op := range []string{"div", "udiv", "srem", "urem"} {
+		ir, err := ParseIR(strings.NewReader("%v1 = mov 0\n%ret = " + op + " %v1, %v1\nret\n"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if _, err := InterpretE(ir); !errors.Is(err, ErrDivideByZero) {
+			t.Errorf("Expected ErrDivideByZero for %s, got %v", op, err)
+		}
+	}
+}
@@ -100,6 +100,16 @@ func (q *LivenessQueue) Print() string {
 	return str + "]"
 }
 
+// The index of the interval for virtual register r, or -1
+func (q *LivenessQueue) find(r int) int {
+	for i, v := range q.intervals {
+		if r > 0 && v.register.value == r {
+			return i
+		}
+	}
+	return -1
+}
+
 func (q *LivenessQueue) Remove(i int) {
 	q.intervals = append(q.intervals[:i], q.intervals[i+1:]...)
 }
@@ -131,9 +141,43 @@ func makeIntervals(ir *IR) []Interval {
 		}
 	}
 
+	extendIntervalsForLoops(ir, intervals)
 	return intervals
 }
 
+// Intervals built in program order are only correct for straight-line code.
+// A backwards jump can carry any value live inside the loop around to its
+// start, so every interval overlapping a loop is stretched to cover all of it.
+// Repeats until nothing changes to handle nested loops.
+func extendIntervalsForLoops(ir *IR, intervals []Interval) {
+	positions := labelPositions(ir)
+	changed := true
+	for changed {
+		changed = false
+		for j, instr := range ir.instructions {
+			if instr.op != jmp && instr.op != br {
+				continue
+			}
+			loopStart := positions[instr.arg2.value]
+			if loopStart < 0 || loopStart > j {
+				continue
+			}
+			for r := 1; r < len(intervals); r++ {
+				if intervals[r].start > j || intervals[r].end <= loopStart {
+					continue
+				}
+				if intervals[r].start > loopStart || intervals[r].end < j+1 {
+					intervals[r].start = min(intervals[r].start, loopStart)
+					if intervals[r].end < j+1 {
+						intervals[r].end = j + 1
+					}
+					changed = true
+				}
+			}
+		}
+	}
+}
+
 func min(a int, b int) int {
 	if a < b {
 		return a
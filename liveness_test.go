@@ -1,6 +1,7 @@
 package navm
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -164,3 +165,30 @@ func TestLivenessQueueActive(t *testing.T) {
 	}
 
 }
+
+func TestMakeIntervalsLoop(t *testing.T) {
+	text := `  %v1 = mov 10
+  %v2 = mov 0
+  %v4 = mov 1
+loop:
+  %v3 = add %v2, %v1
+  %v2 = mov %v3
+  %v1 = sub %v1, %v4
+  br %v1, loop
+  %ret = mov %v2
+  ret
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	intervals := makeIntervals(ir)
+	// v4 is only read inside the loop, but must stay live until the branch
+	// back to the top
+	expected := [][2]int{{0, 0}, {0, 8}, {1, 9}, {3, 8}, {2, 8}}
+	for r, e := range expected {
+		if intervals[r].start != e[0] || intervals[r].end != e[1] {
+			t.Errorf("Expected %%v%d to be live (%d, %d), got (%d, %d)", r, e[0], e[1], intervals[r].start, intervals[r].end)
+		}
+	}
+}
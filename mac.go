@@ -2,11 +2,14 @@ package navm
 
 import (
 	"strconv"
+	"strings"
 )
 
+// Writes arm64 for macOS and, with ELF symbols and directives, Linux
 type MacGenerator struct {
-	arch *Architecture
-	ir   *IR
+	arch      *Architecture
+	ir        *IR
+	divisions int // checked so far, numbering their labels
 }
 
 func (g *MacGenerator) Init(a *Architecture, ir *IR) {
@@ -14,22 +17,133 @@ func (g *MacGenerator) Init(a *Architecture, ir *IR) {
 	g.ir = ir
 }
 
+func (g *MacGenerator) GetFileHeader() string {
+	if g.arch.ObjectFormat == ELF {
+		return ".text\n"
+	}
+	return ""
+}
+
+// Functions that make calls save the frame pointer and link register, which
+// bl overwrites
 func (g *MacGenerator) GetHeader() string {
-	return ".global _main\n.align 2\n\n_main:\n"
+	header := g.getGlobal(g.GetSymbol(g.ir.Name()))
+	if hasCalls(g.ir) {
+		header += "  stp X29, X30, [SP, #-16]!\n  mov X29, SP\n"
+	}
+	return header
 }
 
-// For now we just assume the last register assigned is the return register
+// Restores the frame pointer and link register saved for calls. The result
+// is already in X0.
 func (g *MacGenerator) GetReturn() string {
+	if hasCalls(g.ir) {
+		return "  ldp X29, X30, [SP], #16\n  ret\n"
+	}
 	return "  ret\n"
 }
 
+// Exports and starts the symbol name. ELF also marks it as a function.
+func (g *MacGenerator) getGlobal(name string) string {
+	if g.arch.ObjectFormat == ELF {
+		return ".global " + name + "\n.type " + name + ", %function\n.align 2\n\n" + name + ":\n"
+	}
+	return ".global " + name + "\n.align 2\n\n" + name + ":\n"
+}
+
+// Linux takes the system call number in X8 and the exit status in X0, where
+// entry returns it. macOS system call numbers are not a stable interface, so
+// it has no ExitSyscall and this is never called there.
+func (g *MacGenerator) GetStart(entry string) string {
+	return g.getGlobal("_start") +
+		"  bl " + g.GetSymbol(entry) + "\n" +
+		"  mov X8, #" + strconv.Itoa(g.arch.ExitSyscall) + "\n" +
+		"  svc #0\n\n"
+}
+
+// C symbols have a leading underscore on macOS, but not in ELF
+func (g *MacGenerator) GetSymbol(name string) string {
+	if g.arch.ObjectFormat == ELF {
+		return name
+	}
+	return "_" + name
+}
+
+// Labels starting with L are local to the object file on macOS, and those
+// starting with .L in ELF
+func (g *MacGenerator) getLocalLabel(name string) string {
+	if g.arch.ObjectFormat == ELF {
+		return ".L" + name
+	}
+	return "L" + name
+}
+
+func (g *MacGenerator) GetCall(instr Instruction) string {
+	return "  bl " + g.GetSymbol(g.ir.functions[instr.arg2.value]) + "\n"
+}
+
+// fmov moves between float registers, and moves the bits of an integer
+// register into one
 func (g *MacGenerator) GetTwoArgInstruction(op GenOp, instr Instruction) string {
 	name := g.GetTargetInstruction(op)
-	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
-	arg2 := g.GetArg(instr.arg2)
+	if op == movGenOp && instr.typ.IsFloat() {
+		name = "fmov"
+	}
+	retRegister := g.register(instr.ret.value, instr.typ)
+	if op == movGenOp && instr.arg2.argType == constant {
+		return arm64LoadImmediate(retRegister, g.ir.constants[instr.arg2.value]) + g.narrow(instr)
+	}
+	arg2 := g.getTypedArg(instr.arg2, instr.typ)
 	return "  " + name + " " + retRegister + ", " + arg2 + "\n"
 }
 
+// Loads value into rd, a W or X register. mov takes values with at most one
+// 16 bit chunk that is not all zeros, or not all ones. Others start with a
+// movz, or a movn if more chunks are all ones, and set the remaining chunks
+// with movk.
+func arm64LoadImmediate(rd string, value int) string {
+	chunks := 4
+	if strings.HasPrefix(rd, "W") {
+		chunks = 2
+	}
+	zeros, ones := 0, 0
+	for i := 0; i < chunks; i++ {
+		switch value >> uint(16*i) & 0xffff {
+		case 0:
+			zeros++
+		case 0xffff:
+			ones++
+		}
+	}
+	if zeros >= chunks-1 || ones >= chunks-1 {
+		return "  mov " + rd + ", #" + strconv.Itoa(value) + "\n"
+	}
+	fill, first := 0, "movz"
+	if ones > zeros {
+		fill, first = 0xffff, "movn"
+	}
+	xrn := ""
+	for i := 0; i < chunks; i++ {
+		chunk := value >> uint(16*i) & 0xffff
+		if chunk == fill {
+			continue
+		}
+		name := "movk"
+		if xrn == "" {
+			name = first
+			if fill != 0 {
+				chunk ^= 0xffff
+			}
+		}
+		xrn += "  " + name + " " + rd + ", #" + strconv.Itoa(chunk)
+		if i > 0 {
+			xrn += ", lsl #" + strconv.Itoa(16*i)
+		}
+		xrn += "\n"
+	}
+	return xrn
+}
+
 func (g *MacGenerator) GetTwoArgNoRetInstruction(op GenOp, instr Instruction) string {
 	name := g.GetTargetInstruction(op)
 	arg1Register := g.arch.GetPhysicalRegister(instr.arg1.value)
@@ -39,10 +153,136 @@ func (g *MacGenerator) GetTwoArgNoRetInstruction(op GenOp, instr Instruction) st
 
 func (g *MacGenerator) GetInstruction(op GenOp, instr Instruction) string {
 	name := g.GetTargetInstruction(op)
-	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
-	arg1 := g.arch.GetPhysicalRegister(instr.arg1.value)
-	arg2 := g.GetArg(instr.arg2)
-	return "  " + name + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n"
+	retRegister := g.register(instr.ret.value, instr.typ)
+	arg1 := g.register(instr.arg1.value, instr.typ)
+	arg2 := g.getTypedArg(instr.arg2, instr.typ)
+	return "  " + name + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n" + g.narrow(instr)
+}
+
+// i8 and i16 values are sign extended, so a logical right shift first zero
+// extends into the first scratch register, which is free since arg1 is only
+// reloaded into it when spilled
+func (g *MacGenerator) GetShiftInstruction(op GenOp, instr Instruction) string {
+	if op != lshrGenOp || (instr.typ != I8 && instr.typ != I16) {
+		return g.GetInstruction(op, instr)
+	}
+	extend := "uxtb"
+	if instr.typ == I16 {
+		extend = "uxth"
+	}
+	scratch := arm64WRegister(g.arch.GetPhysicalRegister(scratch_register_1))
+	retRegister := g.register(instr.ret.value, instr.typ)
+	arg1 := g.register(instr.arg1.value, instr.typ)
+	arg2 := g.getTypedArg(instr.arg2, instr.typ)
+	return "  " + extend + " " + scratch + ", " + arg1 + "\n" +
+		"  lsr " + retRegister + ", " + scratch + ", " + arg2 + "\n" + g.narrow(instr)
+}
+
+// IP0 and IP1 may only be clobbered by calls, so are free to hold
+// temporaries within an instruction
+const arm64Temporary0 = "X16"
+const arm64Temporary1 = "X17"
+
+// There is no remainder instruction, so srem and urem divide then take
+// arg1 - quotient * arg2 with msub. Unsigned division of i8 and i16 first
+// zero extends its sign extended operands into the temporaries.
+func (g *MacGenerator) GetDivision(op GenOp, instr Instruction) string {
+	retRegister := g.register(instr.ret.value, instr.typ)
+	arg1 := g.register(instr.arg1.value, instr.typ)
+	arg2 := g.register(instr.arg2.value, instr.typ)
+	name := "sdiv"
+	xrn := g.getDivisionCheck(op, instr, arg1, arg2)
+	quotient := arm64Temporary0
+	if instr.typ.Size() <= 4 {
+		quotient = arm64WRegister(quotient)
+	}
+	if op == udivGenOp || op == uremGenOp {
+		name = "udiv"
+		if instr.typ == I8 || instr.typ == I16 {
+			extend := "uxtb"
+			if instr.typ == I16 {
+				extend = "uxth"
+			}
+			xrn += "  " + extend + " " + arm64WRegister(arm64Temporary0) + ", " + arg1 + "\n"
+			xrn += "  " + extend + " " + arm64WRegister(arm64Temporary1) + ", " + arg2 + "\n"
+			arg1 = arm64WRegister(arm64Temporary0)
+			arg2 = arm64WRegister(arm64Temporary1)
+			// The operands are copies, so the result can hold the quotient
+			quotient = retRegister
+		}
+	}
+	if op == divGenOp || op == udivGenOp {
+		return xrn + "  " + name + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n" + g.narrow(instr)
+	}
+	xrn += "  " + name + " " + quotient + ", " + arg1 + ", " + arg2 + "\n"
+	xrn += "  msub " + retRegister + ", " + quotient + ", " + arg2 + ", " + arg1 + "\n"
+	return xrn + g.narrow(instr)
+}
+
+// sdiv and udiv return 0 for a zero divisor and wrap on overflow, which msub
+// turns into the remainders WrapFaults asks for, so only TrapFaults needs
+// checks. They branch to a brk, and signed division compares arg1 with the
+// type's minimum only when arg2 is -1, using ccmp.
+func (g *MacGenerator) getDivisionCheck(op GenOp, instr Instruction, arg1 string, arg2 string) string {
+	if instr.traps != TrapFaults {
+		return ""
+	}
+	g.divisions++
+	suffix := strconv.Itoa(g.divisions) + "_" + g.ir.Name()
+	done := g.getLocalLabel("div" + suffix)
+	if op != divGenOp {
+		return "  cbnz " + arg2 + ", " + done + "\n  brk #1\n" + done + ":\n"
+	}
+	trap := g.getLocalLabel("trap" + suffix)
+	minimum := arm64Temporary0
+	if instr.typ.Size() <= 4 {
+		minimum = arm64WRegister(minimum)
+	}
+	return "  cbz " + arg2 + ", " + trap + "\n" +
+		"  mov " + minimum + ", #" + strconv.Itoa(instr.typ.minimum()) + "\n" +
+		"  cmn " + arg2 + ", #1\n" +
+		"  ccmp " + arg1 + ", " + minimum + ", #0, eq\n" +
+		"  b.ne " + done + "\n" +
+		trap + ":\n  brk #1\n" + done + ":\n"
+}
+
+func (g *MacGenerator) GetUnaryInstruction(op GenOp, instr Instruction) string {
+	name := g.GetTargetInstruction(op)
+	retRegister := g.register(instr.ret.value, instr.typ)
+	arg2 := g.register(instr.arg2.value, instr.typ)
+	return "  " + name + " " + retRegister + ", " + arg2 + "\n" + g.narrow(instr)
+}
+
+// Types of 32 bits or less use the W view of a register, and an f32 the S
+// view of a float register
+func (g *MacGenerator) register(value int, t Type) string {
+	register := g.arch.GetPhysicalRegister(value)
+	if t.Size() <= 4 {
+		return arm64SRegister(arm64WRegister(register))
+	}
+	return register
+}
+
+func (g *MacGenerator) getTypedArg(arg Arg, t Type) string {
+	if arg.argType == registerArg && !arg.isVirtualRegister {
+		return g.register(arg.value, t)
+	}
+	return g.GetArg(arg)
+}
+
+// There are no 8 or 16 bit operations, so i8 and i16 values are kept sign
+// extended to 32 bits. Operations that may leave other bits set re-extend
+// their result.
+func (g *MacGenerator) narrow(instr Instruction) string {
+	retRegister := g.register(instr.ret.value, instr.typ)
+	switch instr.typ {
+	case I8:
+		return "  sxtb " + retRegister + ", " + retRegister + "\n"
+	case I16:
+		return "  sxth " + retRegister + ", " + retRegister + "\n"
+	default:
+		return ""
+	}
 }
 
 func (g *MacGenerator) GetAddress(arg Arg) string {
@@ -69,6 +309,216 @@ func (g *MacGenerator) GetArg(arg Arg) string {
 	}
 }
 
+// Labels are only unique within a function, so are qualified with its name.
+// IR names cannot contain $.
+func (g *MacGenerator) GetLabelName(l int) string {
+	return g.getLocalLabel(g.ir.Name() + "$" + g.ir.labels[l])
+}
+
+func (g *MacGenerator) GetLabel(instr Instruction) string {
+	return g.GetLabelName(instr.arg2.value) + ":\n"
+}
+
+func (g *MacGenerator) GetJump(instr Instruction) string {
+	return "  b " + g.GetLabelName(instr.arg2.value) + "\n"
+}
+
+func (g *MacGenerator) GetBranch(instr Instruction) string {
+	cond := g.register(instr.arg1.value, instr.typ)
+	return "  cbnz " + cond + ", " + g.GetLabelName(instr.arg2.value) + "\n"
+}
+
+// Constants are wrapped to the type, since one written unsigned, like 200 for
+// an i8, is compared with a sign extended register
+func (g *MacGenerator) GetCompareInstruction(op GenOp, instr Instruction) string {
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	arg1 := g.register(instr.arg1.value, instr.typ)
+	arg2 := g.getTypedArg(instr.arg2, instr.typ)
+	if instr.arg2.argType == constant {
+		arg2 = "#" + strconv.Itoa(instr.typ.wrap(g.ir.constants[instr.arg2.value]))
+	}
+	return "  cmp " + arg1 + ", " + arg2 + "\n  cset " + retRegister + ", " + g.GetCondition(op) + "\n"
+}
+
+// Zero extending loads write the W register, which clears the top half of the
+// X register. Sign extending loads write the register for the type.
+func (g *MacGenerator) GetSizedLoad(instr Instruction) string {
+	size, signed := instr.op.memoryAccess()
+	retRegister := g.register(instr.ret.value, instr.typ)
+	var name string
+	switch {
+	case size == 1 && signed:
+		name = "ldrsb"
+	case size == 1:
+		name = "ldrb"
+	case size == 2 && signed:
+		name = "ldrsh"
+	case size == 2:
+		name = "ldrh"
+	case size == 4 && signed:
+		name = "ldrsw"
+	case size == 4:
+		name = "ldr"
+	default:
+		panic("Unknown load size: " + strconv.Itoa(size))
+	}
+	if !signed {
+		retRegister = arm64WRegister(retRegister)
+	}
+	xrn := "  " + name + " " + retRegister + ", " + g.GetArg(instr.arg2) + "\n"
+	if !signed && size == instr.typ.Size() {
+		xrn += g.narrow(instr)
+	}
+	return xrn
+}
+
+func (g *MacGenerator) GetSizedStore(instr Instruction) string {
+	size, _ := instr.op.memoryAccess()
+	var name string
+	switch size {
+	case 1:
+		name = "strb"
+	case 2:
+		name = "strh"
+	case 4:
+		name = "str"
+	default:
+		panic("Unknown store size: " + strconv.Itoa(size))
+	}
+	arg1Register := arm64WRegister(g.arch.GetPhysicalRegister(instr.arg1.value))
+	return "  " + name + " " + arg1Register + ", " + g.GetArg(instr.arg2) + "\n"
+}
+
+// Writing a W register clears the top half of the X register, which zero
+// extends. Truncating to i8 or i16 sign extends to keep them in the form
+// narrow expects.
+func (g *MacGenerator) GetConversion(instr Instruction) string {
+	if _, _, ok := instr.op.floatConversion(); ok {
+		return g.getFloatConversion(instr)
+	}
+	retRegister := g.register(instr.ret.value, instr.typ)
+	retW := arm64WRegister(retRegister)
+	arg2 := arm64WRegister(g.arch.GetPhysicalRegister(instr.arg2.value))
+	var xrn string
+	switch instr.op {
+	case sext8:
+		xrn = "sxtb " + retRegister
+	case sext16:
+		xrn = "sxth " + retRegister
+	case sext32:
+		xrn = "sxtw " + retRegister
+	case zext8:
+		xrn = "uxtb " + retW
+	case zext16:
+		xrn = "uxth " + retW
+	case zext32:
+		xrn = "mov " + retW
+	case trunc:
+		switch instr.typ {
+		case I8:
+			xrn = "sxtb " + retW
+		case I16:
+			xrn = "sxth " + retW
+		default:
+			xrn = "mov " + retW
+		}
+	default:
+		panic("Unknown conversion: " + instr.op.String())
+	}
+	return "  " + xrn + ", " + arg2 + "\n"
+}
+
+// Float to integer conversions round towards zero and saturate, as
+// SaturatingFloats describes
+func (g *MacGenerator) getFloatConversion(instr Instruction) string {
+	from, to, _ := instr.op.floatConversion()
+	retRegister := g.register(instr.ret.value, to)
+	arg2 := g.register(instr.arg2.value, from)
+	var name string
+	switch {
+	case !from.IsFloat():
+		name = "scvtf"
+	case !to.IsFloat():
+		name = "fcvtzs"
+	default:
+		name = "fcvt"
+	}
+	return "  " + name + " " + retRegister + ", " + arg2 + "\n"
+}
+
+func (g *MacGenerator) GetFloatInstruction(op GenOp, instr Instruction) string {
+	var name string
+	switch op {
+	case addGenOp:
+		name = "fadd"
+	case subGenOp:
+		name = "fsub"
+	case multGenOp:
+		name = "fmul"
+	case divGenOp:
+		name = "fdiv"
+	default:
+		panic("Unknown float operation: " + strconv.Itoa(int(op)))
+	}
+	retRegister := g.register(instr.ret.value, instr.typ)
+	arg1 := g.register(instr.arg1.value, instr.typ)
+	arg2 := g.register(instr.arg2.value, instr.typ)
+	return "  " + name + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n"
+}
+
+func (g *MacGenerator) GetFloatLoad(instr Instruction) string {
+	retRegister := g.register(instr.ret.value, instr.op.floatAccess())
+	return "  ldr " + retRegister + ", " + g.GetArg(instr.arg2) + "\n"
+}
+
+func (g *MacGenerator) GetFloatStore(instr Instruction) string {
+	arg1Register := g.register(instr.arg1.value, instr.op.floatAccess())
+	return "  str " + arg1Register + ", " + g.GetArg(instr.arg2) + "\n"
+}
+
+// The single precision view of a float register
+func arm64SRegister(register string) string {
+	if strings.HasPrefix(register, "D") {
+		return "S" + register[1:]
+	}
+	return register
+}
+
+// The low 32 bits of a 64 bit register
+func arm64WRegister(register string) string {
+	if strings.HasPrefix(register, "X") {
+		return "W" + register[1:]
+	}
+	return register
+}
+
+func (g *MacGenerator) GetCondition(op GenOp) string {
+	switch op {
+	case eqGenOp:
+		return "eq"
+	case neGenOp:
+		return "ne"
+	case ltGenOp:
+		return "lt"
+	case leGenOp:
+		return "le"
+	case gtGenOp:
+		return "gt"
+	case geGenOp:
+		return "ge"
+	case ultGenOp:
+		return "lo"
+	case uleGenOp:
+		return "ls"
+	case ugtGenOp:
+		return "hi"
+	case ugeGenOp:
+		return "hs"
+	default:
+		panic("Unknown comparison: " + strconv.Itoa(int(op)))
+	}
+}
+
 func (g *MacGenerator) GetTargetInstruction(op GenOp) string {
 	switch op {
 	case addGenOp:
@@ -85,6 +535,22 @@ func (g *MacGenerator) GetTargetInstruction(op GenOp) string {
 		return "ldr"
 	case storeGenOp:
 		return "str"
+	case andGenOp:
+		return "and"
+	case orGenOp:
+		return "orr"
+	case xorGenOp:
+		return "eor"
+	case shlGenOp:
+		return "lsl"
+	case lshrGenOp:
+		return "lsr"
+	case ashrGenOp:
+		return "asr"
+	case notGenOp:
+		return "mvn"
+	case negGenOp:
+		return "neg"
 	default:
 		panic("Unknown operation: " + strconv.Itoa(int(op)))
 	}
@@ -0,0 +1,129 @@
+package navm
+
+import (
+	"fmt"
+)
+
+const defaultMemorySize = 1024
+
+// A named, accessible range of interpreter memory
+type Segment struct {
+	Name  string
+	Start int
+	Size  int
+}
+
+// How the interpreter lays out memory. The zero value is 1024 bytes that may
+// all be accessed, at any alignment.
+type MemoryLayout struct {
+	Size int // in bytes, or 0 for 1024
+	// If set, every access must fall entirely inside one segment. Memory
+	// outside the segments acts as a guard region.
+	Segments []Segment
+	// Fault on accesses whose address is not a multiple of their size
+	CheckAlignment bool
+}
+
+// Lays out globals, heap and stack in that order, with the stack at the top
+// of memory. A guard region of the given size comes before each segment, so
+// address 0 always faults.
+func SegmentedLayout(globals int, heap int, stack int, guard int) MemoryLayout {
+	l := MemoryLayout{}
+	next := 0
+	for _, s := range []Segment{{Name: "globals", Size: globals}, {Name: "heap", Size: heap}, {Name: "stack", Size: stack}} {
+		next += guard
+		s.Start = next
+		next += s.Size
+		l.Segments = append(l.Segments, s)
+	}
+	l.Size = next
+	return l
+}
+
+// The named segment, or nil
+func (l *MemoryLayout) Segment(name string) *Segment {
+	for idx := range l.Segments {
+		if l.Segments[idx].Name == name {
+			return &l.Segments[idx]
+		}
+	}
+	return nil
+}
+
+func (l *MemoryLayout) size() int {
+	if l.Size == 0 {
+		return defaultMemorySize
+	}
+	return l.Size
+}
+
+// The initial stack pointer: the end of the stack segment if there is one,
+// otherwise the end of memory. The stack grows down from there.
+func (l *MemoryLayout) stackTop() int {
+	if s := l.Segment("stack"); s != nil {
+		return s.Start + s.Size
+	}
+	return l.size()
+}
+
+func (l *MemoryLayout) validate() error {
+	if l.Size < 0 {
+		return fmt.Errorf("%w: memory size %d", ErrInvalidOperand, l.Size)
+	}
+	for idx, s := range l.Segments {
+		if s.Start < 0 || s.Size < 0 || s.Start > l.size() || s.Size > l.size()-s.Start {
+			return fmt.Errorf("%w: segment %s [%d, %d) outside memory of %d bytes", ErrInvalidOperand, s.Name, s.Start, s.Start+s.Size, l.size())
+		}
+		for _, t := range l.Segments[:idx] {
+			if s.Start < t.Start+t.Size && t.Start < s.Start+s.Size {
+				return fmt.Errorf("%w: segments %s and %s overlap", ErrInvalidOperand, t.Name, s.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns a fault, without Function and Index filled in, if an access of size
+// bytes at addr is not allowed
+func (l *MemoryLayout) check(addr int, size int) *MemoryFault {
+	if l.CheckAlignment && addr%size != 0 {
+		return &MemoryFault{Address: addr, Size: size, Err: ErrMisaligned}
+	}
+	// Written so that addr+size cannot overflow
+	if addr < 0 || size > l.size() || addr > l.size()-size {
+		return &MemoryFault{Address: addr, Size: size, Err: ErrOutOfBounds}
+	}
+	if len(l.Segments) == 0 {
+		return nil
+	}
+	for _, s := range l.Segments {
+		if addr >= s.Start && addr+size <= s.Start+s.Size {
+			return nil
+		}
+	}
+	return &MemoryFault{Address: addr, Size: size, Err: ErrOutOfBounds}
+}
+
+// Reads len(b) bytes as an integer
+func (e Endianness) get(b []byte) int {
+	value := 0
+	for t := range b {
+		if e == BigEndian {
+			value = value<<8 | int(b[t])
+		} else {
+			value = value<<8 | int(b[len(b)-1-t])
+		}
+	}
+	return value
+}
+
+// Writes the low len(b) bytes of value
+func (e Endianness) put(b []byte, value int) {
+	for t := range b {
+		if e == BigEndian {
+			b[len(b)-1-t] = byte(value >> uint(8*t))
+		} else {
+			b[t] = byte(value >> uint(8*t))
+		}
+	}
+}
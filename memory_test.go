@@ -0,0 +1,237 @@
+package navm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+// Stores 7 at the address in %v1 and loads it back
+func storeAt(t *testing.T, addr int) *IR {
+	ir := NewIR()
+	r1 := ir.NewVirtualRegister()
+	r2 := ir.NewVirtualRegister()
+	ir.MoveConstant(r1, addr)
+	ir.MoveConstant(r2, 7)
+	if err := ir.Store(r2, r1.ToAddress(ir.GetConstant(0))); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := ir.Load(GetReturnRegister(), r1.ToAddress(ir.GetConstant(0))); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ir.Return()
+	return ir
+}
+
+func TestMemorySize(t *testing.T) {
+	result, err := InterpretWithOptions(storeAt(t, 4000), InterpretOptions{Memory: MemoryLayout{Size: 4096}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != 7 {
+		t.Errorf("Expected 7, got %d", result)
+	}
+
+	_, err = InterpretWithOptions(storeAt(t, 4090), InterpretOptions{Memory: MemoryLayout{Size: 4096}})
+	var fault *MemoryFault
+	if !errors.As(err, &fault) {
+		t.Fatalf("Expected a MemoryFault, got %v", err)
+	}
+	if fault.Address != 4090 || fault.Index != 2 || fault.Function != "main" || !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Expected an out of bounds fault at 4090 by main:2, got %s", fault)
+	}
+}
+
+func TestSegmentedLayout(t *testing.T) {
+	l := SegmentedLayout(64, 128, 256, 16)
+	if l.Size != 16+64+16+128+16+256 {
+		t.Errorf("Expected 496 bytes, got %d", l.Size)
+	}
+	stack := l.Segment("stack")
+	if stack == nil || stack.Start+stack.Size != l.Size {
+		t.Errorf("Expected the stack at the top of memory, got %v", stack)
+	}
+	heap := l.Segment("heap")
+	opts := InterpretOptions{Memory: l}
+
+	result, err := InterpretWithOptions(storeAt(t, heap.Start), opts)
+	if err != nil || result != 7 {
+		t.Errorf("Expected 7 from the heap, got %d and %v", result, err)
+	}
+	cases := []int{
+		0,                          // guard below globals
+		heap.Start - 8,             // guard between globals and heap
+		heap.Start + heap.Size - 4, // straddles the end of the heap
+		stack.Start + stack.Size,   // past the top of memory
+	}
+	for _, addr := range cases {
+		_, err := InterpretWithOptions(storeAt(t, addr), opts)
+		var fault *MemoryFault
+		if !errors.As(err, &fault) || fault.Address != addr || !errors.Is(err, ErrOutOfBounds) {
+			t.Errorf("Expected an out of bounds fault at %d, got %v", addr, err)
+		}
+	}
+}
+
+func TestAccessNearMaxInt(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(`  %v1 = mov 9223372036854775805
+  %v2 = load [%v1 + 0]
+  ret
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = InterpretE(ir)
+	var fault *MemoryFault
+	if !errors.As(err, &fault) || fault.Address != 9223372036854775805 || !errors.Is(err, ErrOutOfBounds) {
+		t.Errorf("Expected an out of bounds fault, got %v", err)
+	}
+}
+
+func TestMisalignedAccess(t *testing.T) {
+	_, err := InterpretWithOptions(storeAt(t, 12), InterpretOptions{})
+	if err != nil {
+		t.Errorf("Expected misaligned accesses to be allowed by default, got %s", err)
+	}
+	_, err = InterpretWithOptions(storeAt(t, 12), InterpretOptions{Memory: MemoryLayout{CheckAlignment: true}})
+	var fault *MemoryFault
+	if !errors.As(err, &fault) || !errors.Is(err, ErrMisaligned) || fault.Address != 12 || fault.Size != 8 {
+		t.Errorf("Expected a misaligned fault at 12, got %v", err)
+	}
+}
+
+func TestInvalidLayout(t *testing.T) {
+	layouts := []MemoryLayout{
+		{Size: -1},
+		{Size: 64, Segments: []Segment{{Name: "a", Start: 32, Size: 64}}},
+		{Segments: []Segment{{Name: "a", Start: 0, Size: 64}, {Name: "b", Start: 32, Size: 64}}},
+	}
+	ir, err := ParseIR(strings.NewReader("ret\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, l := range layouts {
+		if _, err := InterpretWithOptions(ir, InterpretOptions{Memory: l}); !errors.Is(err, ErrInvalidOperand) {
+			t.Errorf("Expected ErrInvalidOperand for %v, got %v", l, err)
+		}
+	}
+}
+
+func TestEndianness(t *testing.T) {
+	value := 0x0102030405060708
+	cases := []struct {
+		endianness Endianness
+		first      byte
+	}{
+		{LittleEndian, 0x08},
+		{BigEndian, 0x01},
+	}
+	for _, c := range cases {
+		ir := NewIR()
+		r1 := ir.NewVirtualRegister()
+		r2 := ir.NewVirtualRegister()
+		ir.MoveConstant(r1, 16)
+		ir.MoveConstant(r2, value)
+		ir.Store(r2, r1.ToAddress(ir.GetConstant(0)))
+		ir.Load(GetReturnRegister(), r1.ToAddress(ir.GetConstant(0)))
+		ir.Return()
+		d, err := NewDebugger(ir, InterpretOptions{Endianness: c.endianness})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		d.Step()
+		d.Step()
+		d.Step()
+		mem, _ := d.Memory(16, 8)
+		if mem[0] != c.first {
+			t.Errorf("Expected first byte %#x for %v, got %v", c.first, c.endianness, mem)
+		}
+		d.Continue()
+		if d.Result() != value {
+			t.Errorf("Expected %#x back, got %#x", value, d.Result())
+		}
+	}
+	for triple, a := range Architectures {
+		if a.Endianness != LittleEndian {
+			t.Errorf("Expected %s to be little-endian", triple)
+		}
+	}
+}
+
+func TestSizedLoadsAndStores(t *testing.T) {
+	text := `.registers 9
+.constants 16, 0, 1, 2, 4, -1
+  %v1 = mov 16
+  %v2 = mov -1
+  store %v2, [%v1 + 0]
+  %v3 = load8u [%v1 + 0]
+  %v4 = load8s [%v1 + 0]
+  %v5 = load16u [%v1 + 0]
+  %v6 = load16s [%v1 + 0]
+  %v7 = load32u [%v1 + 0]
+  %v8 = load32s [%v1 + 0]
+  %v2 = mov 0
+  store %v2, [%v1 + 0]
+  %v2 = mov -1
+  store8 %v2, [%v1 + 1]
+  store16 %v2, [%v1 + 2]
+  store32 %v2, [%v1 + 4]
+  %ret = load [%v1 + 0]
+  ret
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ir.Print() != text {
+		t.Errorf("Expected\n%s\ngot\n%s", text, ir.Print())
+	}
+	d, err := NewDebugger(ir, InterpretOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for d.Location().Index < 9 {
+		d.Step()
+	}
+	expected := []int{0, 16, -1, 0xff, -1, 0xffff, -1, 0xffffffff, -1}
+	registers := d.Registers()
+	for r := 3; r < len(expected); r++ {
+		if registers[r] != expected[r] {
+			t.Errorf("Expected %%v%d = %d, got %d", r, expected[r], registers[r])
+		}
+	}
+	d.Continue()
+	// Byte 0 is untouched, byte 1 from store8, bytes 2-3 from store16 and
+	// bytes 4-7 from store32
+	if d.Result() != -256 {
+		t.Errorf("Expected %#x, got %#x", -256, d.Result())
+	}
+}
+
+func TestSizedAccessBounds(t *testing.T) {
+	ir := NewIR()
+	r1 := ir.NewVirtualRegister()
+	ir.MoveConstant(r1, 1023)
+	if err := ir.LoadSized(GetReturnRegister(), r1.ToAddress(ir.GetConstant(0)), 1, true); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ir.Return()
+	if _, err := InterpretE(ir); err != nil {
+		t.Errorf("Expected a 1 byte load at 1023 to succeed, got %s", err)
+	}
+	ir.instructions[1].op = load16u
+	_, err := InterpretE(ir)
+	var fault *MemoryFault
+	if !errors.As(err, &fault) || fault.Size != 2 {
+		t.Errorf("Expected a 2 byte fault, got %v", err)
+	}
+	if err := ir.LoadSized(r1, r1.ToAddress(ir.GetConstant(0)), 3, false); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand for a 3 byte load, got %v", err)
+	}
+	if err := ir.StoreSized(r1, r1.ToAddress(ir.GetConstant(0)), 16); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand for a 16 byte store, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package navm
+
+// A set of functions that can call each other
+type Module struct {
+	functions []*IR
+}
+
+func NewModule() *Module {
+	return &Module{}
+}
+
+// Creates a function and adds it to the module
+func (m *Module) NewFunction(name string, params int) *IR {
+	ir := NewFunction(name, params)
+	m.AddFunction(ir)
+	return ir
+}
+
+func (m *Module) AddFunction(ir *IR) {
+	if m.Function(ir.Name()) != nil {
+		panic("Duplicate function: " + ir.Name())
+	}
+	m.functions = append(m.functions, ir)
+}
+
+// Looks up a function by name, returning nil if there is none
+func (m *Module) Function(name string) *IR {
+	for _, f := range m.functions {
+		if f.Name() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *Module) Functions() []*IR {
+	return m.functions
+}
+
+// Prints every function in the textual format understood by ParseModule
+func (m *Module) Print() string {
+	ret := ""
+	for idx, f := range m.functions {
+		if idx > 0 {
+			ret += "\n"
+		}
+		ret += printIR(f, true)
+	}
+	return ret
+}
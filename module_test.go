@@ -0,0 +1,380 @@
+package navm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+const factorialModule = `.func fact 1
+.registers 5
+.constants 1
+  %v2 = le %v1, 1
+  br %v2, base
+  %v3 = sub %v1, 1
+  %v4 = call @fact(%v3)
+  %ret = mul %v1, %v4
+  ret
+base:
+  %ret = mov 1
+  ret
+
+.func main 0
+.registers 3
+.constants 5, 3
+  %v1 = mov 5
+  %v2 = call @fact(%v1)
+  %ret = sub %v2, 3
+  ret
+`
+
+func TestParseModuleRoundTrip(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if m.Print() != factorialModule {
+		t.Errorf("Expected\n%s\ngot\n%s", factorialModule, m.Print())
+	}
+	if m.Function("fact").ParamCount() != 1 {
+		t.Errorf("Expected fact to take 1 parameter, got %d", m.Function("fact").ParamCount())
+	}
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	decoded := NewModule()
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if decoded.Print() != factorialModule {
+		t.Errorf("Expected\n%s\ngot\n%s", factorialModule, decoded.Print())
+	}
+}
+
+func TestInterpretModule(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result := InterpretModule(m, "main")
+	if result != 117 {
+		t.Errorf("Expected 117, got %d", result)
+	}
+	result = InterpretModule(m, "fact", 6)
+	if result != 720 {
+		t.Errorf("Expected 720, got %d", result)
+	}
+}
+
+func TestModuleBuilder(t *testing.T) {
+	m := NewModule()
+	add3 := m.NewFunction("add3", 3)
+	sum := add3.NewVirtualRegister()
+	add3.AddRegisters(sum, add3.Parameter(0), add3.Parameter(1))
+	add3.AddRegisters(GetReturnRegister(), sum, add3.Parameter(2))
+	add3.Return()
+
+	main := m.NewFunction("main", 0)
+	a := main.NewVirtualRegister()
+	b := main.NewVirtualRegister()
+	main.MoveConstant(a, 2)
+	main.MoveConstant(b, 5)
+	main.Call(b, "add3", a, b, a)
+	main.MultRegisters(GetReturnRegister(), a, b)
+	main.Return()
+
+	result := InterpretModule(m, "main")
+	if result != 18 {
+		t.Errorf("Expected 18, got %d", result)
+	}
+}
+
+func TestCompileModule(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result := CompileModule(m, AARCH64_MACOS_NONE)
+	for _, expected := range []string{
+		".global _fact\n.align 2\n\n_fact:\n  stp X29, X30, [SP, #-16]!\n  mov X29, SP\n",
+		"  mov X9, X0\n  str X9, [SP, #0]\n",
+		"  mov X0, X12\n",
+		"  bl _fact\n",
+		"  ldp X29, X30, [SP], #16\n  ret\n",
+		".global _main\n",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %q in\n%s", expected, result)
+		}
+	}
+
+	m, _ = ParseModule(strings.NewReader(factorialModule))
+	result = CompileModule(m, X64_WIN_GNU)
+	for _, expected := range []string{
+		"section .text\n\tglobal fact\n\nfact:\n",
+		"  mov R10, RCX\n",
+		"  sub RSP, 32\n  call fact\n  add RSP, 32\n",
+		"\tglobal main\n",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %q in\n%s", expected, result)
+		}
+	}
+	if strings.Count(result, "section .text") != 1 {
+		t.Errorf("Expected a single section directive in\n%s", result)
+	}
+
+	// ELF symbols have no underscore, and local labels start with .L
+	m, _ = ParseModule(strings.NewReader(factorialModule))
+	result = CompileModule(m, AARCH64_LINUX_GNU)
+	for _, expected := range []string{
+		".text\n.global fact\n.type fact, %function\n.align 2\n\nfact:\n",
+		"  cbnz X11, .Lfact$base\n",
+		"  bl fact\n",
+		".Lfact$base:\n",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %q in\n%s", expected, result)
+		}
+	}
+
+	// System V passes the first argument in RDI and has no shadow space
+	m, _ = ParseModule(strings.NewReader(factorialModule))
+	result = CompileModule(m, X64_LINUX_GNU)
+	for _, expected := range []string{
+		".text\n\t.globl fact\n\nfact:\n",
+		"  mov %rdi, %r10\n",
+		"  mov %r13, %rdi\n  call fact\n  mov %rax, %r14\n",
+		"  jnz .Lfact$base\n",
+		"\t.globl main\n",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %q in\n%s", expected, result)
+		}
+	}
+
+	// ra is saved around calls, in a frame that keeps sp 16 byte aligned
+	m, _ = ParseModule(strings.NewReader(factorialModule))
+	result = CompileModule(m, RISCV64_LINUX_MUSL)
+	for _, expected := range []string{
+		".text\n.globl fact\n.type fact, @function\n.align 2\n\nfact:\n  addi sp, sp, -16\n  sd ra, 0(sp)\n",
+		"  mv t0, a0\n",
+		"  bnez t2, .Lfact$base\n",
+		"  mv a0, t3\n  call fact\n  mv t4, a0\n",
+		"  ld ra, 0(sp)\n  addi sp, sp, 16\n  ret\n",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %q in\n%s", expected, result)
+		}
+	}
+}
+
+func TestCompileStart(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := CompileModuleWithOptions(m, X64_LINUX_GNU, CompileOptions{Entry: "main"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := ".text\n\t.globl _start\n\n_start:\n  call main\n  mov %rax, %rdi\n  mov $60, %eax\n  syscall\n\n\t.globl fact\n"
+	if !strings.HasPrefix(result, expected) {
+		t.Errorf("Expected a prefix of %q, got\n%s", expected, result)
+	}
+	m, _ = ParseModule(strings.NewReader(factorialModule))
+	if result, err = CompileModuleWithOptions(m, X64_LINUX_GNU, CompileOptions{Dialect: NasmDialect, Entry: "main"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(result, "section .text\n\tglobal _start\n\n_start:\n  call main\n  mov RDI, RAX\n  mov EAX, 60\n  syscall\n") {
+		t.Errorf("Expected a NASM _start, got\n%s", result)
+	}
+
+	m, _ = ParseModule(strings.NewReader(factorialModule))
+	if result, err = CompileModuleWithOptions(m, AARCH64_LINUX_GNU, CompileOptions{Entry: "main"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(result, ".text\n.global _start\n.type _start, %function\n.align 2\n\n_start:\n  bl main\n  mov X8, #93\n  svc #0\n\n.global fact\n") {
+		t.Errorf("Expected an arm64 _start, got\n%s", result)
+	}
+
+	m, _ = ParseModule(strings.NewReader(factorialModule))
+	if result, err = CompileModuleWithOptions(m, RISCV64_LINUX_MUSL, CompileOptions{Entry: "main"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(result, ".text\n.globl _start\n.type _start, @function\n.align 2\n\n_start:\n  call main\n  li a7, 93\n  ecall\n\n.globl fact\n") {
+		t.Errorf("Expected a RISC-V _start, got\n%s", result)
+	}
+
+	errorCases := []struct {
+		target string
+		entry  string
+		err    error
+	}{
+		{X64_WIN_GNU, "main", ErrUnknownTarget},
+		{AARCH64_MACOS_NONE, "main", ErrUnknownTarget},
+		{X64_LINUX_GNU, "start", ErrUnknownFunction},
+		{X64_LINUX_GNU, "fact", ErrInvalidOperand},
+	}
+	for _, c := range errorCases {
+		m, _ = ParseModule(strings.NewReader(factorialModule))
+		if _, err := CompileModuleWithOptions(m, c.target, CompileOptions{Entry: c.entry}); !errors.Is(err, c.err) {
+			t.Errorf("Expected %v for %s on %s, got %v", c.err, c.entry, c.target, err)
+		}
+	}
+
+	ir, err := ParseIR(strings.NewReader("%ret = mov 7\nret\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result, err = CompileWithOptions(ir, X64_LINUX_GNU, CompileOptions{Entry: "main"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(result, "_start:\n  call main\n") || !strings.Contains(result, "main:\n  mov $7, %rax\n  ret\n") {
+		t.Errorf("Expected _start and main, got\n%s", result)
+	}
+}
+
+func TestCallSpillsLiveRegisters(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	fact := m.Function("fact")
+	if err := lowerCalls(Architectures[AARCH64_MACOS_NONE], fact); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	allocateRegisters(Architectures[AARCH64_MACOS_NONE], fact)
+	// %v1 is needed after the recursive call, so must live on the stack
+	for _, instr := range fact.instructions {
+		if instr.op == mult && instr.arg1.registerType != stackRegister {
+			t.Errorf("Expected the multiplicand to be spilled, got %s", instr.Print())
+		}
+	}
+}
+
+const pointerModule = `.func id 1
+.registers 2
+  %ret = mov %v1
+  ret
+
+.func main 0
+.registers 4
+.constants 64, 42, 0, 8
+  %v1 = mov 64
+  %v2 = mov 42
+  store %v2, [%v1 + 0]
+  %v3 = call @id(%v2)
+  store %v3, [%v1 + 8]
+  %v2 = load [%v1 + 0]
+  %v3 = load [%v1 + 8]
+  %ret = add %v2, %v3
+  ret
+`
+
+func TestPointerLiveAcrossCall(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(pointerModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := InterpretModuleE(m, "main")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != 84 {
+		t.Errorf("Expected 84, got %d", result)
+	}
+	// %v1 is spilled across the call, so the store after it reloads the
+	// base and must keep its offset
+	for target, expected := range map[string]string{
+		AARCH64_MACOS_NONE: "  ldr X10, [SP, #0]\n  str X11, [X10, #8]\n",
+		X64_LINUX_GNU:      "  mov (%rsp), %r11\n  mov %r12, 8(%r11)\n",
+		RISCV64_LINUX_MUSL: "  ld t1, 0(sp)\n  sd t2, 8(t1)\n",
+	} {
+		m, err := ParseModule(strings.NewReader(pointerModule))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := InterpretModuleForArchitecture(m, target, "main", InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if result != 84 {
+			t.Errorf("Expected 84 for %s, got %d", target, result)
+		}
+		if xrn := CompileModule(m, target); !strings.Contains(xrn, expected) {
+			t.Errorf("Expected %q for %s in\n%s", expected, target, xrn)
+		}
+	}
+	for _, target := range []string{AARCH64_LINUX_GNU, X64_WIN_GNU} {
+		result, err := InterpretModuleForArchitecture(m, target, "main", InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if result != 84 {
+			t.Errorf("Expected 84 for %s, got %d", target, result)
+		}
+	}
+}
+
+func TestCompileModuleLabels(t *testing.T) {
+	text := `.func a 1
+.registers 2
+  br %v1, base
+  %ret = mov 1
+  ret
+base:
+  %ret = mov 2
+  ret
+
+.func main 0
+.registers 2
+  %v1 = call @a(%v1)
+  br %v1, base
+  %ret = mov 3
+  ret
+base:
+  ret
+`
+	m, err := ParseModule(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := CompileModuleE(m, AARCH64_MACOS_NONE)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Each function has its own base label
+	for _, expected := range []string{"La$base:\n", "Lmain$base:\n", ", La$base\n", ", Lmain$base\n"} {
+		if strings.Count(result, expected) != 1 {
+			t.Errorf("Expected %q once in\n%s", expected, result)
+		}
+	}
+}
+
+func TestCompileModuleForTwoTargets(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	before := m.Print()
+	for _, target := range []string{AARCH64_MACOS_NONE, AARCH64_LINUX_GNU} {
+		if _, err := CompileModuleE(m, target); err != nil {
+			t.Errorf("Unexpected error for %s: %s", target, err)
+		}
+	}
+	if m.Print() != before {
+		t.Errorf("Expected the module to be unchanged, got\n%s", m.Print())
+	}
+	fact := m.Function("fact")
+	for _, target := range []string{X64_LINUX_GNU, RISCV64_LINUX_MUSL} {
+		if _, err := CompileE(fact, target); err != nil {
+			t.Errorf("Unexpected error for %s: %s", target, err)
+		}
+	}
+}
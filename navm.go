@@ -1,16 +1,13 @@
 package navm
 
 import (
+	"fmt"
+	"math"
 	"strconv"
 )
 
-type Type int
-
-const (
-	noType Type = iota
-	i64    Type = iota
-)
-
+// Op values are part of the binary encoding, so new ops must only ever be
+// appended
 type Op int
 
 const (
@@ -23,8 +20,267 @@ const (
 	load  Op = iota
 	store Op = iota
 	ret   Op = iota
+	label Op = iota // marks the start of a basic block, arg2 is the label
+	jmp   Op = iota // unconditional jump to the label in arg2
+	br    Op = iota // jump to the label in arg2 if arg1 is non-zero
+	// Comparisons set ret to 1 if arg1 <op> arg2 holds, otherwise 0. lt, le,
+	// gt and ge are signed, the u-prefixed versions unsigned.
+	eq  Op = iota
+	ne  Op = iota
+	lt  Op = iota
+	le  Op = iota
+	gt  Op = iota
+	ge  Op = iota
+	ult Op = iota
+	ule Op = iota
+	ugt Op = iota
+	uge Op = iota
+	// Calls the function in arg2 with args, putting its return value in ret
+	call Op = iota
+	// Narrow loads, zero (u) or sign (s) extended to 64 bits, and narrow
+	// stores of the low bytes of arg1. load and store move 8 bytes.
+	load8u  Op = iota
+	load8s  Op = iota
+	load16u Op = iota
+	load16s Op = iota
+	load32u Op = iota
+	load32s Op = iota
+	store8  Op = iota
+	store16 Op = iota
+	store32 Op = iota
+	// Sign (sext) or zero (zext) extend the low bits of arg2 into the wider
+	// ret, or truncate arg2 into the narrower ret
+	sext8  Op = iota
+	sext16 Op = iota
+	sext32 Op = iota
+	zext8  Op = iota
+	zext16 Op = iota
+	zext32 Op = iota
+	trunc  Op = iota
+	// Float arithmetic, on two registers of the same float type
+	fadd Op = iota
+	fsub Op = iota
+	fmul Op = iota
+	fdiv Op = iota
+	// Float loads and stores, of 4 bytes for f32 and 8 for f64
+	fload32  Op = iota
+	fload64  Op = iota
+	fstore32 Op = iota
+	fstore64 Op = iota
+	// Conversions between floats and i64, and between float types. Float to
+	// integer conversions round towards zero.
+	sitof32  Op = iota
+	sitof64  Op = iota
+	f32tosi  Op = iota
+	f64tosi  Op = iota
+	f32tof64 Op = iota
+	f64tof32 Op = iota
+	// Bitwise operations. not and neg (two's complement negation) take a
+	// single register in arg2.
+	and Op = iota
+	or  Op = iota
+	xor Op = iota
+	not Op = iota
+	neg Op = iota
+	// Shift arg1 by arg2, which is taken modulo 64 for i64 and modulo 32 for
+	// narrower types. lshr shifts in zeros, ashr copies of the sign bit.
+	shl  Op = iota
+	lshr Op = iota
+	ashr Op = iota
+	// Unsigned division, and signed and unsigned remainders. Like div they
+	// round towards zero, and srem takes the sign of arg1. The most negative
+	// value divided by -1 wraps around to itself, with a remainder of 0.
+	udiv Op = iota
+	srem Op = iota
+	urem Op = iota
 )
 
+// Mnemonics used by the textual IR format, indexed by Op
+var opNames = []string{
+	noOp:     "",
+	add:      "add",
+	mov:      "mov",
+	sub:      "sub",
+	mult:     "mul",
+	div:      "div",
+	load:     "load",
+	store:    "store",
+	ret:      "ret",
+	label:    "label",
+	jmp:      "jmp",
+	br:       "br",
+	eq:       "eq",
+	ne:       "ne",
+	lt:       "lt",
+	le:       "le",
+	gt:       "gt",
+	ge:       "ge",
+	ult:      "ult",
+	ule:      "ule",
+	ugt:      "ugt",
+	uge:      "uge",
+	call:     "call",
+	load8u:   "load8u",
+	load8s:   "load8s",
+	load16u:  "load16u",
+	load16s:  "load16s",
+	load32u:  "load32u",
+	load32s:  "load32s",
+	store8:   "store8",
+	store16:  "store16",
+	store32:  "store32",
+	sext8:    "sext8",
+	sext16:   "sext16",
+	sext32:   "sext32",
+	zext8:    "zext8",
+	zext16:   "zext16",
+	zext32:   "zext32",
+	trunc:    "trunc",
+	fadd:     "fadd",
+	fsub:     "fsub",
+	fmul:     "fmul",
+	fdiv:     "fdiv",
+	fload32:  "fload32",
+	fload64:  "fload64",
+	fstore32: "fstore32",
+	fstore64: "fstore64",
+	sitof32:  "sitof32",
+	sitof64:  "sitof64",
+	f32tosi:  "f32tosi",
+	f64tosi:  "f64tosi",
+	f32tof64: "f32tof64",
+	f64tof32: "f64tof32",
+	and:      "and",
+	or:       "or",
+	xor:      "xor",
+	not:      "not",
+	neg:      "neg",
+	shl:      "shl",
+	lshr:     "lshr",
+	ashr:     "ashr",
+	udiv:     "udiv",
+	srem:     "srem",
+	urem:     "urem",
+}
+
+// The number of bytes a load or store accesses, and whether a load sign
+// extends. Other ops access 0 bytes.
+func (op Op) memoryAccess() (size int, signed bool) {
+	switch op {
+	case load, store:
+		return 8, false
+	case load8u, store8:
+		return 1, false
+	case load8s:
+		return 1, true
+	case load16u, store16:
+		return 2, false
+	case load16s:
+		return 2, true
+	case load32u, store32, fload32, fstore32:
+		return 4, false
+	case load32s:
+		return 4, true
+	case fload64, fstore64:
+		return 8, false
+	default:
+		return 0, false
+	}
+}
+
+func (op Op) isComparison() bool {
+	return op >= eq && op <= uge
+}
+
+func (op Op) isConversion() bool {
+	return op >= sext8 && op <= trunc
+}
+
+func (op Op) isDivision() bool {
+	return op == div || op == udiv || op == srem || op == urem
+}
+
+func (op Op) isUnary() bool {
+	return op == not || op == neg
+}
+
+func (op Op) isShift() bool {
+	return op >= shl && op <= ashr
+}
+
+func (op Op) isFloatArithmetic() bool {
+	return op >= fadd && op <= fdiv
+}
+
+// Binary ops that two-address targets compute in place, overwriting arg1
+func (op Op) isTwoAddress() bool {
+	switch op {
+	case add, sub, mult, and, or, xor, shl, lshr, ashr, fadd, fsub, fmul, fdiv:
+		return true
+	default:
+		return false
+	}
+}
+
+// The types a float conversion reads from arg2 and writes to ret
+func (op Op) floatConversion() (from Type, to Type, ok bool) {
+	switch op {
+	case sitof32:
+		return I64, F32, true
+	case sitof64:
+		return I64, F64, true
+	case f32tosi:
+		return F32, I64, true
+	case f64tosi:
+		return F64, I64, true
+	case f32tof64:
+		return F32, F64, true
+	case f64tof32:
+		return F64, F32, true
+	default:
+		return noType, noType, false
+	}
+}
+
+// The float type a float load or store moves, or noType
+func (op Op) floatAccess() Type {
+	switch op {
+	case fload32, fstore32:
+		return F32
+	case fload64, fstore64:
+		return F64
+	default:
+		return noType
+	}
+}
+
+// Whether the op works on float operands, rather than only integers
+func (op Op) takesFloats() bool {
+	_, _, conversion := op.floatConversion()
+	return op.isFloatArithmetic() || conversion || op.floatAccess() != noType
+}
+
+// The number of bytes an extension reads from arg2, or 0 for other ops
+func (op Op) conversionSize() int {
+	switch op {
+	case sext8, zext8:
+		return 1
+	case sext16, zext16:
+		return 2
+	case sext32, zext32:
+		return 4
+	default:
+		return 0
+	}
+}
+
+func (op Op) String() string {
+	if op < 0 || int(op) >= len(opNames) || opNames[op] == "" {
+		return "op" + strconv.Itoa(int(op))
+	}
+	return opNames[op]
+}
+
 // Add concept of virtual vs physical registers
 
 type RegisterType int
@@ -48,6 +304,10 @@ func (r Register) Value() int {
 const STACK_POINTER_REGISTER = -1
 const RETURN_REGISTER = -2
 
+// Argument register i of the target calling convention is
+// ARGUMENT_REGISTER_0 - i. They only appear once calls are lowered.
+const ARGUMENT_REGISTER_0 = -3
+
 // 0 register is not used, will indicate "no register"
 // 1 register will indicate the return value
 
@@ -59,6 +319,8 @@ const (
 	constant    ArgType = iota
 	address     ArgType = iota
 	stackArg    ArgType = iota
+	labelArg    ArgType = iota
+	functionArg ArgType = iota // index into IR.functions
 )
 
 // Basically a union
@@ -67,25 +329,103 @@ type Arg struct {
 	isVirtualRegister bool
 	value             int
 	offsetConstant    int
+	// An address whose base register is spilled, so value is its stack
+	// position until addSpillInstructions reloads it
+	spilledBase bool
 }
 
 type Instruction struct {
-	op   Op
-	ret  Register
-	arg1 Register
-	arg2 Arg
+	op    Op
+	typ   Type // set before allocation for narrow instructions, see annotateTypes
+	ret   Register
+	arg1  Register
+	arg2  Arg
+	args  []Register // only used by call
+	traps TrapPolicy // only used by divisions, overrides IR.traps
 }
 
+// A single function. Its parameters are the virtual registers 1 to
+// paramCount.
 type IR struct {
-	registersLength int // maximum register number + 1
+	name            string // defaults to main
+	paramCount      int
+	registersLength int    // maximum register number + 1
+	types           []Type // indexed by virtual register, missing entries are I64
 	instructions    []Instruction
 	constants       []int
+	labels          []string // label names, indexed by label number
+	functions       []string // names of called functions, indexed by functionArg
+	traps           TrapPolicy
+}
+
+// A jump target. Create with IR.NewLabel and place with IR.Label.
+type Label struct {
+	value int
 }
 
 func NewIR() *IR {
 	return &IR{registersLength: 1}
 }
 
+// Creates a function taking params arguments, which are available in the
+// registers returned by Parameter
+func NewFunction(name string, params int) *IR {
+	return &IR{name: name, paramCount: params, registersLength: params + 1}
+}
+
+// A deep copy, so passes that rewrite instructions leave the original alone
+func (ir *IR) Copy() *IR {
+	c := *ir
+	c.instructions = make([]Instruction, len(ir.instructions))
+	for idx, instr := range ir.instructions {
+		if instr.args != nil {
+			instr.args = append([]Register(nil), instr.args...)
+		}
+		c.instructions[idx] = instr
+	}
+	c.types = append([]Type(nil), ir.types...)
+	c.constants = append([]int(nil), ir.constants...)
+	c.labels = append([]string(nil), ir.labels...)
+	c.functions = append([]string(nil), ir.functions...)
+	return &c
+}
+
+func (ir *IR) Name() string {
+	if ir.name == "" {
+		return "main"
+	}
+	return ir.name
+}
+
+func (ir *IR) ParamCount() int {
+	return ir.paramCount
+}
+
+// The register holding parameter i, counting from 0
+func (ir *IR) Parameter(i int) Register {
+	if i < 0 || i >= ir.paramCount {
+		panic("Parameter " + strconv.Itoa(i) + " out of range")
+	}
+	return MakeVirtualRegister(i + 1)
+}
+
+func (ir *IR) getFunction(name string) int {
+	for idx, f := range ir.functions {
+		if f == name {
+			return idx
+		}
+	}
+	ir.functions = append(ir.functions, name)
+	return len(ir.functions) - 1
+}
+
+// Calls the named function, putting its return value in ret. As on hardware
+// the return register is overwritten by the call as well.
+func (ir *IR) Call(ret Register, name string, args ...Register) {
+	xrn := Instruction{op: call, ret: ret, arg2: Arg{argType: functionArg, value: ir.getFunction(name)}, args: args}
+	ir.instructions = append(ir.instructions, xrn)
+}
+
 func (ir *IR) GetConstant(c int) int {
 	for idx, i := range ir.constants {
 		if i == c {
@@ -133,20 +473,323 @@ func (ir *IR) DivRegisters(ret Register, r1 Register, r2 Register) {
 	ir.instructions = append(ir.instructions, xrn)
 }
 
-func (ir *IR) Load(ret Register, addr Arg) {
+func (ir *IR) binaryRegisters(op Op, ret Register, r1 Register, r2 Register) {
+	xrn := Instruction{op: op, ret: ret, arg1: r1, arg2: r2.ToArg()}
+	ir.instructions = append(ir.instructions, xrn)
+}
+
+func (ir *IR) AndRegisters(ret Register, r1 Register, r2 Register) {
+	ir.binaryRegisters(and, ret, r1, r2)
+}
+
+func (ir *IR) OrRegisters(ret Register, r1 Register, r2 Register) {
+	ir.binaryRegisters(or, ret, r1, r2)
+}
+
+func (ir *IR) XorRegisters(ret Register, r1 Register, r2 Register) {
+	ir.binaryRegisters(xor, ret, r1, r2)
+}
+
+// Shifts r1 left by r2
+func (ir *IR) ShlRegisters(ret Register, r1 Register, r2 Register) {
+	ir.binaryRegisters(shl, ret, r1, r2)
+}
+
+// Shifts r1 right by r2, shifting in zeros
+func (ir *IR) LshrRegisters(ret Register, r1 Register, r2 Register) {
+	ir.binaryRegisters(lshr, ret, r1, r2)
+}
+
+// Shifts r1 right by r2, shifting in copies of the sign bit
+func (ir *IR) AshrRegisters(ret Register, r1 Register, r2 Register) {
+	ir.binaryRegisters(ashr, ret, r1, r2)
+}
+
+func (ir *IR) Not(ret Register, r Register) {
+	xrn := Instruction{op: not, ret: ret, arg2: r.ToArg()}
+	ir.instructions = append(ir.instructions, xrn)
+}
+
+func (ir *IR) Neg(ret Register, r Register) {
+	xrn := Instruction{op: neg, ret: ret, arg2: r.ToArg()}
+	ir.instructions = append(ir.instructions, xrn)
+}
+
+// Divides r1 by r2 as unsigned numbers
+func (ir *IR) UdivRegisters(ret Register, r1 Register, r2 Register) {
+	ir.binaryRegisters(udiv, ret, r1, r2)
+}
+
+// The remainder of r1 / r2, with the sign of r1
+func (ir *IR) SremRegisters(ret Register, r1 Register, r2 Register) {
+	ir.binaryRegisters(srem, ret, r1, r2)
+}
+
+// The remainder of r1 / r2 as unsigned numbers
+func (ir *IR) UremRegisters(ret Register, r1 Register, r2 Register) {
+	ir.binaryRegisters(urem, ret, r1, r2)
+}
+
+func (ir *IR) floatRegisters(op Op, ret Register, r1 Register, r2 Register) {
+	xrn := Instruction{op: op, ret: ret, arg1: r1, arg2: r2.ToArg()}
+	ir.instructions = append(ir.instructions, xrn)
+}
+
+func (ir *IR) FAddRegisters(ret Register, r1 Register, r2 Register) {
+	ir.floatRegisters(fadd, ret, r1, r2)
+}
+
+func (ir *IR) FSubRegisters(ret Register, r1 Register, r2 Register) {
+	ir.floatRegisters(fsub, ret, r1, r2)
+}
+
+func (ir *IR) FMultRegisters(ret Register, r1 Register, r2 Register) {
+	ir.floatRegisters(fmul, ret, r1, r2)
+}
+
+func (ir *IR) FDivRegisters(ret Register, r1 Register, r2 Register) {
+	ir.floatRegisters(fdiv, ret, r1, r2)
+}
+
+// Sets the float register r to f, rounded to r's type. Returns
+// ErrInvalidOperand if r is not a float.
+func (ir *IR) MoveFloat(r Register, f float64) error {
+	switch ir.TypeOf(r) {
+	case F32:
+		ir.MoveConstant(r, int(math.Float32bits(float32(f))))
+	case F64:
+		ir.MoveConstant(r, int(math.Float64bits(f)))
+	default:
+		return fmt.Errorf("%w: float constant moved to %s", ErrInvalidOperand, ir.TypeOf(r))
+	}
+	return nil
+}
+
+func (ir *IR) compareRegisters(op Op, ret Register, r1 Register, r2 Register) {
+	xrn := Instruction{op: op, ret: ret, arg1: r1, arg2: Arg{
+		argType:           registerArg,
+		isVirtualRegister: true,
+		value:             r2.value}}
+	ir.instructions = append(ir.instructions, xrn)
+}
+
+// Sets ret to 1 if r1 == r2, otherwise 0
+func (ir *IR) EqRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(eq, ret, r1, r2)
+}
+
+// Sets ret to 1 if r1 != r2, otherwise 0
+func (ir *IR) NeRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(ne, ret, r1, r2)
+}
+
+// Sets ret to 1 if r1 < r2 as signed integers, otherwise 0
+func (ir *IR) LtRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(lt, ret, r1, r2)
+}
+
+// Sets ret to 1 if r1 <= r2 as signed integers, otherwise 0
+func (ir *IR) LeRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(le, ret, r1, r2)
+}
+
+// Sets ret to 1 if r1 > r2 as signed integers, otherwise 0
+func (ir *IR) GtRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(gt, ret, r1, r2)
+}
+
+// Sets ret to 1 if r1 >= r2 as signed integers, otherwise 0
+func (ir *IR) GeRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(ge, ret, r1, r2)
+}
+
+// Sets ret to 1 if r1 < r2 as unsigned integers, otherwise 0
+func (ir *IR) UltRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(ult, ret, r1, r2)
+}
+
+// Sets ret to 1 if r1 <= r2 as unsigned integers, otherwise 0
+func (ir *IR) UleRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(ule, ret, r1, r2)
+}
+
+// Sets ret to 1 if r1 > r2 as unsigned integers, otherwise 0
+func (ir *IR) UgtRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(ugt, ret, r1, r2)
+}
+
+// Sets ret to 1 if r1 >= r2 as unsigned integers, otherwise 0
+func (ir *IR) UgeRegisters(ret Register, r1 Register, r2 Register) {
+	ir.compareRegisters(uge, ret, r1, r2)
+}
+
+// Loads 8 bytes from addr into ret. Returns ErrInvalidOperand if addr is not
+// an address.
+func (ir *IR) Load(ret Register, addr Arg) error {
 	if addr.argType != address {
-		panic("Argument addr must be an address")
+		return fmt.Errorf("%w: load from non-address argument", ErrInvalidOperand)
 	}
 	xrn := Instruction{op: load, ret: ret, arg2: addr}
 	ir.instructions = append(ir.instructions, xrn)
+	return nil
+}
+
+// Loads size bytes (1, 2, 4 or 8) from addr into ret, sign extending them if
+// signed is set and zero extending them otherwise
+func (ir *IR) LoadSized(ret Register, addr Arg, size int, signed bool) error {
+	var op Op
+	switch {
+	case size == 1 && signed:
+		op = load8s
+	case size == 1:
+		op = load8u
+	case size == 2 && signed:
+		op = load16s
+	case size == 2:
+		op = load16u
+	case size == 4 && signed:
+		op = load32s
+	case size == 4:
+		op = load32u
+	case size == 8:
+		op = load
+	default:
+		return fmt.Errorf("%w: load of %d bytes", ErrInvalidOperand, size)
+	}
+	if addr.argType != address {
+		return fmt.Errorf("%w: load from non-address argument", ErrInvalidOperand)
+	}
+	xrn := Instruction{op: op, ret: ret, arg2: addr}
+	ir.instructions = append(ir.instructions, xrn)
+	return nil
+}
+
+// Loads the float register ret from addr, 4 bytes for an f32 and 8 for an f64
+func (ir *IR) LoadFloat(ret Register, addr Arg) error {
+	op := fload64
+	switch ir.TypeOf(ret) {
+	case F32:
+		op = fload32
+	case F64:
+	default:
+		return fmt.Errorf("%w: float load into %s", ErrInvalidOperand, ir.TypeOf(ret))
+	}
+	if addr.argType != address {
+		return fmt.Errorf("%w: load from non-address argument", ErrInvalidOperand)
+	}
+	xrn := Instruction{op: op, ret: ret, arg2: addr}
+	ir.instructions = append(ir.instructions, xrn)
+	return nil
+}
+
+// Stores the float register reg at addr
+func (ir *IR) StoreFloat(reg Register, addr Arg) error {
+	op := fstore64
+	switch ir.TypeOf(reg) {
+	case F32:
+		op = fstore32
+	case F64:
+	default:
+		return fmt.Errorf("%w: float store from %s", ErrInvalidOperand, ir.TypeOf(reg))
+	}
+	if addr.argType != address {
+		return fmt.Errorf("%w: store to non-address argument", ErrInvalidOperand)
+	}
+	xrn := Instruction{op: op, arg1: reg, arg2: addr}
+	ir.instructions = append(ir.instructions, xrn)
+	return nil
+}
+
+// Stores reg as 8 bytes at addr. Returns ErrInvalidOperand if addr is not an
+// address.
+func (ir *IR) Store(reg Register, addr Arg) error {
+	if addr.argType != address {
+		return fmt.Errorf("%w: store to non-address argument", ErrInvalidOperand)
+	}
+	xrn := Instruction{op: store, arg1: reg, arg2: addr}
+	ir.instructions = append(ir.instructions, xrn)
+	return nil
 }
 
-func (ir *IR) Store(reg Register, addr Arg) {
+// Stores the low size bytes (1, 2, 4 or 8) of reg at addr
+func (ir *IR) StoreSized(reg Register, addr Arg, size int) error {
+	var op Op
+	switch size {
+	case 1:
+		op = store8
+	case 2:
+		op = store16
+	case 4:
+		op = store32
+	case 8:
+		op = store
+	default:
+		return fmt.Errorf("%w: store of %d bytes", ErrInvalidOperand, size)
+	}
 	if addr.argType != address {
-		panic("Argument addr must be an address")
+		return fmt.Errorf("%w: store to non-address argument", ErrInvalidOperand)
 	}
-	xrn := Instruction{op: store, ret: reg, arg2: addr}
+	xrn := Instruction{op: op, arg1: reg, arg2: addr}
 	ir.instructions = append(ir.instructions, xrn)
+	return nil
+}
+
+// Sign extends r into ret, which must be wider. Returns ErrInvalidOperand if
+// r is already 64 bits.
+func (ir *IR) SignExtend(ret Register, r Register) error {
+	return ir.extend([]Op{sext8, sext16, sext32}, ret, r)
+}
+
+// Zero extends r into ret, which must be wider. Returns ErrInvalidOperand if
+// r is already 64 bits.
+func (ir *IR) ZeroExtend(ret Register, r Register) error {
+	return ir.extend([]Op{zext8, zext16, zext32}, ret, r)
+}
+
+// ops are the 8, 16 and 32 bit extensions
+func (ir *IR) extend(ops []Op, ret Register, r Register) error {
+	var op Op
+	switch ir.TypeOf(r) {
+	case I8:
+		op = ops[0]
+	case I16:
+		op = ops[1]
+	case I32:
+		op = ops[2]
+	default:
+		return fmt.Errorf("%w: cannot extend %s", ErrInvalidOperand, ir.TypeOf(r))
+	}
+	if ir.TypeOf(ret).Size() <= ir.TypeOf(r).Size() {
+		return fmt.Errorf("%w: cannot extend %s to %s", ErrInvalidOperand, ir.TypeOf(r), ir.TypeOf(ret))
+	}
+	xrn := Instruction{op: op, ret: ret, arg2: r.ToArg()}
+	ir.instructions = append(ir.instructions, xrn)
+	return nil
+}
+
+// Keeps the low bits of r that fit in ret, which must be narrower
+func (ir *IR) Truncate(ret Register, r Register) error {
+	if ir.TypeOf(ret).Size() >= ir.TypeOf(r).Size() {
+		return fmt.Errorf("%w: cannot truncate %s to %s", ErrInvalidOperand, ir.TypeOf(r), ir.TypeOf(ret))
+	}
+	xrn := Instruction{op: trunc, ret: ret, arg2: r.ToArg()}
+	ir.instructions = append(ir.instructions, xrn)
+	return nil
+}
+
+// Converts between floats and i64, or between float types, choosing the op
+// from the types of ret and r. Float to integer conversions round towards
+// zero.
+func (ir *IR) ConvertFloat(ret Register, r Register) error {
+	from, to := ir.TypeOf(r), ir.TypeOf(ret)
+	for _, op := range []Op{sitof32, sitof64, f32tosi, f64tosi, f32tof64, f64tof32} {
+		if f, t, _ := op.floatConversion(); f == from && t == to {
+			xrn := Instruction{op: op, ret: ret, arg2: r.ToArg()}
+			ir.instructions = append(ir.instructions, xrn)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: cannot convert %s to %s", ErrInvalidOperand, from, to)
 }
 
 func (ir *IR) Return() {
@@ -154,6 +797,33 @@ func (ir *IR) Return() {
 	ir.instructions = append(ir.instructions, xrn)
 }
 
+func (ir *IR) NewLabel() Label {
+	l := Label{value: len(ir.labels)}
+	ir.labels = append(ir.labels, "L"+strconv.Itoa(l.value))
+	return l
+}
+
+// Places the label at the current position, starting a new basic block
+func (ir *IR) Label(l Label) {
+	xrn := Instruction{op: label, arg2: l.ToArg()}
+	ir.instructions = append(ir.instructions, xrn)
+}
+
+func (ir *IR) Jump(l Label) {
+	xrn := Instruction{op: jmp, arg2: l.ToArg()}
+	ir.instructions = append(ir.instructions, xrn)
+}
+
+// Jumps to l if cond is non-zero, otherwise falls through
+func (ir *IR) Branch(cond Register, l Label) {
+	xrn := Instruction{op: br, arg1: cond, arg2: l.ToArg()}
+	ir.instructions = append(ir.instructions, xrn)
+}
+
+func (l Label) ToArg() Arg {
+	return Arg{argType: labelArg, value: l.value}
+}
+
 func (ir *IR) AddInstruction(xrn Instruction) {
 	ir.instructions = append(ir.instructions, xrn)
 }
@@ -164,6 +834,34 @@ func (ir *IR) NewVirtualRegister() Register {
 	return ret
 }
 
+func (ir *IR) NewTypedRegister(t Type) Register {
+	r := ir.NewVirtualRegister()
+	ir.SetType(r, t)
+	return r
+}
+
+// Sets the type of a virtual register, such as a parameter
+func (ir *IR) SetType(r Register, t Type) {
+	if r.registerType != virtualRegister || r.value <= 0 || r.value >= ir.registersLength {
+		panic("Only virtual registers have types")
+	}
+	if !t.valid() || t == noType {
+		panic("Unknown type: " + strconv.Itoa(int(t)))
+	}
+	for len(ir.types) <= r.value {
+		ir.types = append(ir.types, noType)
+	}
+	ir.types[r.value] = t
+}
+
+// The type of a register. Everything except typed virtual registers is I64.
+func (ir *IR) TypeOf(r Register) Type {
+	if r.registerType == virtualRegister && r.value > 0 && r.value < len(ir.types) && ir.types[r.value] != noType {
+		return ir.types[r.value]
+	}
+	return I64
+}
+
 func MakeVirtualRegister(value int) Register {
 	return Register{registerType: virtualRegister, value: value}
 }
@@ -176,6 +874,11 @@ func GetStackPointer() Register {
 	return Register{registerType: physicalRegister, value: STACK_POINTER_REGISTER}
 }
 
+// Argument register i of the target calling convention
+func GetArgumentRegister(i int) Register {
+	return Register{registerType: physicalRegister, value: ARGUMENT_REGISTER_0 - i}
+}
+
 func GetReturnRegister() Register {
 	return Register{registerType: virtualRegister, value: RETURN_REGISTER}
 }
@@ -192,19 +895,18 @@ func MakeConstant(value int) Arg {
 	return Arg{argType: constant, value: value}
 }
 
+// Prints the IR in the textual format understood by ParseIR
 func (ir *IR) Print() string {
-	ret := ""
-	for _, i := range ir.instructions {
-		ret += i.Print() + "\n"
-	}
-	// Add constants
-	ret += "Constants: "
-	for _, c := range ir.constants {
-		ret += strconv.Itoa(c) + " "
-	}
-	return ret
+	return printIR(ir, false)
+}
+
+// Prints the instruction at index, resolving constants against the IR
+func (ir *IR) PrintInstruction(index int) string {
+	return printInstruction(ir.instructions[index], ir)
 }
 
+// Prints a single instruction. Without an IR to resolve them against,
+// constants are printed as constant pool references, e.g. #0
 func (i *Instruction) Print() string {
-	return strconv.Itoa(int(i.op)) + " " + strconv.Itoa(i.ret.value) + " " + strconv.Itoa(i.arg1.value) + " " + strconv.Itoa(i.arg2.value)
+	return printInstruction(*i, nil)
 }
@@ -0,0 +1,595 @@
+package navm
+
+import (
+	"math/bits"
+	"strconv"
+)
+
+// Writes RV64IMFD for Linux
+type RiscvGenerator struct {
+	arch      *Architecture
+	ir        *IR
+	divisions int // checked so far, numbering their labels
+}
+
+func (g *RiscvGenerator) Init(a *Architecture, ir *IR) {
+	g.arch = a
+	g.ir = ir
+}
+
+// Left out of the allocator's registers, so free to hold temporaries within
+// an instruction. Argument registers would not do, since reloading a spilled
+// argument can need a temporary after earlier arguments are in place.
+const riscv64Temporary0 = "t5"
+const riscv64Temporary1 = "t6"
+
+func (g *RiscvGenerator) GetFileHeader() string {
+	return ".text\n"
+}
+
+// Exports and starts the symbol name
+func (g *RiscvGenerator) getGlobal(name string) string {
+	return ".globl " + name + "\n.type " + name + ", @function\n.align 2\n\n" + name + ":\n"
+}
+
+// Saves the s registers the function uses and, if it makes calls, ra, which
+// call overwrites, in a frame that keeps sp 16 byte aligned
+func (g *RiscvGenerator) GetHeader() string {
+	header := g.getGlobal(g.ir.Name())
+	saved := g.GetSavedRegisters()
+	if len(saved) == 0 {
+		return header
+	}
+	header += "  addi sp, sp, -" + strconv.Itoa(g.getFrameSize()) + "\n"
+	for i, r := range saved {
+		header += "  sd " + r + ", " + strconv.Itoa(8*i) + "(sp)\n"
+	}
+	return header
+}
+
+// Restores the callee-saved registers and frees their frame. The result is
+// already in a0.
+func (g *RiscvGenerator) GetReturn() string {
+	ret := ""
+	saved := g.GetSavedRegisters()
+	for i, r := range saved {
+		ret += "  ld " + r + ", " + strconv.Itoa(8*i) + "(sp)\n"
+	}
+	if len(saved) > 0 {
+		ret += "  addi sp, sp, " + strconv.Itoa(g.getFrameSize()) + "\n"
+	}
+	return ret + "  ret\n"
+}
+
+// The callee-saved registers used by the function, then ra if it makes calls
+func (g *RiscvGenerator) GetSavedRegisters() []string {
+	used := usedPhysicalRegisters(g.arch, g.ir)
+	saved := []string{}
+	for _, r := range g.arch.CalleeSavedRegisters {
+		for _, u := range used {
+			if u == r {
+				saved = append(saved, r)
+			}
+		}
+	}
+	if hasCalls(g.ir) {
+		saved = append(saved, "ra")
+	}
+	return saved
+}
+
+func (g *RiscvGenerator) getFrameSize() int {
+	size := 8 * len(g.GetSavedRegisters())
+	return (size + g.arch.StackAlignmentSize - 1) / g.arch.StackAlignmentSize * g.arch.StackAlignmentSize
+}
+
+// Linux takes the system call number in a7 and the exit status in a0, where
+// entry returns it
+func (g *RiscvGenerator) GetStart(entry string) string {
+	return g.getGlobal("_start") +
+		"  call " + entry + "\n" +
+		"  li a7, " + strconv.Itoa(g.arch.ExitSyscall) + "\n" +
+		"  ecall\n\n"
+}
+
+func (g *RiscvGenerator) GetCall(instr Instruction) string {
+	return "  call " + g.ir.functions[instr.arg2.value] + "\n"
+}
+
+// mv between integer registers, fmv between float registers, and fmv.d.x or
+// fmv.w.x for the bits of an integer register. Constants are wrapped to the
+// type, which keeps narrow values sign extended.
+func (g *RiscvGenerator) GetTwoArgInstruction(op GenOp, instr Instruction) string {
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	if op == loadGenOp {
+		setup, addr := g.getAddress(instr.arg2)
+		return setup + "  ld " + retRegister + ", " + addr + "\n"
+	}
+	if instr.arg2.argType == constant {
+		return riscv64LoadImmediate(retRegister, instr.typ.wrap(g.ir.constants[instr.arg2.value]))
+	}
+	arg2 := g.arch.GetPhysicalRegister(instr.arg2.value)
+	switch {
+	case !instr.typ.IsFloat():
+		return "  mv " + retRegister + ", " + arg2 + "\n"
+	case g.arch.isFloatRegister(instr.arg2.value):
+		return "  fmv" + riscv64FloatSuffix(instr.typ) + " " + retRegister + ", " + arg2 + "\n"
+	case instr.typ == F32:
+		return "  fmv.w.x " + retRegister + ", " + arg2 + "\n"
+	default:
+		return "  fmv.d.x " + retRegister + ", " + arg2 + "\n"
+	}
+}
+
+func (g *RiscvGenerator) GetTwoArgNoRetInstruction(op GenOp, instr Instruction) string {
+	name := g.GetTargetInstruction(op)
+	setup, addr := g.getAddress(instr.arg2)
+	return setup + "  " + name + " " + g.arch.GetPhysicalRegister(instr.arg1.value) + ", " + addr + "\n"
+}
+
+// Constants that fit in 12 bits use the immediate form of the instruction,
+// and larger ones are loaded into a temporary. i32 operations use the W
+// forms, which sign extend their 32 bit result.
+func (g *RiscvGenerator) GetInstruction(op GenOp, instr Instruction) string {
+	name := g.GetTargetInstruction(op)
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	arg1 := g.arch.GetPhysicalRegister(instr.arg1.value)
+	xrn := ""
+	var arg2 string
+	if instr.arg2.argType == constant {
+		c := g.ir.constants[instr.arg2.value]
+		if op == subGenOp {
+			name, c = "add", -c
+		}
+		if riscv64FitsImmediate(c) {
+			name += "i"
+			arg2 = strconv.Itoa(c)
+		} else {
+			xrn += riscv64LoadImmediate(riscv64Temporary1, c)
+			arg2 = riscv64Temporary1
+		}
+	} else {
+		arg2 = g.arch.GetPhysicalRegister(instr.arg2.value)
+	}
+	xrn += "  " + name + g.getWordSuffix(op, instr.typ) + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n"
+	return xrn + g.narrow(instr)
+}
+
+// The W forms work on the low 32 bits. Arithmetic on i8 and i16 is done at
+// 64 bits and narrowed, but shifts use the W forms for all narrow types, so
+// that a count in a register is taken modulo 32.
+func (g *RiscvGenerator) getWordSuffix(op GenOp, t Type) string {
+	switch op {
+	case andGenOp, orGenOp, xorGenOp:
+		return ""
+	case shlGenOp, lshrGenOp, ashrGenOp:
+		if t.Size() <= 4 {
+			return "w"
+		}
+		return ""
+	default:
+		if t == I32 {
+			return "w"
+		}
+		return ""
+	}
+}
+
+// i8 and i16 values are sign extended, so a logical right shift first zero
+// extends into a temporary
+func (g *RiscvGenerator) GetShiftInstruction(op GenOp, instr Instruction) string {
+	if op != lshrGenOp || (instr.typ != I8 && instr.typ != I16) {
+		return g.GetInstruction(op, instr)
+	}
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	arg1 := g.arch.GetPhysicalRegister(instr.arg1.value)
+	xrn := riscv64ZeroExtend(riscv64Temporary0, arg1, instr.typ.Size())
+	if instr.arg2.argType == constant {
+		xrn += "  srli " + retRegister + ", " + riscv64Temporary0 + ", " + strconv.Itoa(g.ir.constants[instr.arg2.value]) + "\n"
+	} else {
+		xrn += "  srlw " + retRegister + ", " + riscv64Temporary0 + ", " + g.arch.GetPhysicalRegister(instr.arg2.value) + "\n"
+	}
+	return xrn + g.narrow(instr)
+}
+
+// div, divu, rem and remu give -1 for a zero divisor and the dividend as the
+// remainder, and wrap on overflow with a remainder of 0. So WrapFaults only
+// has to branch around div and divu to give 0, while TrapFaults ebreaks on a
+// zero divisor and, for div, on overflow. Unsigned division of i8 and i16
+// first zero extends its sign extended operands into the temporaries.
+func (g *RiscvGenerator) GetDivision(op GenOp, instr Instruction) string {
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	arg1 := g.arch.GetPhysicalRegister(instr.arg1.value)
+	arg2 := g.arch.GetPhysicalRegister(instr.arg2.value)
+	var name string
+	switch op {
+	case divGenOp:
+		name = "div"
+	case udivGenOp:
+		name = "divu"
+	case sremGenOp:
+		name = "rem"
+	case uremGenOp:
+		name = "remu"
+	}
+	name += g.getWordSuffix(op, instr.typ)
+	xrn := g.getDivisionCheck(op, instr, arg1, arg2)
+	zero := ""
+	if instr.traps == WrapFaults && (op == divGenOp || op == udivGenOp) {
+		g.divisions++
+		zero = g.getDivisionLabel("zero")
+		xrn += "  beqz " + arg2 + ", " + zero + "\n"
+	}
+	if (op == udivGenOp || op == uremGenOp) && (instr.typ == I8 || instr.typ == I16) {
+		xrn += riscv64ZeroExtend(riscv64Temporary0, arg1, instr.typ.Size())
+		xrn += riscv64ZeroExtend(riscv64Temporary1, arg2, instr.typ.Size())
+		arg1, arg2 = riscv64Temporary0, riscv64Temporary1
+	}
+	xrn += "  " + name + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n" + g.narrow(instr)
+	if zero != "" {
+		done := g.getDivisionLabel("div")
+		xrn += "  j " + done + "\n" + zero + ":\n  li " + retRegister + ", 0\n" + done + ":\n"
+	}
+	return xrn
+}
+
+// Branches to an ebreak for a zero divisor and, for signed division, when
+// arg2 is -1 and arg1 the type's minimum
+func (g *RiscvGenerator) getDivisionCheck(op GenOp, instr Instruction, arg1 string, arg2 string) string {
+	if instr.traps != TrapFaults {
+		return ""
+	}
+	g.divisions++
+	done := g.getDivisionLabel("div")
+	if op != divGenOp {
+		return "  bnez " + arg2 + ", " + done + "\n  ebreak\n" + done + ":\n"
+	}
+	trap := g.getDivisionLabel("trap")
+	return "  beqz " + arg2 + ", " + trap + "\n" +
+		"  li " + riscv64Temporary1 + ", -1\n" +
+		"  bne " + arg2 + ", " + riscv64Temporary1 + ", " + done + "\n" +
+		riscv64LoadImmediate(riscv64Temporary1, instr.typ.minimum()) +
+		"  bne " + arg1 + ", " + riscv64Temporary1 + ", " + done + "\n" +
+		trap + ":\n  ebreak\n" + done + ":\n"
+}
+
+// Local to the object file, and numbered by the division being checked
+func (g *RiscvGenerator) getDivisionLabel(kind string) string {
+	return ".L" + g.ir.Name() + "$" + kind + "$" + strconv.Itoa(g.divisions)
+}
+
+// not and neg
+func (g *RiscvGenerator) GetUnaryInstruction(op GenOp, instr Instruction) string {
+	name := g.GetTargetInstruction(op) + g.getWordSuffix(op, instr.typ)
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	arg2 := g.arch.GetPhysicalRegister(instr.arg2.value)
+	return "  " + name + " " + retRegister + ", " + arg2 + "\n" + g.narrow(instr)
+}
+
+// There are no 8 or 16 bit operations, so i8 and i16 values are kept sign
+// extended to 64 bits, like i32 values. Operations that may leave other bits
+// set re-extend their result.
+func (g *RiscvGenerator) narrow(instr Instruction) string {
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	switch instr.typ {
+	case I8, I16:
+		return riscv64SignExtend(retRegister, retRegister, instr.typ.Size())
+	default:
+		return ""
+	}
+}
+
+// Sign extends the low size bytes of from into to
+func riscv64SignExtend(to string, from string, size int) string {
+	if size == 4 {
+		return "  sext.w " + to + ", " + from + "\n"
+	}
+	shift := strconv.Itoa(64 - 8*size)
+	return "  slli " + to + ", " + from + ", " + shift + "\n  srai " + to + ", " + to + ", " + shift + "\n"
+}
+
+// Zero extends the low size bytes of from into to
+func riscv64ZeroExtend(to string, from string, size int) string {
+	if size == 1 {
+		return "  andi " + to + ", " + from + ", 255\n"
+	}
+	shift := strconv.Itoa(64 - 8*size)
+	return "  slli " + to + ", " + from + ", " + shift + "\n  srli " + to + ", " + to + ", " + shift + "\n"
+}
+
+// Whether c fits in the signed 12 bit immediate of an I-type instruction
+func riscv64FitsImmediate(c int) bool {
+	return c >= -2048 && c < 2048
+}
+
+// Loads value into rd. 12 bit values use li, and 32 bit ones lui for the top
+// 20 bits and addiw for the rest. Wider values load their top bits the same
+// way, then shift them up with slli and add the low 12 bits with addi.
+func riscv64LoadImmediate(rd string, value int) string {
+	lo := value << 52 >> 52
+	if riscv64FitsImmediate(value) {
+		return "  li " + rd + ", " + strconv.Itoa(value) + "\n"
+	}
+	// Wraps for values near the maximum, as the instructions do
+	hi := (value - lo) >> 12
+	if value == int(int32(value)) {
+		xrn := "  lui " + rd + ", " + strconv.Itoa(hi&0xfffff) + "\n"
+		if lo != 0 {
+			xrn += "  addiw " + rd + ", " + rd + ", " + strconv.Itoa(lo) + "\n"
+		}
+		return xrn
+	}
+	shift := 12 + bits.TrailingZeros64(uint64(hi))
+	xrn := riscv64LoadImmediate(rd, hi>>(shift-12))
+	xrn += "  slli " + rd + ", " + rd + ", " + strconv.Itoa(shift) + "\n"
+	if lo != 0 {
+		xrn += "  addi " + rd + ", " + rd + ", " + strconv.Itoa(lo) + "\n"
+	}
+	return xrn
+}
+
+// Any instructions needed to form the address, and the operand, e.g. 8(sp).
+// A displacement too wide for the instruction is added into a temporary.
+func (g *RiscvGenerator) getAddress(arg Arg) (string, string) {
+	base := g.arch.GetPhysicalRegister(arg.value)
+	displacement := g.ir.constants[arg.offsetConstant]
+	if riscv64FitsImmediate(displacement) {
+		return "", strconv.Itoa(displacement) + "(" + base + ")"
+	}
+	setup := riscv64LoadImmediate(riscv64Temporary0, displacement)
+	setup += "  add " + riscv64Temporary0 + ", " + riscv64Temporary0 + ", " + base + "\n"
+	return setup, "0(" + riscv64Temporary0 + ")"
+}
+
+func (g *RiscvGenerator) GetAddress(arg Arg) string {
+	setup, addr := g.getAddress(arg)
+	if setup != "" {
+		panic("Displacement too wide for an address operand")
+	}
+	return addr
+}
+
+func (g *RiscvGenerator) GetConstant(i int) string {
+	return strconv.Itoa(g.ir.constants[i])
+}
+
+func (g *RiscvGenerator) GetArg(arg Arg) string {
+	switch arg.argType {
+	case constant:
+		return g.GetConstant(arg.value)
+	case registerArg:
+		if arg.isVirtualRegister {
+			panic("Virtual register not allowed at code generation time")
+		}
+		return g.arch.GetPhysicalRegister(arg.value)
+	case address:
+		return g.GetAddress(arg)
+	default:
+		panic("Unknown argument type")
+	}
+}
+
+// Labels starting with .L are left out of the object file. They name the
+// function, since they are not local to it, and IR names cannot contain $.
+func (g *RiscvGenerator) GetLabelName(l int) string {
+	return ".L" + g.ir.Name() + "$" + g.ir.labels[l]
+}
+
+func (g *RiscvGenerator) GetLabel(instr Instruction) string {
+	return g.GetLabelName(instr.arg2.value) + ":\n"
+}
+
+func (g *RiscvGenerator) GetJump(instr Instruction) string {
+	return "  j " + g.GetLabelName(instr.arg2.value) + "\n"
+}
+
+func (g *RiscvGenerator) GetBranch(instr Instruction) string {
+	return "  bnez " + g.arch.GetPhysicalRegister(instr.arg1.value) + ", " + g.GetLabelName(instr.arg2.value) + "\n"
+}
+
+// The only comparisons are slt and sltu, so the others swap their operands
+// or invert the result. Values are sign extended whatever their type, which
+// keeps their order, signed or unsigned, so comparisons are always 64 bit.
+func (g *RiscvGenerator) GetCompareInstruction(op GenOp, instr Instruction) string {
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	arg1 := g.arch.GetPhysicalRegister(instr.arg1.value)
+	xrn := ""
+	var arg2 string
+	if instr.arg2.argType == constant {
+		xrn += riscv64LoadImmediate(riscv64Temporary1, instr.typ.wrap(g.ir.constants[instr.arg2.value]))
+		arg2 = riscv64Temporary1
+	} else {
+		arg2 = g.arch.GetPhysicalRegister(instr.arg2.value)
+	}
+	slt := "slt"
+	switch op {
+	case ultGenOp, uleGenOp, ugtGenOp, ugeGenOp:
+		slt = "sltu"
+	}
+	switch op {
+	case eqGenOp:
+		return xrn + "  xor " + retRegister + ", " + arg1 + ", " + arg2 + "\n  seqz " + retRegister + ", " + retRegister + "\n"
+	case neGenOp:
+		return xrn + "  xor " + retRegister + ", " + arg1 + ", " + arg2 + "\n  snez " + retRegister + ", " + retRegister + "\n"
+	case ltGenOp, ultGenOp:
+		return xrn + "  " + slt + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n"
+	case gtGenOp, ugtGenOp:
+		return xrn + "  " + slt + " " + retRegister + ", " + arg2 + ", " + arg1 + "\n"
+	case geGenOp, ugeGenOp:
+		return xrn + "  " + slt + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n  xori " + retRegister + ", " + retRegister + ", 1\n"
+	case leGenOp, uleGenOp:
+		return xrn + "  " + slt + " " + retRegister + ", " + arg2 + ", " + arg1 + "\n  xori " + retRegister + ", " + retRegister + ", 1\n"
+	default:
+		panic("Unknown comparison: " + strconv.Itoa(int(op)))
+	}
+}
+
+// A zero extending load as wide as the type is done sign extending instead,
+// which is how narrow values are kept
+func (g *RiscvGenerator) GetSizedLoad(instr Instruction) string {
+	size, signed := instr.op.memoryAccess()
+	if size == instr.typ.Size() {
+		signed = true
+	}
+	var name string
+	switch size {
+	case 1:
+		name = "lb"
+	case 2:
+		name = "lh"
+	case 4:
+		name = "lw"
+	default:
+		panic("Unknown load size: " + strconv.Itoa(size))
+	}
+	if !signed {
+		name += "u"
+	}
+	setup, addr := g.getAddress(instr.arg2)
+	return setup + "  " + name + " " + g.arch.GetPhysicalRegister(instr.ret.value) + ", " + addr + "\n"
+}
+
+func (g *RiscvGenerator) GetSizedStore(instr Instruction) string {
+	size, _ := instr.op.memoryAccess()
+	var name string
+	switch size {
+	case 1:
+		name = "sb"
+	case 2:
+		name = "sh"
+	case 4:
+		name = "sw"
+	default:
+		panic("Unknown store size: " + strconv.Itoa(size))
+	}
+	setup, addr := g.getAddress(instr.arg2)
+	return setup + "  " + name + " " + g.arch.GetPhysicalRegister(instr.arg1.value) + ", " + addr + "\n"
+}
+
+// Without the bit manipulation extensions, extensions shift the value to
+// the top of the register and back. Truncation sign extends to keep the
+// result in the form narrow expects.
+func (g *RiscvGenerator) GetConversion(instr Instruction) string {
+	if _, _, ok := instr.op.floatConversion(); ok {
+		return g.getFloatConversion(instr)
+	}
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	arg2 := g.arch.GetPhysicalRegister(instr.arg2.value)
+	switch instr.op {
+	case sext8:
+		return riscv64SignExtend(retRegister, arg2, 1)
+	case sext16:
+		return riscv64SignExtend(retRegister, arg2, 2)
+	case sext32:
+		return riscv64SignExtend(retRegister, arg2, 4)
+	case zext8:
+		return riscv64ZeroExtend(retRegister, arg2, 1)
+	case zext16:
+		return riscv64ZeroExtend(retRegister, arg2, 2)
+	case zext32:
+		return riscv64ZeroExtend(retRegister, arg2, 4)
+	case trunc:
+		return riscv64SignExtend(retRegister, arg2, instr.typ.Size())
+	default:
+		panic("Unknown conversion: " + instr.op.String())
+	}
+}
+
+// Float to integer conversions round towards zero with rtz and saturate, as
+// CanonicalFloats describes
+func (g *RiscvGenerator) getFloatConversion(instr Instruction) string {
+	from, to, _ := instr.op.floatConversion()
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	arg2 := g.arch.GetPhysicalRegister(instr.arg2.value)
+	switch {
+	case !from.IsFloat():
+		return "  fcvt" + riscv64FloatSuffix(to) + ".l " + retRegister + ", " + arg2 + "\n"
+	case !to.IsFloat():
+		return "  fcvt.l" + riscv64FloatSuffix(from) + " " + retRegister + ", " + arg2 + ", rtz\n"
+	default:
+		return "  fcvt" + riscv64FloatSuffix(to) + riscv64FloatSuffix(from) + " " + retRegister + ", " + arg2 + "\n"
+	}
+}
+
+func (g *RiscvGenerator) GetFloatInstruction(op GenOp, instr Instruction) string {
+	var name string
+	switch op {
+	case addGenOp:
+		name = "fadd"
+	case subGenOp:
+		name = "fsub"
+	case multGenOp:
+		name = "fmul"
+	case divGenOp:
+		name = "fdiv"
+	default:
+		panic("Unknown float operation: " + strconv.Itoa(int(op)))
+	}
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	arg1 := g.arch.GetPhysicalRegister(instr.arg1.value)
+	arg2 := g.arch.GetPhysicalRegister(instr.arg2.value)
+	return "  " + name + riscv64FloatSuffix(instr.typ) + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n"
+}
+
+func (g *RiscvGenerator) GetFloatLoad(instr Instruction) string {
+	name := "fld"
+	if instr.op.floatAccess() == F32 {
+		name = "flw"
+	}
+	setup, addr := g.getAddress(instr.arg2)
+	return setup + "  " + name + " " + g.arch.GetPhysicalRegister(instr.ret.value) + ", " + addr + "\n"
+}
+
+func (g *RiscvGenerator) GetFloatStore(instr Instruction) string {
+	name := "fsd"
+	if instr.op.floatAccess() == F32 {
+		name = "fsw"
+	}
+	setup, addr := g.getAddress(instr.arg2)
+	return setup + "  " + name + " " + g.arch.GetPhysicalRegister(instr.arg1.value) + ", " + addr + "\n"
+}
+
+// Single or double precision
+func riscv64FloatSuffix(t Type) string {
+	if t == F32 {
+		return ".s"
+	}
+	return ".d"
+}
+
+func (g *RiscvGenerator) GetTargetInstruction(op GenOp) string {
+	switch op {
+	case addGenOp:
+		return "add"
+	case subGenOp:
+		return "sub"
+	case multGenOp:
+		return "mul"
+	case divGenOp:
+		return "div"
+	case movGenOp:
+		return "mv"
+	case loadGenOp:
+		return "ld"
+	case storeGenOp:
+		return "sd"
+	case andGenOp:
+		return "and"
+	case orGenOp:
+		return "or"
+	case xorGenOp:
+		return "xor"
+	case shlGenOp:
+		return "sll"
+	case lshrGenOp:
+		return "srl"
+	case ashrGenOp:
+		return "sra"
+	case notGenOp:
+		return "not"
+	case negGenOp:
+		return "neg"
+	default:
+		panic("Unknown operation: " + strconv.Itoa(int(op)))
+	}
+}
@@ -0,0 +1,155 @@
+package navm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+// Runs the li, lui, addiw, slli and addi of an immediate sequence on a
+// single register
+func runImmediateSequence(t *testing.T, xrn string) int {
+	value := 0
+	for _, line := range strings.Split(strings.TrimSpace(xrn), "\n") {
+		fields := strings.Fields(strings.ReplaceAll(line, ",", ""))
+		imm, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if (fields[0] == "addi" || fields[0] == "addiw") && !riscv64FitsImmediate(imm) {
+			t.Errorf("Expected a 12 bit immediate, got %q", line)
+		}
+		switch fields[0] {
+		case "li":
+			value = imm
+		case "lui":
+			value = int(int32(imm << 12))
+		case "addiw":
+			value = int(int32(value + imm))
+		case "slli":
+			value <<= imm
+		case "addi":
+			value += imm
+		default:
+			t.Fatalf("Unexpected instruction %q", line)
+		}
+	}
+	return value
+}
+
+func TestRiscv64LoadImmediate(t *testing.T) {
+	values := []int{0, 1, -1, 2047, -2048, 2048, -2049, 0x7ffff800, 0xfffff800,
+		math.MaxInt32, math.MinInt32, math.MaxInt32 + 1, math.MinInt32 - 1,
+		math.MaxInt64, math.MinInt64, -1 << 32, 0x123456789abcdef0, -0x123456789abcdef0}
+	// Walks through bit patterns of every width
+	for v := uint64(0x9e3779b97f4a7c15); len(values) < 200; v = v*6364136223846793005 + 1442695040888963407 {
+		values = append(values, int(v>>(len(values)%64)))
+	}
+	for _, v := range values {
+		xrn := riscv64LoadImmediate("t0", v)
+		if result := runImmediateSequence(t, xrn); result != v {
+			t.Errorf("Expected %d, got %d from\n%s", v, result, xrn)
+		}
+	}
+
+	if xrn := riscv64LoadImmediate("t0", 2047); xrn != "  li t0, 2047\n" {
+		t.Errorf("Expected a single li, got\n%s", xrn)
+	}
+	if xrn := riscv64LoadImmediate("t0", 0x12345000); xrn != "  lui t0, 74565\n" {
+		t.Errorf("Expected a single lui, got\n%s", xrn)
+	}
+	if xrn := riscv64LoadImmediate("t0", 0x7fffffff); xrn != "  lui t0, 524288\n  addiw t0, t0, -1\n" {
+		t.Errorf("Expected lui and addiw, got\n%s", xrn)
+	}
+	if xrn := riscv64LoadImmediate("t0", 1<<40); xrn != "  li t0, 1\n  slli t0, t0, 40\n" {
+		t.Errorf("Expected li and slli, got\n%s", xrn)
+	}
+}
+
+func TestCompileRiscv(t *testing.T) {
+	text := `.types %v2 i32, %v3 i8
+  %v1 = mov 100000
+  %v1 = add %v1, 5000
+  %v1 = sub %v1, 7
+  %v2 = trunc %v1
+  %v2 = add %v2, %v2
+  %v3 = trunc %v1
+  %v3 = lshr %v3, 2
+  %v1 = sext8 %v3
+  %v4 = lt %v1, %v1
+  %ret = ge %v1, 3
+  ret
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := CompileE(ir, RISCV64_LINUX_MUSL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		".text\n.globl main\n.type main, @function\n.align 2\n\nmain:\n",
+		"  lui t2, 24\n  addiw t2, t2, 1696\n",
+		// Constants too wide for addi go through a temporary
+		"  lui t6, 1\n  addiw t6, t6, 904\n  add t2, t2, t6\n",
+		"  addi t2, t2, -7\n",
+		"  sext.w t3, t2\n  addw t3, t3, t3\n",
+		// A narrow lshr zero extends first
+		"  andi t5, t4, 255\n  srli t4, t5, 2\n  slli t4, t4, 56\n  srai t4, t4, 56\n",
+		"  li t6, 3\n  slt a0, t2, t6\n  xori a0, a0, 1\n",
+		"  ret\n",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %q in\n%s", expected, result)
+		}
+	}
+}
+
+// Eight arguments, all reloaded from spill slots too far from sp for a 12 bit
+// displacement, so the reloads need temporaries while earlier arguments are
+// already in a0 to a7
+func TestRiscvCallWithLargeFrame(t *testing.T) {
+	var b strings.Builder
+	b.WriteString(".func f 8\n  %ret = add %v1, %v8\n  ret\n\n.func main 0\n")
+	n := 300
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "  %%v%d = mov %d\n", i, i)
+	}
+	fmt.Fprintf(&b, "  %%ret = call @f(%%v%d, %%v%d, %%v%d, %%v%d, %%v%d, %%v%d, %%v%d, %%v%d)\n", n-7, n-6, n-5, n-4, n-3, n-2, n-1, n)
+	for i := n; i >= 1; i-- {
+		fmt.Fprintf(&b, "  %%ret = add %%ret, %%v%d\n", i)
+	}
+	b.WriteString("  ret\n")
+	m, err := ParseModule(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := n*(n+1)/2 + n - 7 + n
+	result, err := InterpretModuleForArchitecture(m, RISCV64_LINUX_MUSL, "main", InterpretOptions{Memory: MemoryLayout{Size: 8192}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != expected {
+		t.Errorf("Expected %d, got %d", expected, result)
+	}
+	xrn, err := CompileModuleE(m, RISCV64_LINUX_MUSL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	body := xrn[strings.Index(xrn, "\nmain:\n"):]
+	if !strings.Contains(body, "  add t5, t5, sp\n  ld t1, 0(t5)\n  mv a7, t1\n") {
+		t.Errorf("Expected a reload through a temporary in\n%s", body)
+	}
+	// Only the moves into a6 and a7 may write them
+	for _, register := range []string{"a6", "a7"} {
+		if count := strings.Count(body, register); count != 1 {
+			t.Errorf("Expected %s once in main, got %d times", register, count)
+		}
+	}
+}
@@ -0,0 +1,930 @@
+////////////////////////////////////////////////////////////////////////////////
+// Textual IR format. See README.md for the syntax. ////////////////////////////
+////////////////////////////////////////////////////////////////////////////////
+
+package navm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Describes which operands an op takes, used by both the printer and parser
+type opShape int
+
+const (
+	noShape      opShape = iota
+	movShape     opShape = iota // %r = op arg
+	binaryShape  opShape = iota // %r = op %a, arg
+	loadShape    opShape = iota // %r = op [addr]
+	storeShape   opShape = iota // op %a, [addr]
+	nullaryShape opShape = iota // op
+	labelShape   opShape = iota // name:
+	jumpShape    opShape = iota // op name
+	branchShape  opShape = iota // op %a, name
+	callShape    opShape = iota // [%r =] op @name(%a, ...)
+)
+
+func (op Op) shape() opShape {
+	switch op {
+	case mov, sext8, sext16, sext32, zext8, zext16, zext32, trunc,
+		sitof32, sitof64, f32tosi, f64tosi, f32tof64, f64tof32, not, neg:
+		return movShape
+	case add, sub, mult, div, eq, ne, lt, le, gt, ge, ult, ule, ugt, uge,
+		fadd, fsub, fmul, fdiv, and, or, xor, shl, lshr, ashr, udiv, srem, urem:
+		return binaryShape
+	case load, load8u, load8s, load16u, load16s, load32u, load32s, fload32, fload64:
+		return loadShape
+	case store, store8, store16, store32, fstore32, fstore64:
+		return storeShape
+	case ret:
+		return nullaryShape
+	case label:
+		return labelShape
+	case jmp:
+		return jumpShape
+	case br:
+		return branchShape
+	case call:
+		return callShape
+	default:
+		return noShape
+	}
+}
+
+func opFromName(name string) (Op, bool) {
+	for op, n := range opNames {
+		if n != "" && n == name {
+			return Op(op), true
+		}
+	}
+	return noOp, false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Printer
+
+// The .func header is only needed for named functions, or when printing a
+// whole module
+func printIR(ir *IR, header bool) string {
+	ret := ""
+	if header || ir.name != "" || ir.paramCount != 0 {
+		ret += ".func " + ir.Name() + " " + strconv.Itoa(ir.paramCount) + "\n"
+	}
+	ret += ".registers " + strconv.Itoa(ir.registersLength) + "\n"
+	types := ""
+	for r, t := range ir.types {
+		if t == noType || t == I64 {
+			continue
+		}
+		if types != "" {
+			types += ", "
+		}
+		types += printRegister(MakeVirtualRegister(r)) + " " + t.String()
+	}
+	if types != "" {
+		ret += ".types " + types + "\n"
+	}
+	if ir.traps != DefaultTraps {
+		ret += ".traps " + ir.traps.String() + "\n"
+	}
+	if len(ir.constants) > 0 {
+		ret += ".constants "
+		for idx, c := range ir.constants {
+			if idx > 0 {
+				ret += ", "
+			}
+			ret += strconv.Itoa(c)
+		}
+		ret += "\n"
+	}
+	for _, i := range ir.instructions {
+		if i.op == label {
+			ret += printInstruction(i, ir) + "\n"
+		} else {
+			ret += "  " + printInstruction(i, ir) + "\n"
+		}
+	}
+	return ret
+}
+
+// Narrow instructions carry their type as a suffix, e.g. add.i32, and
+// divisions that override the function's trap policy carry it after that,
+// e.g. div.i32.wrap
+func printInstruction(i Instruction, ir *IR) string {
+	name := i.op.String()
+	if i.typ != noType {
+		name += "." + i.typ.String()
+	}
+	if i.traps != DefaultTraps {
+		name += "." + i.traps.String()
+	}
+	switch i.op.shape() {
+	case movShape:
+		return printRegister(i.ret) + " = " + name + " " + printArg(i.arg2, ir)
+	case binaryShape:
+		return printRegister(i.ret) + " = " + name + " " + printRegister(i.arg1) + ", " + printArg(i.arg2, ir)
+	case loadShape:
+		return printRegister(i.ret) + " = " + name + " " + printArg(i.arg2, ir)
+	case storeShape:
+		return name + " " + printRegister(i.arg1) + ", " + printArg(i.arg2, ir)
+	case nullaryShape:
+		return name
+	case labelShape:
+		return printArg(i.arg2, ir) + ":"
+	case jumpShape:
+		return name + " " + printArg(i.arg2, ir)
+	case branchShape:
+		return name + " " + printRegister(i.arg1) + ", " + printArg(i.arg2, ir)
+	case callShape:
+		args := ""
+		for idx, a := range i.args {
+			if idx > 0 {
+				args += ", "
+			}
+			args += printRegister(a)
+		}
+		xrn := name + " " + printArg(i.arg2, ir) + "(" + args + ")"
+		if i.ret.registerType == noRegisterType {
+			return xrn
+		}
+		return printRegister(i.ret) + " = " + xrn
+	default:
+		return name + " " + printRegister(i.ret) + ", " + printRegister(i.arg1) + ", " + printArg(i.arg2, ir)
+	}
+}
+
+func printRegister(r Register) string {
+	var prefix string
+	switch r.registerType {
+	case noRegisterType:
+		return "_"
+	case virtualRegister:
+		if r.value == RETURN_REGISTER {
+			return "%ret"
+		}
+		prefix = "%v"
+	case physicalRegister:
+		if r.value == STACK_POINTER_REGISTER {
+			return "%sp"
+		}
+		if r.value <= ARGUMENT_REGISTER_0 {
+			return "%a" + strconv.Itoa(ARGUMENT_REGISTER_0-r.value)
+		}
+		prefix = "%p"
+	case stackRegister:
+		prefix = "%s"
+	default:
+		prefix = "%?"
+	}
+	switch r.value {
+	case RETURN_REGISTER:
+		return prefix + "ret"
+	case STACK_POINTER_REGISTER:
+		return prefix + "sp"
+	default:
+		return prefix + strconv.Itoa(r.value)
+	}
+}
+
+func printConstant(c int, ir *IR) string {
+	if ir == nil || c < 0 || c >= len(ir.constants) {
+		return "#" + strconv.Itoa(c)
+	}
+	return strconv.Itoa(ir.constants[c])
+}
+
+func printArg(a Arg, ir *IR) string {
+	switch a.argType {
+	case constant:
+		return printConstant(a.value, ir)
+	case registerArg, stackArg:
+		return printRegister(a.register())
+	case address:
+		offset := printConstant(a.offsetConstant, ir)
+		if strings.HasPrefix(offset, "-") {
+			return "[" + printRegister(a.register()) + " - " + offset[1:] + "]"
+		}
+		return "[" + printRegister(a.register()) + " + " + offset + "]"
+	case labelArg:
+		if ir == nil || a.value < 0 || a.value >= len(ir.labels) {
+			return "L" + strconv.Itoa(a.value)
+		}
+		return ir.labels[a.value]
+	case functionArg:
+		if ir == nil || a.value < 0 || a.value >= len(ir.functions) {
+			return "@" + strconv.Itoa(a.value)
+		}
+		return "@" + ir.functions[a.value]
+	default:
+		return "_"
+	}
+}
+
+// The register an argument refers to, if any
+func (a Arg) register() Register {
+	if a.argType == stackArg || a.spilledBase {
+		return Register{registerType: stackRegister, value: a.value}
+	}
+	if a.isVirtualRegister {
+		return Register{registerType: virtualRegister, value: a.value}
+	}
+	return Register{registerType: physicalRegister, value: a.value}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Parser
+
+// Reports the position of a syntax error, both 1-indexed
+type ParseError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return strconv.Itoa(e.Line) + ":" + strconv.Itoa(e.Column) + ": " + e.Msg
+}
+
+// A constant operand. Literals are resolved against the constant pool once
+// the whole input has been read.
+type constRef struct {
+	value     int
+	isLiteral bool // otherwise value is a constant pool index
+}
+
+type parsedInstruction struct {
+	xrn    Instruction
+	arg2   *constRef // set if arg2 is a constant
+	offset *constRef // set if arg2 is an address
+	line   int
+	column int
+}
+
+type lineParser struct {
+	text   string
+	pos    int
+	lineNo int
+	ir     *IR
+	labels *labelTable
+}
+
+// Labels are numbered in order of first appearance, which may be a forward
+// reference
+type labelTable struct {
+	ir      *IR
+	indices map[string]int
+	defined []bool
+	usedAt  []*ParseError // where each label was first referenced
+}
+
+func (t *labelTable) get(name string) int {
+	if idx, ok := t.indices[name]; ok {
+		return idx
+	}
+	idx := len(t.ir.labels)
+	t.ir.labels = append(t.ir.labels, name)
+	t.indices[name] = idx
+	t.defined = append(t.defined, false)
+	t.usedAt = append(t.usedAt, nil)
+	return idx
+}
+
+// The state of the function currently being parsed
+type functionParser struct {
+	ir           *IR
+	explicit     bool // started by a .func directive
+	registersSet bool
+	constantsSet bool
+	typesAt      *ParseError // where the .types directive is, if there is one
+	parsed       []parsedInstruction
+	labels       *labelTable
+}
+
+func newFunctionParser(ir *IR) *functionParser {
+	return &functionParser{ir: ir, labels: &labelTable{ir: ir, indices: make(map[string]int)}}
+}
+
+func (fp *functionParser) empty() bool {
+	return !fp.explicit && !fp.registersSet && !fp.constantsSet && fp.typesAt == nil && len(fp.parsed) == 0
+}
+
+// Parses the textual IR format produced by IR.Print. The input must contain
+// at most one function.
+func ParseIR(r io.Reader) (*IR, error) {
+	m, err := parseModule(r, true)
+	if err != nil {
+		return nil, err
+	}
+	return m.functions[0], nil
+}
+
+// Parses the textual format produced by Module.Print, with each function
+// started by a .func directive
+func ParseModule(r io.Reader) (*Module, error) {
+	return parseModule(r, false)
+}
+
+func parseModule(r io.Reader, single bool) (*Module, error) {
+	m := NewModule()
+	fp := newFunctionParser(NewIR())
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		p := &lineParser{text: scanner.Text(), lineNo: lineNo, ir: fp.ir, labels: fp.labels}
+		p.skipSpace()
+		if p.atEnd() {
+			continue
+		}
+		if p.peek() != '.' {
+			pi, err := p.instruction()
+			if err != nil {
+				return nil, err
+			}
+			fp.parsed = append(fp.parsed, pi)
+			continue
+		}
+		column := p.column()
+		directive := p.word()
+		switch directive {
+		case ".func":
+			if !fp.empty() {
+				if single {
+					return nil, p.errorAt(column, "expected a single function")
+				}
+				if err := fp.finish(m); err != nil {
+					return nil, err
+				}
+			}
+			p.skipSpace()
+			nameColumn := p.column()
+			name := p.word()
+			if name == "" {
+				return nil, p.errorAt(nameColumn, "expected function name")
+			}
+			if m.Function(name) != nil {
+				return nil, p.errorAt(nameColumn, "function "+strconv.Quote(name)+" is already defined")
+			}
+			p.skipSpace()
+			paramsColumn := p.column()
+			params, err := p.integer()
+			if err != nil {
+				return nil, err
+			}
+			if params < 0 {
+				return nil, p.errorAt(paramsColumn, "parameter count cannot be negative")
+			}
+			fp = newFunctionParser(NewFunction(name, params))
+			fp.explicit = true
+		case ".registers":
+			if fp.registersSet {
+				return nil, p.errorAt(column, "duplicate .registers directive")
+			}
+			n, err := p.integer()
+			if err != nil {
+				return nil, err
+			}
+			if n < fp.ir.paramCount+1 {
+				return nil, p.errorAt(column, ".registers must be at least the parameter count plus 1")
+			}
+			fp.ir.registersLength = n
+			fp.registersSet = true
+		case ".constants":
+			if fp.constantsSet || len(fp.parsed) > 0 {
+				return nil, p.errorAt(column, ".constants must appear once, before any instruction")
+			}
+			for !p.atEnd() {
+				if len(fp.ir.constants) > 0 {
+					if err := p.expect(','); err != nil {
+						return nil, err
+					}
+				}
+				c, err := p.integer()
+				if err != nil {
+					return nil, err
+				}
+				fp.ir.constants = append(fp.ir.constants, c)
+			}
+			fp.constantsSet = true
+		case ".types":
+			if fp.typesAt != nil {
+				return nil, p.errorAt(column, "duplicate .types directive")
+			}
+			fp.typesAt = p.errorAt(column, "")
+			for first := true; !p.atEnd(); first = false {
+				if !first {
+					if err := p.expect(','); err != nil {
+						return nil, err
+					}
+				}
+				if err := p.registerType(fp.ir); err != nil {
+					return nil, err
+				}
+			}
+		case ".traps":
+			if fp.ir.traps != DefaultTraps {
+				return nil, p.errorAt(column, "duplicate .traps directive")
+			}
+			p.skipSpace()
+			policyColumn := p.column()
+			name := p.word()
+			policy, ok := trapPolicyFromName(name)
+			if !ok {
+				return nil, p.errorAt(policyColumn, "unknown trap policy "+strconv.Quote(name))
+			}
+			fp.ir.traps = policy
+		default:
+			return nil, p.errorAt(column, "unknown directive "+strconv.Quote(directive))
+		}
+		if !p.atEnd() {
+			return nil, p.errorf("unexpected %q after directive", string(p.peek()))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := fp.finish(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Resolves labels, constants and the register count, then adds the function
+// to the module
+func (fp *functionParser) finish(m *Module) error {
+	ir := fp.ir
+	for idx, name := range ir.labels {
+		if !fp.labels.defined[idx] {
+			err := fp.labels.usedAt[idx]
+			err.Msg = "undefined label " + strconv.Quote(name)
+			return err
+		}
+	}
+
+	maxRegister := ir.paramCount
+	for _, pi := range fp.parsed {
+		xrn := pi.xrn
+		if pi.arg2 != nil {
+			c, err := resolveConstant(ir, *pi.arg2, pi)
+			if err != nil {
+				return err
+			}
+			xrn.arg2.value = c
+		}
+		if pi.offset != nil {
+			c, err := resolveConstant(ir, *pi.offset, pi)
+			if err != nil {
+				return err
+			}
+			xrn.arg2.offsetConstant = c
+		}
+		registers := append([]Register{xrn.ret, xrn.arg1, xrn.arg2.register()}, xrn.args...)
+		for _, r := range registers {
+			if r.registerType != virtualRegister || r.value <= maxRegister {
+				continue
+			}
+			if fp.registersSet && r.value >= ir.registersLength {
+				return &ParseError{Line: pi.line, Column: pi.column, Msg: "register %v" + strconv.Itoa(r.value) + " exceeds .registers " + strconv.Itoa(ir.registersLength)}
+			}
+			maxRegister = r.value
+		}
+		ir.instructions = append(ir.instructions, xrn)
+	}
+	if fp.typesAt != nil && len(ir.types) > maxRegister+1 {
+		if fp.registersSet && len(ir.types) > ir.registersLength {
+			err := fp.typesAt
+			err.Msg = "register %v" + strconv.Itoa(len(ir.types)-1) + " exceeds .registers " + strconv.Itoa(ir.registersLength)
+			return err
+		}
+		maxRegister = len(ir.types) - 1
+	}
+	if !fp.registersSet {
+		ir.registersLength = maxRegister + 1
+	}
+	m.AddFunction(ir)
+	return nil
+}
+
+func resolveConstant(ir *IR, c constRef, pi parsedInstruction) (int, error) {
+	if c.isLiteral {
+		return ir.GetConstant(c.value), nil
+	}
+	if c.value < 0 || c.value >= len(ir.constants) {
+		return 0, &ParseError{Line: pi.line, Column: pi.column, Msg: "constant #" + strconv.Itoa(c.value) + " is out of range"}
+	}
+	return c.value, nil
+}
+
+func (p *lineParser) instruction() (parsedInstruction, error) {
+	pi := parsedInstruction{line: p.lineNo, column: p.column()}
+	if name, ok := p.labelDefinition(); ok {
+		idx := p.labels.get(name)
+		if p.labels.defined[idx] {
+			return pi, p.errorAt(pi.column, "label "+strconv.Quote(name)+" is already defined")
+		}
+		p.labels.defined[idx] = true
+		pi.xrn = Instruction{op: label, arg2: Arg{argType: labelArg, value: idx}}
+		if !p.atEnd() {
+			return pi, p.errorf("unexpected %q after label", string(p.peek()))
+		}
+		return pi, nil
+	}
+	var retReg Register
+	hasRet := false
+	if p.peek() == '%' {
+		r, err := p.register()
+		if err != nil {
+			return pi, err
+		}
+		retReg = r
+		hasRet = true
+		if err := p.expect('='); err != nil {
+			return pi, err
+		}
+	}
+	p.skipSpace()
+	column := p.column()
+	name := p.word()
+	if name == "" {
+		return pi, p.errorf("expected instruction")
+	}
+	suffixes := ""
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		suffixes = name[dot:]
+		name = name[:dot]
+	}
+	op, ok := opFromName(name)
+	if !ok {
+		return pi, p.errorAt(column, "unknown instruction "+strconv.Quote(name))
+	}
+	typ, traps, err := p.suffixes(op, suffixes, column+len(name))
+	if err != nil {
+		return pi, err
+	}
+	shape := op.shape()
+	wantsRet := shape == movShape || shape == binaryShape || shape == loadShape
+	if wantsRet && !hasRet {
+		return pi, p.errorAt(column, name+" requires a destination register")
+	}
+	if !wantsRet && hasRet && shape != callShape {
+		return pi, p.errorAt(column, name+" does not take a destination register")
+	}
+	pi.xrn = Instruction{op: op, typ: typ, ret: retReg, traps: traps}
+
+	switch shape {
+	case movShape:
+		err = p.operand(&pi)
+	case binaryShape:
+		if pi.xrn.arg1, err = p.register(); err != nil {
+			return pi, err
+		}
+		if err = p.expect(','); err != nil {
+			return pi, err
+		}
+		err = p.operand(&pi)
+	case loadShape:
+		err = p.address(&pi)
+	case jumpShape:
+		err = p.labelReference(&pi)
+	case branchShape:
+		if pi.xrn.arg1, err = p.register(); err != nil {
+			return pi, err
+		}
+		if err = p.expect(','); err != nil {
+			return pi, err
+		}
+		err = p.labelReference(&pi)
+	case callShape:
+		err = p.callTarget(&pi)
+	case labelShape:
+		return pi, p.errorAt(column, "labels are written as name:")
+	case storeShape:
+		if pi.xrn.arg1, err = p.register(); err != nil {
+			return pi, err
+		}
+		if err = p.expect(','); err != nil {
+			return pi, err
+		}
+		err = p.address(&pi)
+	}
+	if err != nil {
+		return pi, err
+	}
+	if !p.atEnd() {
+		return pi, p.errorf("unexpected %q after instruction", string(p.peek()))
+	}
+	return pi, nil
+}
+
+// Parses "%vN type" from a .types directive, growing the IR's type table
+func (p *lineParser) registerType(ir *IR) error {
+	column := p.column()
+	r, err := p.register()
+	if err != nil {
+		return err
+	}
+	if r.registerType != virtualRegister || r.value <= 0 {
+		return p.errorAt(column, "only virtual registers have types")
+	}
+	p.skipSpace()
+	typeColumn := p.column()
+	name := p.word()
+	t, ok := typeFromName(name)
+	if !ok {
+		return p.errorAt(typeColumn, "unknown type "+strconv.Quote(name))
+	}
+	for len(ir.types) <= r.value {
+		ir.types = append(ir.types, noType)
+	}
+	ir.types[r.value] = t
+	return nil
+}
+
+// Checks for a "name:" label definition, consuming it if present
+func (p *lineParser) labelDefinition() (string, bool) {
+	start := p.pos
+	name := p.word()
+	if name != "" && p.peek() == ':' {
+		p.pos++
+		return name, true
+	}
+	p.pos = start
+	return "", false
+}
+
+// Parses the suffixes after an instruction name, each starting with a '.':
+// an optional type, then for divisions an optional trap policy
+func (p *lineParser) suffixes(op Op, suffixes string, column int) (Type, TrapPolicy, error) {
+	var typ Type
+	var traps TrapPolicy
+	for suffixes != "" {
+		column++
+		suffix := suffixes[1:]
+		if dot := strings.IndexByte(suffix, '.'); dot >= 0 {
+			suffix = suffix[:dot]
+		}
+		if t, ok := typeFromName(suffix); ok && typ == noType && traps == DefaultTraps {
+			typ = t
+		} else if policy, ok := trapPolicyFromName(suffix); ok && traps == DefaultTraps {
+			if !op.isDivision() {
+				return typ, traps, p.errorAt(column, op.String()+" does not take a trap policy")
+			}
+			traps = policy
+		} else {
+			if op.isDivision() {
+				return typ, traps, p.errorAt(column, "unknown type or trap policy "+strconv.Quote(suffix))
+			}
+			return typ, traps, p.errorAt(column, "unknown type "+strconv.Quote(suffix))
+		}
+		column += len(suffix)
+		suffixes = suffixes[1+len(suffix):]
+	}
+	return typ, traps, nil
+}
+
+// Parses @name(%a, ...) into arg2 and args
+func (p *lineParser) callTarget(pi *parsedInstruction) error {
+	if err := p.expect('@'); err != nil {
+		return err
+	}
+	name := p.word()
+	if name == "" {
+		return p.errorf("expected function name")
+	}
+	pi.xrn.arg2 = Arg{argType: functionArg, value: p.ir.getFunction(name)}
+	if err := p.expect('('); err != nil {
+		return err
+	}
+	p.skipSpace()
+	for p.peek() != ')' {
+		if len(pi.xrn.args) > 0 {
+			if err := p.expect(','); err != nil {
+				return err
+			}
+		}
+		r, err := p.register()
+		if err != nil {
+			return err
+		}
+		pi.xrn.args = append(pi.xrn.args, r)
+		p.skipSpace()
+	}
+	return p.expect(')')
+}
+
+// Parses a label name into arg2
+func (p *lineParser) labelReference(pi *parsedInstruction) error {
+	p.skipSpace()
+	column := p.column()
+	name := p.word()
+	if name == "" {
+		return p.errorf("expected label")
+	}
+	idx := p.labels.get(name)
+	if p.labels.usedAt[idx] == nil {
+		p.labels.usedAt[idx] = p.errorAt(column, "")
+	}
+	pi.xrn.arg2 = Arg{argType: labelArg, value: idx}
+	return nil
+}
+
+// Parses a register or constant operand into arg2
+func (p *lineParser) operand(pi *parsedInstruction) error {
+	p.skipSpace()
+	if p.peek() == '%' {
+		r, err := p.register()
+		if err != nil {
+			return err
+		}
+		pi.xrn.arg2 = r.ToArg()
+		if r.registerType == stackRegister {
+			pi.xrn.arg2.argType = stackArg
+		}
+		return nil
+	}
+	c, err := p.constant()
+	if err != nil {
+		return err
+	}
+	pi.xrn.arg2 = Arg{argType: constant}
+	pi.arg2 = &c
+	return nil
+}
+
+// Parses [%r + offset] into arg2
+func (p *lineParser) address(pi *parsedInstruction) error {
+	if err := p.expect('['); err != nil {
+		return err
+	}
+	column := p.column()
+	r, err := p.register()
+	if err != nil {
+		return err
+	}
+	if r.registerType == stackRegister {
+		return p.errorAt(column, "stack slots cannot be used as an address")
+	}
+	pi.xrn.arg2 = r.ToAddress(0)
+	c := constRef{value: 0, isLiteral: true}
+	p.skipSpace()
+	if p.peek() == '+' || p.peek() == '-' {
+		negative := p.peek() == '-'
+		p.pos++
+		p.skipSpace()
+		if c, err = p.constant(); err != nil {
+			return err
+		}
+		if negative {
+			if !c.isLiteral {
+				return p.errorf("constant pool references cannot be negated")
+			}
+			c.value = -c.value
+		}
+	}
+	pi.offset = &c
+	return p.expect(']')
+}
+
+func (p *lineParser) constant() (constRef, error) {
+	p.skipSpace()
+	if p.peek() == '#' {
+		p.pos++
+		n, err := p.integer()
+		return constRef{value: n}, err
+	}
+	n, err := p.integer()
+	return constRef{value: n, isLiteral: true}, err
+}
+
+func (p *lineParser) register() (Register, error) {
+	p.skipSpace()
+	column := p.column()
+	if p.peek() != '%' {
+		return Register{}, p.errorf("expected register")
+	}
+	p.pos++
+	name := p.word()
+	switch name {
+	case "ret":
+		return GetReturnRegister(), nil
+	case "sp":
+		return GetStackPointer(), nil
+	case "":
+		return Register{}, p.errorAt(column, "expected register name after %")
+	}
+	if name[0] == 'a' {
+		// Argument registers count up from %a0
+		n, err := strconv.Atoi(name[1:])
+		if err != nil || n < 0 {
+			return Register{}, p.errorAt(column, "invalid register %"+name)
+		}
+		return GetArgumentRegister(n), nil
+	}
+	var r Register
+	switch name[0] {
+	case 'v':
+		r.registerType = virtualRegister
+	case 'p':
+		r.registerType = physicalRegister
+	case 's':
+		r.registerType = stackRegister
+	default:
+		return Register{}, p.errorAt(column, "unknown register %"+name)
+	}
+	switch name[1:] {
+	case "ret":
+		r.value = RETURN_REGISTER
+	case "sp":
+		r.value = STACK_POINTER_REGISTER
+	default:
+		n, err := strconv.Atoi(name[1:])
+		if err != nil || n < 1 {
+			return Register{}, p.errorAt(column, "invalid register %"+name)
+		}
+		r.value = n
+	}
+	return r, nil
+}
+
+func (p *lineParser) integer() (int, error) {
+	p.skipSpace()
+	column := p.column()
+	start := p.pos
+	if p.peek() == '-' {
+		p.pos++
+	}
+	for p.peek() >= '0' && p.peek() <= '9' {
+		p.pos++
+	}
+	n, err := strconv.Atoi(p.text[start:p.pos])
+	if err != nil {
+		p.pos = start
+		return 0, p.errorAt(column, "expected integer")
+	}
+	return n, nil
+}
+
+// Reads an identifier made of letters, digits, '_' and '.'
+func (p *lineParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.text) {
+		c := p.peek()
+		if !(c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			break
+		}
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+func (p *lineParser) expect(c byte) error {
+	p.skipSpace()
+	if p.peek() != c {
+		if p.atEnd() {
+			return p.errorf("expected %q, got end of line", string(c))
+		}
+		return p.errorf("expected %q, got %q", string(c), string(p.peek()))
+	}
+	p.pos++
+	return nil
+}
+
+// Skips whitespace, and treats a ';' comment as the end of the line
+func (p *lineParser) skipSpace() {
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t' || p.text[p.pos] == '\r') {
+		p.pos++
+	}
+	if p.pos < len(p.text) && p.text[p.pos] == ';' {
+		p.text = p.text[:p.pos]
+	}
+}
+
+func (p *lineParser) atEnd() bool {
+	p.skipSpace()
+	return p.pos >= len(p.text)
+}
+
+func (p *lineParser) peek() byte {
+	if p.pos >= len(p.text) {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+func (p *lineParser) column() int {
+	return p.pos + 1
+}
+
+func (p *lineParser) errorAt(column int, msg string) *ParseError {
+	return &ParseError{Line: p.lineNo, Column: column, Msg: msg}
+}
+
+func (p *lineParser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.column(), fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,236 @@
+package navm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+func TestPrintIR(t *testing.T) {
+	ir := NewIR()
+	r1 := ir.NewVirtualRegister()
+	r2 := ir.NewVirtualRegister()
+	ir.MoveConstant(r1, 3)
+	ir.MoveConstant(r2, 4)
+	ir.MultRegisters(r2, r1, r2)
+	ir.AddInstruction(Instruction{op: store, arg1: r2, arg2: GetStackPointer().ToAddress(ir.GetConstant(8))})
+	ir.AddInstruction(Instruction{op: load, ret: GetReturnRegister(), arg2: r1.ToAddress(ir.GetConstant(-8))})
+	ir.Return()
+
+	expected := `.registers 3
+.constants 3, 4, 8, -8
+  %v1 = mov 3
+  %v2 = mov 4
+  %v2 = mul %v1, %v2
+  store %v2, [%sp + 8]
+  %ret = load [%v1 - 8]
+  ret
+`
+	if ir.Print() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, ir.Print())
+	}
+}
+
+// The builder puts the stored register in arg1, where the printer looks
+func TestStoreBuilderRoundTrip(t *testing.T) {
+	ir := NewIR()
+	r1 := ir.NewVirtualRegister()
+	ir.MoveConstant(r1, 5)
+	ir.Store(r1, GetStackPointer().ToAddress(ir.GetConstant(16)))
+	ir.Return()
+
+	text := ir.Print()
+	if !strings.Contains(text, "  store %v1, [%sp + 16]\n") {
+		t.Errorf("Expected a store of %%v1, got\n%s", text)
+	}
+	parsed, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if parsed.Print() != text {
+		t.Errorf("Expected\n%s\ngot\n%s", text, parsed.Print())
+	}
+}
+
+func TestParseIRRoundTrip(t *testing.T) {
+	text := `.registers 5
+.constants 1, 2, 16, 0
+  %sp = sub %sp, 16
+  %v1 = mov 1
+  %v2 = add %v1, 2
+  %v3 = div %v2, %v1
+  store %v3, [%sp + 16]
+  %v4 = load [%sp + 16]
+  %ret = sub %v4, %v1
+  %v2 = ult %v4, %v1
+  %v2 = eq %v2, 0
+  %p3 = mov %s1
+  ret
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ir.Print() != text {
+		t.Errorf("Expected\n%s\ngot\n%s", text, ir.Print())
+	}
+	reparsed, err := ParseIR(strings.NewReader(ir.Print()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if reparsed.Print() != text {
+		t.Errorf("Expected\n%s\ngot\n%s", text, reparsed.Print())
+	}
+}
+
+// Lowered IR uses physical, argument and stack registers, which must print
+// in a form the parser reads back
+func TestParseLoweredRoundTrip(t *testing.T) {
+	for _, target := range []string{AARCH64_MACOS_NONE, X64_WIN_GNU, RISCV64_LINUX_MUSL} {
+		for _, text := range []string{typedProgram, floatProgram, spillProgram} {
+			ir, err := ParseIR(strings.NewReader(text))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			lowered, err := Lower(ir, target)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			reparsed, err := ParseIR(strings.NewReader(lowered.Print()))
+			if err != nil {
+				t.Fatalf("Unexpected error for %s: %s", target, err)
+			}
+			if reparsed.Print() != lowered.Print() {
+				t.Errorf("Expected\n%s\ngot\n%s", lowered.Print(), reparsed.Print())
+			}
+		}
+		m, err := ParseModule(strings.NewReader(factorialModule))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		lowered, err := LowerModule(m, target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !strings.Contains(lowered.Print(), "  %a0 = mov ") {
+			t.Errorf("Expected an argument register for %s, got\n%s", target, lowered.Print())
+		}
+		reparsed, err := ParseModule(strings.NewReader(lowered.Print()))
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if reparsed.Print() != lowered.Print() {
+			t.Errorf("Expected\n%s\ngot\n%s", lowered.Print(), reparsed.Print())
+		}
+	}
+}
+
+func TestParseIRLabels(t *testing.T) {
+	text := `.registers 2
+.constants 10, 0, 1
+  %v1 = mov 10
+  %ret = mov 0
+  jmp loop
+done:
+  ret
+loop:
+  %ret = add %ret, %v1
+  %v1 = sub %v1, 1
+  br %v1, loop
+  jmp done
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ir.Print() != text {
+		t.Errorf("Expected\n%s\ngot\n%s", text, ir.Print())
+	}
+	result := Interpret(ir)
+	if result != 55 {
+		t.Errorf("Expected 55, got %d", result)
+	}
+}
+
+func TestParseIRInterpret(t *testing.T) {
+	text := `; 1 2 3 * +
+%v1 = mov 1
+%v2 = mov 2
+%v3 = mov 3
+%v4 = mul %v2, %v3   ; 6
+%ret = add %v1, %v4
+ret
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ir.registersLength != 5 {
+		t.Errorf("Expected 5 registers, got %d", ir.registersLength)
+	}
+	result := Interpret(ir)
+	if result != 7 {
+		t.Errorf("Expected 7, got %d", result)
+	}
+}
+
+func TestParseIRConstantReferences(t *testing.T) {
+	text := `.constants 5, 5
+%v1 = mov #1
+%ret = add %v1, [%v1 + #0]
+`
+	_, err := ParseIR(strings.NewReader(text))
+	if err == nil {
+		t.Fatalf("Expected an error for an address operand to add")
+	}
+
+	text = `.constants 5, 5
+%v1 = mov #1
+%ret = add %v1, 5
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ir.instructions[0].arg2.value != 1 {
+		t.Errorf("Expected constant #1, got #%d", ir.instructions[0].arg2.value)
+	}
+	if ir.instructions[1].arg2.value != 0 {
+		t.Errorf("Expected constant #0, got #%d", ir.instructions[1].arg2.value)
+	}
+}
+
+func TestParseIRErrors(t *testing.T) {
+	cases := []struct {
+		text   string
+		line   int
+		column int
+	}{
+		{"%v1 = mov 1\n%v2 = frob %v1, 1\n", 2, 7},
+		{"%v1 = mov 1\n  %v2 = add %v1\n", 2, 16},
+		{"%v1 = mov 1\nstore %v1, %sp\n", 2, 12},
+		{"ret %v1\n", 1, 5},
+		{"%v1 = mov #3\n", 1, 1},
+		{".registers 2\n%v1 = mov 1\n%v2 = mov 1\n", 3, 1},
+		{".frobnicate\n", 1, 1},
+		{"add %v1, %v2, 3\n", 1, 1},
+		{"%q1 = mov 1\n", 1, 1},
+		{"%a-1 = mov 1\n", 1, 1},
+		{"loop:\nloop:\n", 2, 1},
+		{"%v1 = mov 1\n  br %v1, missing\nmissing2:\n", 2, 11},
+	}
+	for _, c := range cases {
+		_, err := ParseIR(strings.NewReader(c.text))
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError for %q, got %v", c.text, err)
+			continue
+		}
+		if parseErr.Line != c.line || parseErr.Column != c.column {
+			t.Errorf("Expected error at %d:%d for %q, got %s", c.line, c.column, c.text, parseErr)
+		}
+	}
+}
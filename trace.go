@@ -0,0 +1,113 @@
+////////////////////////////////////////////////////////////////////////////////
+// Interpreter tracing. ////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////
+
+package navm
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// Receives events from the interpreter. ir and index identify the
+// instruction being executed; ir.PrintInstruction(index) gives its text.
+type Tracer interface {
+	BeforeInstruction(ir *IR, index int)
+	// Called once the instruction has finished. For a call that is as soon as
+	// the callee's frame is pushed, and for ret once the frame is popped.
+	AfterInstruction(ir *IR, index int)
+	RegisterWrite(ir *IR, r Register, old int, value int)
+	MemoryRead(ir *IR, addr int, size int, value int)
+	MemoryWrite(ir *IR, addr int, size int, value int)
+}
+
+// Settings for InterpretWithOptions. The zero value interprets silently.
+type InterpretOptions struct {
+	Tracer Tracer // nil disables tracing
+	Fuel   int    // the most instructions to run, or 0 for no limit
+	Memory MemoryLayout
+	// Byte order of loads and stores. Interpreting for an Architecture uses
+	// its byte order instead.
+	Endianness Endianness
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Text
+
+type textTracer struct {
+	w io.Writer
+}
+
+// Writes one human readable line per event, e.g.
+//
+//	main:1 %v2 = add %v1, 2
+//	  %v2 = 7 (was 0)
+func NewTextTracer(w io.Writer) Tracer {
+	return &textTracer{w: w}
+}
+
+func (t *textTracer) BeforeInstruction(ir *IR, index int) {
+	io.WriteString(t.w, ir.Name()+":"+strconv.Itoa(index)+" "+ir.PrintInstruction(index)+"\n")
+}
+
+func (t *textTracer) AfterInstruction(ir *IR, index int) {
+}
+
+func (t *textTracer) RegisterWrite(ir *IR, r Register, old int, value int) {
+	io.WriteString(t.w, "  "+printRegister(r)+" = "+strconv.Itoa(value)+" (was "+strconv.Itoa(old)+")\n")
+}
+
+func (t *textTracer) MemoryRead(ir *IR, addr int, size int, value int) {
+	io.WriteString(t.w, "  read "+strconv.Itoa(value)+" from ["+strconv.Itoa(addr)+"], "+strconv.Itoa(size)+" bytes\n")
+}
+
+func (t *textTracer) MemoryWrite(ir *IR, addr int, size int, value int) {
+	io.WriteString(t.w, "  write "+strconv.Itoa(value)+" to ["+strconv.Itoa(addr)+"], "+strconv.Itoa(size)+" bytes\n")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// JSON lines
+
+type jsonTracer struct {
+	enc *json.Encoder
+}
+
+// One event per line of JSON, as written by the JSON lines tracer. Fields that
+// do not apply to an event are omitted.
+type TraceEvent struct {
+	Event       string `json:"event"` // before, after, register, read or write
+	Function    string `json:"function"`
+	Index       *int   `json:"index,omitempty"`
+	Instruction string `json:"instruction,omitempty"`
+	Register    string `json:"register,omitempty"`
+	Old         *int   `json:"old,omitempty"`
+	Address     *int   `json:"address,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	Value       *int   `json:"value,omitempty"`
+}
+
+// Writes each event as a TraceEvent on its own line
+func NewJSONTracer(w io.Writer) Tracer {
+	return &jsonTracer{enc: json.NewEncoder(w)}
+}
+
+func (t *jsonTracer) BeforeInstruction(ir *IR, index int) {
+	t.enc.Encode(TraceEvent{Event: "before", Function: ir.Name(), Index: &index, Instruction: ir.PrintInstruction(index)})
+}
+
+func (t *jsonTracer) AfterInstruction(ir *IR, index int) {
+	t.enc.Encode(TraceEvent{Event: "after", Function: ir.Name(), Index: &index})
+}
+
+func (t *jsonTracer) RegisterWrite(ir *IR, r Register, old int, value int) {
+	t.enc.Encode(TraceEvent{Event: "register", Function: ir.Name(), Register: printRegister(r), Old: &old, Value: &value})
+}
+
+func (t *jsonTracer) MemoryRead(ir *IR, addr int, size int, value int) {
+	t.enc.Encode(TraceEvent{Event: "read", Function: ir.Name(), Address: &addr, Size: size, Value: &value})
+}
+
+func (t *jsonTracer) MemoryWrite(ir *IR, addr int, size int, value int) {
+	t.enc.Encode(TraceEvent{Event: "write", Function: ir.Name(), Address: &addr, Size: size, Value: &value})
+}
@@ -0,0 +1,101 @@
+package navm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+const traceProgram = `.constants 5, 16
+%v1 = mov 5
+store %v1, [%v1 + 16]
+%ret = load [%v1 + 16]
+ret
+`
+
+func TestTextTracer(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(traceProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var out bytes.Buffer
+	result, err := InterpretWithOptions(ir, InterpretOptions{Tracer: NewTextTracer(&out)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != 5 {
+		t.Errorf("Expected 5, got %d", result)
+	}
+	expected := `main:0 %v1 = mov 5
+  %v1 = 5 (was 0)
+main:1 store %v1, [%v1 + 16]
+  write 5 to [21], 8 bytes
+main:2 %ret = load [%v1 + 16]
+  read 5 from [21], 8 bytes
+  %ret = 5 (was 0)
+main:3 ret
+`
+	if out.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestJSONTracer(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var out bytes.Buffer
+	result, err := InterpretModuleWithOptions(m, "fact", InterpretOptions{Tracer: NewJSONTracer(&out)}, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != 6 {
+		t.Errorf("Expected 6, got %d", result)
+	}
+	before, after := 0, 0
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var e TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid JSON line %q: %s", scanner.Text(), err)
+		}
+		if e.Function != "fact" {
+			t.Errorf("Expected function fact, got %s", e.Function)
+		}
+		switch e.Event {
+		case "before":
+			before++
+			if e.Index == nil || e.Instruction == "" {
+				t.Errorf("Expected an index and instruction in %q", scanner.Text())
+			}
+		case "after":
+			after++
+		case "register", "read", "write":
+		default:
+			t.Errorf("Unknown event %s", e.Event)
+		}
+	}
+	if before == 0 || before != after {
+		t.Errorf("Expected matching before and after events, got %d and %d", before, after)
+	}
+}
+
+func TestNoTracerByDefault(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(traceProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := InterpretWithOptions(ir, InterpretOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != 5 {
+		t.Errorf("Expected 5, got %d", result)
+	}
+}
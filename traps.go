@@ -0,0 +1,102 @@
+////////////////////////////////////////////////////////////////////////////////
+// What division does with a zero divisor, or when dividing the most negative //
+// value by -1 overflows. /////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////
+
+package navm
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Hardware disagrees about these faults: x86-64 raises an exception for both,
+// while arm64 returns 0 for a zero divisor and wraps on overflow. A policy
+// makes the IR mean the same thing everywhere, and the generators emit checks
+// where the target differs from it. Only the signed quotient overflows; srem
+// of the most negative value by -1 is 0 under every policy.
+type TrapPolicy int
+
+const (
+	// Use the function's policy. Functions default to TrapFaults.
+	DefaultTraps TrapPolicy = iota
+	// Stop the program. The interpreter returns ErrDivideByZero or
+	// ErrIntegerOverflow, and compiled code executes a trap instruction.
+	TrapFaults TrapPolicy = iota
+	// A zero divisor gives a quotient of 0 and a remainder of the dividend,
+	// as on arm64. Overflow wraps to the most negative value.
+	WrapFaults TrapPolicy = iota
+	// The program promises the faults never happen, so no checks are
+	// emitted and compiled code does whatever the hardware does. The
+	// interpreter reports them as errors, like TrapFaults.
+	UndefinedFaults TrapPolicy = iota
+)
+
+var trapPolicyNames = []string{
+	DefaultTraps:    "",
+	TrapFaults:      "trap",
+	WrapFaults:      "wrap",
+	UndefinedFaults: "undefined",
+}
+
+func (p TrapPolicy) String() string {
+	if !p.valid() || p == DefaultTraps {
+		return "traps" + strconv.Itoa(int(p))
+	}
+	return trapPolicyNames[p]
+}
+
+func trapPolicyFromName(name string) (TrapPolicy, bool) {
+	for p, n := range trapPolicyNames {
+		if n != "" && n == name {
+			return TrapPolicy(p), true
+		}
+	}
+	return DefaultTraps, false
+}
+
+func (p TrapPolicy) valid() bool {
+	return p >= DefaultTraps && int(p) < len(trapPolicyNames)
+}
+
+// Sets the policy of every division in the function that does not override it
+func (ir *IR) SetTrapPolicy(p TrapPolicy) {
+	if !p.valid() {
+		panic("Unknown trap policy: " + strconv.Itoa(int(p)))
+	}
+	ir.traps = p
+}
+
+// The function's policy, never DefaultTraps
+func (ir *IR) TrapPolicy() TrapPolicy {
+	if ir.traps == DefaultTraps {
+		return TrapFaults
+	}
+	return ir.traps
+}
+
+// Overrides the function's policy for the last instruction added. Returns
+// ErrInvalidOperand if it is not a division.
+func (ir *IR) OverrideTrapPolicy(p TrapPolicy) error {
+	if !p.valid() {
+		return fmt.Errorf("%w: unknown trap policy %d", ErrInvalidOperand, int(p))
+	}
+	if len(ir.instructions) == 0 || !ir.instructions[len(ir.instructions)-1].op.isDivision() {
+		return fmt.Errorf("%w: trap policy for an instruction that is not a division", ErrInvalidOperand)
+	}
+	ir.instructions[len(ir.instructions)-1].traps = p
+	return nil
+}
+
+// The policy that applies to the instruction
+func (ir *IR) trapPolicy(instr Instruction) TrapPolicy {
+	if instr.traps != DefaultTraps {
+		return instr.traps
+	}
+	return ir.TrapPolicy()
+}
+
+// Whether the quotient of a signed division overflows the type
+func divisionOverflows(t Type, dividend int, divisor int) bool {
+	return t.wrap(divisor) == -1 && t.wrap(dividend) == t.minimum()
+}
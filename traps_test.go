@@ -0,0 +1,168 @@
+package navm
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+func TestTrapPolicies(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected int
+		err      error
+	}{
+		{"%v1 = mov 7\n%ret = div %v1, 0\nret\n", 0, ErrDivideByZero},
+		{"%v1 = mov -9223372036854775808\n%ret = div %v1, -1\nret\n", 0, ErrIntegerOverflow},
+		{".types %v1 i8\n%v1 = mov -128\n%v1 = div %v1, -1\n%ret = sext8 %v1\nret\n", 0, ErrIntegerOverflow},
+		{".types %v1 i32\n%v1 = mov -2147483648\n%v1 = div %v1, -1\n%ret = sext32 %v1\nret\n", 0, ErrIntegerOverflow},
+		// Only the quotient overflows
+		{"%v1 = mov -9223372036854775808\n%ret = srem %v1, -1\nret\n", 0, nil},
+		{".types %v1 i16\n%v1 = mov -32768\n%v1 = div %v1, 1\n%ret = sext16 %v1\nret\n", -32768, nil},
+		{".traps undefined\n%v1 = mov 7\n%ret = urem %v1, 0\nret\n", 0, ErrDivideByZero},
+		{".traps undefined\n%v1 = mov -9223372036854775808\n%ret = div %v1, -1\nret\n", 0, ErrIntegerOverflow},
+		{".traps wrap\n%v1 = mov 7\n%ret = div %v1, 0\nret\n", 0, nil},
+		{".traps wrap\n%v1 = mov 7\n%ret = udiv %v1, 0\nret\n", 0, nil},
+		{".traps wrap\n%v1 = mov -7\n%ret = srem %v1, 0\nret\n", -7, nil},
+		{".traps wrap\n%v1 = mov -7\n%ret = urem %v1, 0\nret\n", -7, nil},
+		{".traps wrap\n%v1 = mov -9223372036854775808\n%ret = div %v1, -1\nret\n", math.MinInt64, nil},
+		{".types %v1 i8\n.traps wrap\n%v1 = mov -128\n%v1 = div %v1, -1\n%ret = sext8 %v1\nret\n", -128, nil},
+		// An instruction's policy overrides the function's
+		{".traps wrap\n%v1 = mov 7\n%ret = div.trap %v1, 0\nret\n", 0, ErrDivideByZero},
+		{"%v1 = mov 7\n%ret = srem.wrap %v1, 0\nret\n", 7, nil},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(c.text))
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", c.text, err)
+		}
+		for _, target := range []string{"", AARCH64_MACOS_NONE, X64_WIN_GNU} {
+			var result int
+			if target == "" {
+				result, err = InterpretE(ir)
+			} else {
+				result, err = InterpretForArchitecture(ir, target, InterpretOptions{})
+			}
+			if c.err != nil {
+				if !errors.Is(err, c.err) {
+					t.Errorf("Expected %v for %q on %q, got %v", c.err, c.text, target, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error for %q on %q: %s", c.text, target, err)
+			}
+			if result != c.expected {
+				t.Errorf("Expected %d for %q on %q, got %d", c.expected, c.text, target, result)
+			}
+		}
+	}
+}
+
+func TestTrapPolicyText(t *testing.T) {
+	text := ".registers 3\n.traps wrap\n.constants 7\n  %v1 = mov 7\n  %v2 = div.trap %v1, %v1\n  %ret = urem %v1, %v2\n  ret\n"
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ir.TrapPolicy() != WrapFaults {
+		t.Errorf("Expected wrap, got %s", ir.TrapPolicy())
+	}
+	if ir.Print() != text {
+		t.Errorf("Expected\n%s\ngot\n%s", text, ir.Print())
+	}
+	if NewIR().TrapPolicy() != TrapFaults {
+		t.Errorf("Expected trap, got %s", NewIR().TrapPolicy())
+	}
+
+	// Lowering adds the type before the policy
+	ir, err = ParseIR(strings.NewReader(".types %v1 i32\n%v1 = mov 7\n%v1 = srem.undefined %v1, %v1\n%ret = sext32 %v1\nret\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	lowered, err := Lower(ir, AARCH64_MACOS_NONE)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(lowered.Print(), "srem.i32.undefined") {
+		t.Errorf("Expected srem.i32.undefined, got\n%s", lowered.Print())
+	}
+	reparsed, err := ParseIR(strings.NewReader(lowered.Print()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if reparsed.Print() != lowered.Print() {
+		t.Errorf("Expected\n%s\ngot\n%s", lowered.Print(), reparsed.Print())
+	}
+
+	errorCases := []struct {
+		text   string
+		column int
+	}{
+		{"%v1 = add.wrap %v1, 1\n", 11},
+		{"%v1 = div.often %v1, 1\n", 11},
+		{"%v1 = div.wrap.trap %v1, 1\n", 16},
+		{"%v1 = div.wrap.i32 %v1, 1\n", 16},
+		{".traps often\n", 8},
+		{".traps wrap\n.traps trap\n", 1},
+	}
+	for _, c := range errorCases {
+		_, err := ParseIR(strings.NewReader(c.text))
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Expected a ParseError for %q, got %v", c.text, err)
+			continue
+		}
+		if parseErr.Column != c.column {
+			t.Errorf("Expected column %d for %q, got %s", c.column, c.text, parseErr)
+		}
+	}
+}
+
+func TestOverrideTrapPolicy(t *testing.T) {
+	ir := NewIR()
+	a := ir.NewVirtualRegister()
+	ir.MoveConstant(a, 7)
+	if err := ir.OverrideTrapPolicy(WrapFaults); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+	ir.UremRegisters(GetReturnRegister(), a, a)
+	ir.DivRegisters(a, a, a)
+	if err := ir.OverrideTrapPolicy(TrapPolicy(9)); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+	if err := ir.OverrideTrapPolicy(UndefinedFaults); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ir.Return()
+	if ir.PrintInstruction(2) != "%v1 = div.undefined %v1, %v1" {
+		t.Errorf("Expected div.undefined, got %s", ir.PrintInstruction(2))
+	}
+	ir.SetTrapPolicy(WrapFaults)
+	if ir.TrapPolicy() != WrapFaults {
+		t.Errorf("Expected wrap, got %s", ir.TrapPolicy())
+	}
+}
+
+func TestMarshalTrapPolicies(t *testing.T) {
+	text := ".registers 3\n.traps undefined\n.constants 7\n  %v1 = mov 7\n  %v2 = udiv.wrap %v1, %v1\n  %ret = div %v1, %v2\n  ret\n"
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, err := ir.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	decoded := &IR{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if decoded.Print() != text {
+		t.Errorf("Expected\n%s\ngot\n%s", text, decoded.Print())
+	}
+}
@@ -0,0 +1,309 @@
+////////////////////////////////////////////////////////////////////////////////
+// Value types and the type checker. ///////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////
+
+package navm
+
+import (
+	"strconv"
+)
+
+// Every virtual register holds one of these. Narrow integer types wrap around,
+// and are kept sign extended to 64 bits by the interpreter. Floats are IEEE
+// 754, held as their bit pattern.
+type Type int
+
+// Type values are part of the binary encoding, so new types must only ever be
+// appended
+const (
+	noType Type = iota // treated as I64
+	I64    Type = iota
+	I8     Type = iota
+	I16    Type = iota
+	I32    Type = iota
+	F32    Type = iota
+	F64    Type = iota
+)
+
+var typeNames = []string{
+	noType: "",
+	I64:    "i64",
+	I8:     "i8",
+	I16:    "i16",
+	I32:    "i32",
+	F32:    "f32",
+	F64:    "f64",
+}
+
+func (t Type) String() string {
+	if !t.valid() || t == noType {
+		return "type" + strconv.Itoa(int(t))
+	}
+	return typeNames[t]
+}
+
+func typeFromName(name string) (Type, bool) {
+	for t, n := range typeNames {
+		if n != "" && n == name {
+			return Type(t), true
+		}
+	}
+	return noType, false
+}
+
+func (t Type) valid() bool {
+	return t >= noType && int(t) < len(typeNames)
+}
+
+func (t Type) IsFloat() bool {
+	return t == F32 || t == F64
+}
+
+// The width in bytes
+func (t Type) Size() int {
+	switch t {
+	case I8:
+		return 1
+	case I16:
+		return 2
+	case I32, F32:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// Truncates value to the type, sign extending the result. An f32 is zero
+// extended.
+func (t Type) wrap(value int) int {
+	if t == F32 {
+		return int(uint32(value))
+	}
+	shift := uint(64 - 8*t.Size())
+	return value << shift >> shift
+}
+
+// Shift counts are masked with this, as on arm64 and x86-64, which both
+// shift 32 bit and narrower registers modulo 32
+func (t Type) shiftMask() int {
+	if t.Size() == 8 {
+		return 63
+	}
+	return 31
+}
+
+// The most negative value of the type
+func (t Type) minimum() int {
+	return -1 << uint(8*t.Size()-1)
+}
+
+// The low bits of value, zero extended
+func (t Type) unsigned(value int) uint64 {
+	shift := uint(64 - 8*t.Size())
+	return uint64(value) << shift >> shift
+}
+
+// Whether the constant can be written to a register of the type, either as a
+// signed or an unsigned number. For floats the constant is the bit pattern.
+func (t Type) fits(c int) bool {
+	if t.Size() == 8 {
+		return true
+	}
+	bits := uint(8 * t.Size())
+	return c >= -(1<<(bits-1)) && c < 1<<bits
+}
+
+// The width an instruction operates at: that of its operands for comparisons,
+// stores and branches, and of its result otherwise. Instructions without a
+// value, like ret and jmp, have no type.
+func instructionType(ir *IR, instr Instruction) Type {
+	switch instr.op.shape() {
+	case movShape, binaryShape, loadShape:
+		if instr.op.isComparison() {
+			return ir.TypeOf(instr.arg1)
+		}
+		return ir.TypeOf(instr.ret)
+	case storeShape, branchShape:
+		return ir.TypeOf(instr.arg1)
+	default:
+		return noType
+	}
+}
+
+// Records the type of every instruction operating on narrow values, before
+// register allocation replaces the virtual registers that carry the types.
+// Backends use it to pick sub-registers.
+func annotateTypes(ir *IR) {
+	for idx, instr := range ir.instructions {
+		if t := instructionType(ir, instr); t != noType && t != I64 {
+			ir.instructions[idx].typ = t
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Type checker, run as part of Verify
+
+func (v *verifier) checkTypes() {
+	ir := v.ir
+	if len(ir.types) > ir.registersLength {
+		v.errorf(-1, strconv.Itoa(len(ir.types))+" register types for "+strconv.Itoa(ir.registersLength)+" registers")
+	}
+	for r, t := range ir.types {
+		if !t.valid() {
+			v.errorf(-1, "register %v"+strconv.Itoa(r)+" has unknown type "+strconv.Itoa(int(t)))
+		}
+	}
+	// Arguments are passed in integer registers
+	for i := 0; i < ir.paramCount; i++ {
+		if t := ir.TypeOf(ir.Parameter(i)); t.IsFloat() {
+			v.errorf(-1, "parameter "+strconv.Itoa(i)+" is "+t.String()+", but floats cannot be passed to functions")
+		}
+	}
+	for idx, instr := range ir.instructions {
+		if instr.op <= noOp || int(instr.op) >= len(opNames) {
+			continue
+		}
+		name := instr.op.String()
+		if !instr.typ.valid() {
+			v.errorf(idx, name+" has unknown type "+strconv.Itoa(int(instr.typ)))
+		} else if want := instructionType(ir, instr); instr.typ != noType && (instr.typ.Size() != want.Size() || instr.typ.IsFloat() != want.IsFloat()) {
+			v.errorf(idx, name+" is marked "+instr.typ.String()+" but operates on "+want.String())
+		}
+		if instr.arg2.argType == address && ir.TypeOf(instr.arg2.register()) != I64 {
+			v.errorf(idx, "address register of "+name+" must be i64, got "+ir.TypeOf(instr.arg2.register()).String())
+		}
+		if instr.op != mov && !instr.op.takesFloats() {
+			if t := v.floatOperand(instr); t != noType {
+				v.errorf(idx, name+" does not take "+t.String()+" operands")
+				continue
+			}
+		}
+
+		switch {
+		case instr.op.isFloatArithmetic():
+			if t := ir.TypeOf(instr.ret); !t.IsFloat() {
+				v.errorf(idx, name+" takes f32 or f64 operands, got "+t.String())
+			} else if u := ir.TypeOf(instr.arg1); t != u {
+				v.errorf(idx, name+" of "+u.String()+" into "+t.String())
+			}
+			v.checkOperand(idx, name, ir.TypeOf(instr.ret), instr.arg2)
+		case instr.op.floatAccess() != noType:
+			r := instr.ret
+			if instr.op.shape() == storeShape {
+				r = instr.arg1
+			}
+			if want, got := instr.op.floatAccess(), ir.TypeOf(r); want != got {
+				v.errorf(idx, name+" moves "+want.String()+", not "+got.String())
+			}
+		case instr.op.takesFloats():
+			from, to, _ := instr.op.floatConversion()
+			if got := ir.TypeOf(instr.arg2.register()); instr.arg2.argType == registerArg && got != from {
+				v.errorf(idx, name+" converts from "+from.String()+", not "+got.String())
+			}
+			if got := ir.TypeOf(instr.ret); got != to {
+				v.errorf(idx, name+" converts to "+to.String()+", not "+got.String())
+			}
+		case instr.op == mov || instr.op.isUnary():
+			v.checkOperand(idx, name, ir.TypeOf(instr.ret), instr.arg2)
+		case instr.op.isComparison():
+			v.checkOperand(idx, name, ir.TypeOf(instr.arg1), instr.arg2)
+		case instr.op.shape() == binaryShape:
+			if t, u := ir.TypeOf(instr.ret), ir.TypeOf(instr.arg1); t != u {
+				v.errorf(idx, name+" of "+u.String()+" into "+t.String())
+			}
+			v.checkOperand(idx, name, ir.TypeOf(instr.ret), instr.arg2)
+			if instr.op.isShift() {
+				v.checkShiftCount(idx, instr)
+			}
+		case instr.op.shape() == loadShape:
+			if size, _ := instr.op.memoryAccess(); size > ir.TypeOf(instr.ret).Size() {
+				v.errorf(idx, name+" of "+strconv.Itoa(size)+" bytes into "+ir.TypeOf(instr.ret).String())
+			}
+		case instr.op.shape() == storeShape:
+			if size, _ := instr.op.memoryAccess(); size > ir.TypeOf(instr.arg1).Size() {
+				v.errorf(idx, name+" of "+strconv.Itoa(size)+" bytes from "+ir.TypeOf(instr.arg1).String())
+			}
+		case instr.op.isConversion():
+			v.checkConversion(idx, instr)
+		case instr.op == call:
+			if instr.ret.registerType != noRegisterType && ir.TypeOf(instr.ret) != I64 {
+				v.errorf(idx, "call returns i64, not "+ir.TypeOf(instr.ret).String())
+			}
+		}
+	}
+}
+
+// The type of the first float register an instruction uses, or noType
+func (v *verifier) floatOperand(instr Instruction) Type {
+	registers := append([]Register{instr.ret, instr.arg1}, instr.args...)
+	if instr.arg2.argType == registerArg {
+		registers = append(registers, instr.arg2.register())
+	}
+	for _, r := range registers {
+		if t := v.ir.TypeOf(r); t.IsFloat() {
+			return t
+		}
+	}
+	return noType
+}
+
+// A register operand must match the type exactly, and a constant must fit
+func (v *verifier) checkOperand(idx int, name string, t Type, arg Arg) {
+	switch arg.argType {
+	case registerArg:
+		if u := v.ir.TypeOf(arg.register()); u != t {
+			v.errorf(idx, name+" operands have types "+t.String()+" and "+u.String())
+		}
+	case constant:
+		if arg.value >= 0 && arg.value < len(v.ir.constants) && !t.fits(v.ir.constants[arg.value]) {
+			v.errorf(idx, "constant "+strconv.Itoa(v.ir.constants[arg.value])+" does not fit in "+t.String())
+		}
+	}
+}
+
+// Constant shift counts are written as the count the hardware uses, so must
+// be below the modulus of the type
+func (v *verifier) checkShiftCount(idx int, instr Instruction) {
+	if instr.arg2.argType != constant || instr.arg2.value < 0 || instr.arg2.value >= len(v.ir.constants) {
+		return
+	}
+	t := v.ir.TypeOf(instr.ret)
+	if c := v.ir.constants[instr.arg2.value]; c < 0 || c > t.shiftMask() {
+		v.errorf(idx, "shift count "+strconv.Itoa(c)+" is out of range for "+t.String()+", must be 0 to "+strconv.Itoa(t.shiftMask()))
+	}
+}
+
+// Extensions widen from exactly the width named by the op, and trunc narrows
+func (v *verifier) checkConversion(idx int, instr Instruction) {
+	if instr.arg2.argType != registerArg {
+		return
+	}
+	name := instr.op.String()
+	from := v.ir.TypeOf(instr.arg2.register())
+	to := v.ir.TypeOf(instr.ret)
+	if instr.op == trunc {
+		if to.Size() >= from.Size() {
+			v.errorf(idx, name+" from "+from.String()+" to "+to.String()+" does not narrow")
+		}
+		return
+	}
+	if size := instr.op.conversionSize(); from.Size() != size {
+		v.errorf(idx, name+" expects a "+strconv.Itoa(8*size)+" bit operand, got "+from.String())
+	}
+	if to.Size() <= from.Size() {
+		v.errorf(idx, name+" from "+from.String()+" to "+to.String()+" does not widen")
+	}
+}
+
+// Calls pass arguments of the types the callee's parameters have
+func checkCallTypes(v *verifier, idx int, instr Instruction, callee *IR) {
+	for i, a := range instr.args {
+		if i >= callee.paramCount {
+			break
+		}
+		if want, got := callee.TypeOf(callee.Parameter(i)), v.ir.TypeOf(a); want != got {
+			v.errorf(idx, "argument "+strconv.Itoa(i)+" to "+callee.Name()+" is "+got.String()+", expected "+want.String())
+		}
+	}
+}
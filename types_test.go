@@ -0,0 +1,288 @@
+package navm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+// 100 + 100 wraps in an i8, then is sign and zero extended back to i64
+const typedProgram = `.registers 6
+.types %v1 i8, %v2 i8, %v3 i32, %v4 i16
+.constants 100, 0
+  %v1 = mov 100
+  %v2 = add %v1, %v1
+  %v3 = sext8 %v2
+  %v4 = zext8 %v2
+  %v5 = sext16 %v4
+  %v1 = trunc %v3
+  %v3 = mul %v3, %v3
+  %ret = sext32 %v3
+  ret
+`
+
+func TestTypedRegisters(t *testing.T) {
+	ir, err := ParseIR(strings.NewReader(typedProgram))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ir.Print() != typedProgram {
+		t.Errorf("Expected\n%s\ngot\n%s", typedProgram, ir.Print())
+	}
+	if errs := Verify(ir); errs != nil {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	d, err := NewDebugger(ir, InterpretOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for d.Location().Index < 6 {
+		d.Step()
+	}
+	expected := []int{0, -56, -56, -56, 200, 200}
+	registers := d.Registers()
+	for r := 1; r < len(expected); r++ {
+		if registers[r] != expected[r] {
+			t.Errorf("Expected %%v%d = %d, got %d", r, expected[r], registers[r])
+		}
+	}
+	d.Continue()
+	if d.Result() != 3136 {
+		t.Errorf("Expected 3136, got %d", d.Result())
+	}
+}
+
+func TestTypedRegistersForArchitecture(t *testing.T) {
+	// 65536 * 65536 is 0 in an i32
+	text := `.types %v1 i32, %v2 i32
+  %v1 = mov 65536
+  %v2 = mul %v1, %v1
+  %v2 = sub %v2, 1
+  %ret = zext32 %v2
+  ret
+`
+	for _, target := range []string{AARCH64_MACOS_NONE, X64_WIN_GNU} {
+		ir, err := ParseIR(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := InterpretForArchitecture(ir, target, InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if result != 0xffffffff {
+			t.Errorf("Expected %#x for %s, got %#x", 0xffffffff, target, result)
+		}
+		lowered, err := Lower(ir, target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !strings.Contains(lowered.Print(), " = mul.i32 ") {
+			t.Errorf("Expected a mul.i32 for %s, got\n%s", target, lowered.Print())
+		}
+	}
+}
+
+func TestCompareUnsignedConstant(t *testing.T) {
+	// 200 and 201 only fit an i8 unsigned, so compare as -56 and -55
+	text := `.types %v1 i8
+  %v1 = mov 200
+  %ret = eq %v1, 200
+  %v2 = ult %v1, 201
+  %ret = add %ret, %v2
+  ret
+`
+	ir, err := ParseIR(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	result, err := InterpretE(ir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result != 2 {
+		t.Errorf("Expected 2, got %d", result)
+	}
+	for target, expected := range map[string]string{
+		AARCH64_MACOS_NONE: "  cmp W11, #-56\n",
+		AARCH64_LINUX_GNU:  "  cmp W11, #-56\n",
+		X64_WIN_GNU:        "  cmp R12B, -56\n",
+		X64_LINUX_GNU:      "  cmp $-56, %r12b\n",
+		RISCV64_LINUX_MUSL: "  li t6, -56\n",
+	} {
+		ir, err := ParseIR(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := InterpretForArchitecture(ir, target, InterpretOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", target, err)
+		}
+		if result != 2 {
+			t.Errorf("Expected 2 for %s, got %d", target, result)
+		}
+		xrn, err := CompileE(ir, target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !strings.Contains(xrn, expected) {
+			t.Errorf("Expected %q for %s, got\n%s", expected, target, xrn)
+		}
+	}
+}
+
+func TestTypedBuilders(t *testing.T) {
+	ir := NewFunction("f", 1)
+	ir.SetType(ir.Parameter(0), I16)
+	r1 := ir.NewTypedRegister(I32)
+	if ir.TypeOf(r1) != I32 || ir.TypeOf(ir.Parameter(0)) != I16 || ir.TypeOf(GetReturnRegister()) != I64 {
+		t.Errorf("Expected i32, i16 and i64, got %s, %s and %s", ir.TypeOf(r1), ir.TypeOf(ir.Parameter(0)), ir.TypeOf(GetReturnRegister()))
+	}
+	if err := ir.SignExtend(r1, ir.Parameter(0)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := ir.ZeroExtend(GetReturnRegister(), r1); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := ir.SignExtend(r1, GetReturnRegister()); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand extending an i64, got %v", err)
+	}
+	if err := ir.Truncate(GetReturnRegister(), r1); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand truncating to a wider type, got %v", err)
+	}
+	ir.Return()
+	if ir.instructions[0].op != sext16 || ir.instructions[1].op != zext32 {
+		t.Errorf("Expected sext16 and zext32, got %s and %s", ir.instructions[0].op, ir.instructions[1].op)
+	}
+	m := NewModule()
+	m.AddFunction(ir)
+	result, err := InterpretModuleE(m, "f", 0x18000)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The argument wraps to the i16 -32768
+	if result != 0xffff8000 {
+		t.Errorf("Expected %#x, got %#x", 0xffff8000, result)
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	cases := []struct {
+		text string
+		msg  string
+	}{
+		{".types %v1 i32\n%v2 = mov 1\n%v1 = add %v1, %v2\n", "operands have types i32 and i64"},
+		{".types %v1 i32\n%v2 = mov 1\n%v2 = add %v1, 1\n", "add of i32 into i64"},
+		{".types %v1 i8\n%v1 = mov 256\n", "constant 256 does not fit in i8"},
+		{".types %v1 i8\n%v1 = mov -129\n", "constant -129 does not fit in i8"},
+		{".types %v1 i32\n%v2 = mov 1\n%v3 = lt %v1, %v2\n", "lt operands have types i32 and i64"},
+		{".types %v1 i32\n%v1 = load [%sp + 0]\n", "load of 8 bytes into i32"},
+		{".types %v1 i16\nstore32 %v1, [%sp + 0]\n", "store32 of 4 bytes from i16"},
+		{".types %v1 i32\n%v2 = load8u [%v1 + 0]\n", "address register of load8u must be i64"},
+		{".types %v1 i16\n%v2 = sext8 %v1\n", "sext8 expects a 8 bit operand, got i16"},
+		{".types %v1 i16, %v2 i8\n%v2 = zext16 %v1\n", "does not widen"},
+		{".types %v1 i16, %v2 i32\n%v2 = trunc %v1\n", "does not narrow"},
+		{"%v1 = sext8 5\n", "arg2 of sext8 must be a register"},
+		{".types %v1 i16\n%v1 = add.i32 %v1, 1\n", "add is marked i32 but operates on i16"},
+		{".types %v1 i32\n%v1 = shl %v1, 32\n", "shift count 32 is out of range for i32, must be 0 to 31"},
+		{"%v1 = ashr %v1, -1\n", "shift count -1 is out of range for i64, must be 0 to 63"},
+		{".types %v1 i8\n%v2 = neg %v1\n", "neg operands have types i64 and i8"},
+		{"%v1 = not 5\n", "arg2 of not must be a register"},
+		{".types %v1 f64\n%v1 = xor %v1, %v1\n", "xor does not take f64 operands"},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(c.text))
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", c.text, err)
+		}
+		errs := Verify(ir)
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), c.msg) {
+			t.Errorf("Expected one error containing %q, got %v", c.msg, errs)
+		}
+	}
+
+	m, err := ParseModule(strings.NewReader(`.func main 0
+.types %v1 i32
+  %v1 = mov 1
+  %v2 = call @f(%v1)
+  ret
+.func f 1
+  %ret = mov %v1
+  ret
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	errs := VerifyModule(m)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "argument 0 to f is i32, expected i64") {
+		t.Errorf("Expected an argument type error, got %v", errs)
+	}
+	if _, err := CompileModuleE(m, X64_WIN_GNU); !errors.Is(err, ErrInvalidOperand) {
+		t.Errorf("Expected ErrInvalidOperand, got %v", err)
+	}
+}
+
+func TestParseTypeErrors(t *testing.T) {
+	cases := []struct {
+		text string
+		msg  string
+	}{
+		{".types %v1 i7\n", "1:12: unknown type \"i7\""},
+		{".types %sp i8\n", "1:8: only virtual registers have types"},
+		{".types %v1 i8\n.types %v2 i8\n", "2:1: duplicate .types directive"},
+		{".registers 2\n.types %v3 i8\n", "2:1: register %v3 exceeds .registers 2"},
+		{"%v1 = add.u32 %v1, 1\n", "1:11: unknown type \"u32\""},
+	}
+	for _, c := range cases {
+		_, err := ParseIR(strings.NewReader(c.text))
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("Expected %q, got %v", c.msg, err)
+		}
+	}
+}
+
+func TestCompileTypedRegisters(t *testing.T) {
+	cases := []struct {
+		target   string
+		expected []string
+	}{
+		{AARCH64_MACOS_NONE, []string{
+			"  mov W11, #100\n  sxtb W11, W11\n",
+			"  add W12, W11, W11\n  sxtb W12, W12\n",
+			"  sxtb W13, W12\n",
+			"  uxtb W14, W12\n",
+			"  sxth X15, W14\n",
+			"  sxtb W11, W13\n",
+			"  mul W13, W13, W13\n",
+			"  sxtw X0, W13\n",
+		}},
+		{X64_WIN_GNU, []string{
+			"  mov R12B, 100\n",
+			"  mov R13B, R12B\n  add R13B, R12B\n",
+			"  movsx R10D, R13B\n",
+			"  movzx R15W, R13B\n",
+			"  movsx R14, R15W\n",
+			"  mov R12B, R11B\n",
+			"  imul R10D, R11D\n",
+			"  movsxd RAX, R11D\n",
+		}},
+	}
+	for _, c := range cases {
+		ir, err := ParseIR(strings.NewReader(typedProgram))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		result, err := CompileE(ir, c.target)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, e := range c.expected {
+			if !strings.Contains(result, e) {
+				t.Errorf("Expected %q for %s, got\n%s", e, c.target, result)
+			}
+		}
+	}
+}
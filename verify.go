@@ -0,0 +1,202 @@
+package navm
+
+import (
+	"errors"
+	"strconv"
+)
+
+// A problem found by Verify, pointing at the offending instruction
+type VerifyError struct {
+	Function string
+	Index    int // index into the function's instructions, or -1
+	Msg      string
+}
+
+func (e VerifyError) Error() string {
+	if e.Index < 0 {
+		return e.Function + ": " + e.Msg
+	}
+	return e.Function + ": instruction " + strconv.Itoa(e.Index) + ": " + e.Msg
+}
+
+func (e VerifyError) Unwrap() error {
+	return ErrInvalidOperand
+}
+
+// Combines verification errors into a single error, or nil if there are none
+func joinVerifyErrors(errs []VerifyError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	joined := make([]error, len(errs))
+	for idx, e := range errs {
+		joined[idx] = e
+	}
+	return errors.Join(joined...)
+}
+
+// Checks that IR is well formed and well typed before register allocation, so
+// Interpret and Compile can rely on it. Returns every problem found, or nil.
+func Verify(ir *IR) []VerifyError {
+	v := verifier{ir: ir}
+	v.verify()
+	return v.errors
+}
+
+// Verifies every function, and that each call names a function in the
+// module with a matching parameter count
+func VerifyModule(m *Module) []VerifyError {
+	var errs []VerifyError
+	for _, ir := range m.functions {
+		v := verifier{ir: ir}
+		v.verify()
+		for idx, instr := range ir.instructions {
+			if instr.op != call || instr.arg2.argType != functionArg || instr.arg2.value < 0 || instr.arg2.value >= len(ir.functions) {
+				continue
+			}
+			name := ir.functions[instr.arg2.value]
+			callee := m.Function(name)
+			if callee == nil {
+				v.errorf(idx, "call to unknown function "+name)
+			} else if callee.paramCount != len(instr.args) {
+				v.errorf(idx, "call to "+name+" with "+strconv.Itoa(len(instr.args))+" arguments, expected "+strconv.Itoa(callee.paramCount))
+			} else {
+				checkCallTypes(&v, idx, instr, callee)
+			}
+		}
+		errs = append(errs, v.errors...)
+	}
+	return errs
+}
+
+type verifier struct {
+	ir     *IR
+	errors []VerifyError
+}
+
+func (v *verifier) errorf(idx int, msg string) {
+	v.errors = append(v.errors, VerifyError{Function: v.ir.Name(), Index: idx, Msg: msg})
+}
+
+func (v *verifier) verify() {
+	ir := v.ir
+	if ir.registersLength < ir.paramCount+1 {
+		v.errorf(-1, "register count "+strconv.Itoa(ir.registersLength)+" does not cover "+strconv.Itoa(ir.paramCount)+" parameters")
+	}
+	placed := make([]bool, len(ir.labels))
+	for idx, instr := range ir.instructions {
+		if instr.op == label && instr.arg2.argType == labelArg && v.validLabel(instr.arg2.value) {
+			if placed[instr.arg2.value] {
+				v.errorf(idx, "label "+ir.labels[instr.arg2.value]+" is placed more than once")
+			}
+			placed[instr.arg2.value] = true
+		}
+	}
+
+	for idx, instr := range ir.instructions {
+		if instr.op <= noOp || int(instr.op) >= len(opNames) {
+			v.errorf(idx, "unknown op "+strconv.Itoa(int(instr.op)))
+			continue
+		}
+		name := instr.op.String()
+		shape := instr.op.shape()
+
+		wantsRet := shape == movShape || shape == binaryShape || shape == loadShape
+		if wantsRet {
+			v.checkRegister(idx, "ret", instr.ret)
+		} else if instr.ret.registerType != noRegisterType && shape != callShape {
+			v.errorf(idx, name+" must not have a ret register")
+		}
+		if shape == binaryShape || shape == storeShape || shape == branchShape {
+			v.checkRegister(idx, "arg1", instr.arg1)
+		} else if instr.arg1.registerType != noRegisterType {
+			v.errorf(idx, name+" must not have an arg1 register")
+		}
+		if len(instr.args) > 0 && shape != callShape {
+			v.errorf(idx, name+" must not have call arguments")
+		}
+
+		switch shape {
+		case movShape, binaryShape:
+			_, _, floatConversion := instr.op.floatConversion()
+			if (instr.op.isConversion() || floatConversion || instr.op.isFloatArithmetic() || instr.op.isUnary()) && instr.arg2.argType != registerArg {
+				v.errorf(idx, "arg2 of "+name+" must be a register")
+			} else if instr.arg2.argType != constant && instr.arg2.argType != registerArg {
+				v.errorf(idx, "arg2 of "+name+" must be a constant or register")
+			}
+		case loadShape, storeShape:
+			if instr.arg2.argType != address {
+				v.errorf(idx, "arg2 of "+name+" must be an address")
+			}
+		case labelShape, jumpShape, branchShape:
+			if instr.arg2.argType != labelArg {
+				v.errorf(idx, "arg2 of "+name+" must be a label")
+			} else if !v.validLabel(instr.arg2.value) {
+				v.errorf(idx, "label "+strconv.Itoa(instr.arg2.value)+" out of range")
+			} else if !placed[instr.arg2.value] {
+				v.errorf(idx, "label "+ir.labels[instr.arg2.value]+" is never placed")
+			}
+		case callShape:
+			if instr.ret.registerType != noRegisterType {
+				v.checkRegister(idx, "ret", instr.ret)
+			}
+			for _, a := range instr.args {
+				v.checkRegister(idx, "call argument", a)
+			}
+			if instr.arg2.argType != functionArg {
+				v.errorf(idx, "arg2 of "+name+" must be a function")
+			} else if instr.arg2.value < 0 || instr.arg2.value >= len(ir.functions) {
+				v.errorf(idx, "function "+strconv.Itoa(instr.arg2.value)+" out of range")
+			}
+		case nullaryShape:
+			if instr.arg2.argType != noArgType {
+				v.errorf(idx, name+" must not have arg2")
+			}
+		}
+
+		switch instr.arg2.argType {
+		case constant:
+			v.checkConstant(idx, "arg2", instr.arg2.value)
+		case registerArg, stackArg:
+			v.checkRegister(idx, "arg2", instr.arg2.register())
+		case address:
+			v.checkRegister(idx, "address", instr.arg2.register())
+			v.checkConstant(idx, "address offset", instr.arg2.offsetConstant)
+		}
+	}
+	v.checkTypes()
+}
+
+func (v *verifier) validLabel(l int) bool {
+	return l >= 0 && l < len(v.ir.labels)
+}
+
+func (v *verifier) checkConstant(idx int, what string, c int) {
+	if c < 0 || c >= len(v.ir.constants) {
+		v.errorf(idx, what+" references constant "+strconv.Itoa(c)+", but there are only "+strconv.Itoa(len(v.ir.constants)))
+	}
+}
+
+// Before allocation only virtual registers, the return register and the
+// stack pointer may be used
+func (v *verifier) checkRegister(idx int, what string, r Register) {
+	switch r.registerType {
+	case noRegisterType:
+		v.errorf(idx, what+" register is missing")
+	case virtualRegister:
+		if r.value == RETURN_REGISTER {
+			return
+		}
+		if r.value <= 0 || r.value >= v.ir.registersLength {
+			v.errorf(idx, what+" register %v"+strconv.Itoa(r.value)+" out of range")
+		}
+	case physicalRegister:
+		if r.value != STACK_POINTER_REGISTER {
+			v.errorf(idx, what+" is a physical register before allocation")
+		}
+	case stackRegister:
+		v.errorf(idx, what+" is a stack slot before allocation")
+	default:
+		v.errorf(idx, what+" has unknown register type "+strconv.Itoa(int(r.registerType)))
+	}
+}
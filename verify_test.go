@@ -0,0 +1,92 @@
+package navm
+
+import (
+	"strings"
+	"testing"
+)
+
+func init() {
+}
+
+func TestVerifyValid(t *testing.T) {
+	m, err := ParseModule(strings.NewReader(factorialModule))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if errs := VerifyModule(m); errs != nil {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+
+	ir := NewIR()
+	r := ir.NewVirtualRegister()
+	ir.MoveConstant(r, 1)
+	ir.Store(r, GetStackPointer().ToAddress(ir.GetConstant(8)))
+	ir.Load(GetReturnRegister(), GetStackPointer().ToAddress(ir.GetConstant(8)))
+	ir.Return()
+	if errs := Verify(ir); errs != nil {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	cases := []struct {
+		xrn Instruction
+		msg string
+	}{
+		{Instruction{op: Op(100)}, "unknown op"},
+		{Instruction{op: mov, ret: MakeVirtualRegister(1), arg1: MakeVirtualRegister(1), arg2: MakeConstant(0)}, "mov must not have an arg1"},
+		{Instruction{op: mov, ret: MakeVirtualRegister(1), arg2: MakeConstant(5)}, "references constant 5"},
+		{Instruction{op: add, ret: MakeVirtualRegister(1), arg2: MakeConstant(0)}, "arg1 register is missing"},
+		{Instruction{op: add, ret: MakeVirtualRegister(3), arg1: MakeVirtualRegister(1), arg2: MakeConstant(0)}, "%v3 out of range"},
+		{Instruction{op: add, ret: MakeVirtualRegister(1), arg1: MakePhysicalRegister(1), arg2: MakeConstant(0)}, "physical register before allocation"},
+		{Instruction{op: sub, ret: MakeVirtualRegister(1), arg1: MakeVirtualRegister(1), arg2: MakeVirtualRegister(1).ToAddress(0)}, "constant or register"},
+		{Instruction{op: load, ret: MakeVirtualRegister(1), arg2: MakeVirtualRegister(1).ToArg()}, "must be an address"},
+		{Instruction{op: store, arg1: MakeVirtualRegister(1), arg2: MakeConstant(0)}, "must be an address"},
+		{Instruction{op: store, ret: MakeVirtualRegister(1), arg1: MakeVirtualRegister(1), arg2: MakeVirtualRegister(1).ToAddress(0)}, "must not have a ret"},
+		{Instruction{op: load, ret: MakeVirtualRegister(1), arg2: MakeVirtualRegister(1).ToAddress(7)}, "address offset references constant 7"},
+		{Instruction{op: mov, ret: Register{registerType: stackRegister, value: 1}, arg2: MakeConstant(0)}, "stack slot"},
+		{Instruction{op: jmp, arg2: Label{value: 4}.ToArg()}, "label 4 out of range"},
+		{Instruction{op: br, arg1: MakeVirtualRegister(1), arg2: MakeConstant(0)}, "must be a label"},
+		{Instruction{op: ret, arg2: MakeConstant(0)}, "ret must not have arg2"},
+		{Instruction{op: call, arg2: Arg{argType: functionArg, value: 2}}, "function 2 out of range"},
+	}
+	for _, c := range cases {
+		ir := NewIR()
+		ir.NewVirtualRegister()
+		ir.MoveConstant(MakeVirtualRegister(1), 1)
+		ir.AddInstruction(c.xrn)
+		ir.Return()
+		errs := Verify(ir)
+		if len(errs) != 1 {
+			t.Errorf("Expected one error containing %q, got %v", c.msg, errs)
+			continue
+		}
+		if errs[0].Index != 1 || !strings.Contains(errs[0].Error(), c.msg) {
+			t.Errorf("Expected error at instruction 1 containing %q, got %s", c.msg, errs[0])
+		}
+	}
+}
+
+func TestVerifyLabelsAndCalls(t *testing.T) {
+	ir := NewIR()
+	l := ir.NewLabel()
+	ir.Label(l)
+	ir.Label(l)
+	ir.Jump(ir.NewLabel())
+	errs := Verify(ir)
+	if len(errs) != 2 || errs[0].Index != 1 || errs[1].Index != 2 {
+		t.Errorf("Expected errors at instructions 1 and 2, got %v", errs)
+	}
+
+	m := NewModule()
+	f := m.NewFunction("f", 1)
+	f.Return()
+	main := m.NewFunction("main", 0)
+	main.Call(GetReturnRegister(), "f")
+	main.Call(GetReturnRegister(), "g")
+	main.Return()
+	errs = VerifyModule(m)
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "expected 1") || !strings.Contains(errs[1].Error(), "unknown function g") {
+		t.Errorf("Expected argument count and unknown function errors, got %v", errs)
+	}
+}
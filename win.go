@@ -2,11 +2,15 @@ package navm
 
 import (
 	"strconv"
+	"strings"
 )
 
+// Writes x86-64 for Windows and Linux, whose differences are in the
+// Architecture
 type WinGenerator struct {
-	arch *Architecture
-	ir   *IR
+	arch      *Architecture
+	ir        *IR
+	divisions int // checked so far, numbering their labels
 }
 
 func (g *WinGenerator) Init(a *Architecture, ir *IR) {
@@ -14,61 +18,596 @@ func (g *WinGenerator) Init(a *Architecture, ir *IR) {
 	g.ir = ir
 }
 
+func (g *WinGenerator) GetFileHeader() string {
+	switch g.arch.Dialect {
+	case GasIntelDialect:
+		return ".intel_syntax noprefix\n.text\n"
+	case GasAttDialect:
+		return ".text\n"
+	default:
+		return "section .text\n"
+	}
+}
+
+// Saves the callee-saved registers the function uses. Calls need the stack
+// 16 byte aligned, but it is 8 bytes off on entry because of the return
+// address, which an odd number of pushes fixes.
 func (g *WinGenerator) GetHeader() string {
-	return "section .text\n\tglobal main\n\nmain:\n"
+	header := g.getGlobal(g.ir.Name())
+	saved := g.GetSavedRegisters()
+	for _, r := range saved {
+		header += g.instruction("push", x64Reg(r))
+	}
+	if hasCalls(g.ir) && len(saved)%2 == 0 {
+		header += g.instruction("sub", x64Reg(g.arch.StackPointerRegister), x64Imm(8))
+	}
+	return header
 }
 
-// For now we just assume the last register assigned is the return register
+// Exports and starts the symbol name
+func (g *WinGenerator) getGlobal(name string) string {
+	if g.gas() {
+		return "\t.globl " + name + "\n\n" + name + ":\n"
+	}
+	return "\tglobal " + name + "\n\n" + name + ":\n"
+}
+
+// The stack is 16 byte aligned on entry to _start, so the call leaves it as
+// entry expects. RDI holds the exit status.
+func (g *WinGenerator) GetStart(entry string) string {
+	return g.getGlobal("_start") +
+		g.instruction("call", x64Label(entry)) +
+		g.instruction("mov", x64Reg("RDI"), x64Reg(g.arch.ReturnRegister)) +
+		g.instruction("mov", x64Reg("EAX"), x64Imm(g.arch.ExitSyscall)) +
+		g.instruction("syscall") + "\n"
+}
+
+// Undoes the prologue, dropping the padding that keeps calls aligned and
+// popping the callee-saved registers. The result is already in the ABI's
+// return register.
 func (g *WinGenerator) GetReturn() string {
-	return "  ret\n"
+	ret := ""
+	saved := g.GetSavedRegisters()
+	if hasCalls(g.ir) && len(saved)%2 == 0 {
+		ret += g.instruction("add", x64Reg(g.arch.StackPointerRegister), x64Imm(8))
+	}
+	for i := len(saved) - 1; i >= 0; i-- {
+		ret += g.instruction("pop", x64Reg(saved[i]))
+	}
+	return ret + g.instruction("ret")
 }
 
+// The callee-saved registers used by the function
+func (g *WinGenerator) GetSavedRegisters() []string {
+	used := usedPhysicalRegisters(g.arch, g.ir)
+	saved := []string{}
+	for _, r := range g.arch.CalleeSavedRegisters {
+		for _, u := range used {
+			if u == r {
+				saved = append(saved, r)
+			}
+		}
+	}
+	return saved
+}
+
+// On Windows the caller reserves 32 bytes of shadow space for the callee
+func (g *WinGenerator) GetCall(instr Instruction) string {
+	call := g.instruction("call", x64Label(g.ir.functions[instr.arg2.value]))
+	if g.arch.ShadowSpace == 0 {
+		return call
+	}
+	sp := x64Reg(g.arch.StackPointerRegister)
+	return g.instruction("sub", sp, x64Imm(g.arch.ShadowSpace)) + call +
+		g.instruction("add", sp, x64Imm(g.arch.ShadowSpace))
+}
+
+// mov, and load, which is a mov of all 8 bytes from memory
 func (g *WinGenerator) GetTwoArgInstruction(op GenOp, instr Instruction) string {
 	name := g.GetTargetInstruction(op)
-	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
-	arg2 := g.GetArg(instr.arg2)
-	return "  " + name + " " + retRegister + ", " + arg2 + "\n"
+	if op == movGenOp && instr.typ.IsFloat() {
+		return g.getFloatMove(instr)
+	}
+	if op == loadGenOp {
+		return g.instruction(name, x64Reg(g.arch.GetPhysicalRegister(instr.ret.value)), g.getAddress(instr.arg2, 8))
+	}
+	return g.instruction(name, x64Reg(g.register(instr.ret.value, instr.typ)), g.getTypedArg(instr.arg2, instr.typ))
 }
 
+// store, a mov of all 8 bytes to memory
 func (g *WinGenerator) GetTwoArgNoRetInstruction(op GenOp, instr Instruction) string {
 	name := g.GetTargetInstruction(op)
-	arg1Register := g.arch.GetPhysicalRegister(instr.arg1.value)
-	arg2 := g.GetArg(instr.arg2)
-	return "  " + name + " " + arg1Register + ", " + arg2 + "\n"
+	return g.instruction(name, g.getAddress(instr.arg2, 8), x64Reg(g.arch.GetPhysicalRegister(instr.arg1.value)))
 }
 
+// Binary instructions overwrite their first operand, which lowerTwoAddress
+// has made the same register as ret
 func (g *WinGenerator) GetInstruction(op GenOp, instr Instruction) string {
 	name := g.GetTargetInstruction(op)
-	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
-	arg1 := g.arch.GetPhysicalRegister(instr.arg1.value)
-	arg2 := g.GetArg(instr.arg2)
-	return "  " + name + " " + retRegister + ", " + arg1 + ", " + arg2 + "\n"
+	return g.instruction(name, x64Reg(g.register(instr.ret.value, instr.typ)), g.getTypedArg(instr.arg2, instr.typ))
 }
 
-func (g *WinGenerator) GetAddress(arg Arg) string {
-	return "[" + g.arch.GetPhysicalRegister(arg.value) + ", " + strconv.Itoa(g.ir.constants[arg.offsetConstant]) + "]"
+// A shift by a register takes its count in CL. RCX is an argument register,
+// which is only live on entry and around calls, so is free here. The whole
+// register is copied, since the shift only reads the low bits.
+func (g *WinGenerator) GetShiftInstruction(op GenOp, instr Instruction) string {
+	if instr.arg2.argType != registerArg {
+		return g.GetInstruction(op, instr)
+	}
+	name := g.GetTargetInstruction(op)
+	retRegister := g.register(instr.ret.value, instr.typ)
+	return g.instruction("mov", x64Reg("RCX"), x64Reg(g.arch.GetPhysicalRegister(instr.arg2.value))) +
+		g.instruction(name, x64Reg(retRegister), x64Reg("CL"))
 }
 
-func (g *WinGenerator) GetConstant(i int) string {
-	return strconv.Itoa(g.ir.constants[i])
+// not and neg work in place, so the operand is first copied to the result
+func (g *WinGenerator) GetUnaryInstruction(op GenOp, instr Instruction) string {
+	name := g.GetTargetInstruction(op)
+	retRegister := g.register(instr.ret.value, instr.typ)
+	arg2 := g.register(instr.arg2.value, instr.typ)
+	xrn := ""
+	if retRegister != arg2 {
+		xrn = g.instruction("mov", x64Reg(retRegister), x64Reg(arg2))
+	}
+	return xrn + g.instruction(name, x64Reg(retRegister))
 }
 
-func (g *WinGenerator) GetArg(arg Arg) string {
+// idiv and div divide RDX:RAX by a register, leaving the quotient in RAX and
+// the remainder in RDX. The divisor goes in RCX, and RAX, which may hold the
+// return value, is kept in R9. Like RDX, both are argument registers, so are
+// free here. i8 and i16 are divided as 32 bit values, which cannot overflow.
+//
+// Both instructions fault on a zero divisor or an overflowing quotient,
+// which TrapFaults keeps, except that i8 and i16 overflow is checked for
+// with ud2. WrapFaults branches around the division for a zero divisor and
+// negates for -1.
+func (g *WinGenerator) GetDivision(op GenOp, instr Instruction) string {
+	t := instr.typ
+	if t == noType {
+		t = I64
+	}
+	wide := t
+	if t.Size() < 4 {
+		wide = I32
+	}
+	signed := op == divGenOp || op == sremGenOp
+	retRegister := g.register(instr.ret.value, t)
+	xrn := ""
+	saveRAX := g.arch.GetPhysicalRegister(instr.ret.value) != "RAX"
+	if saveRAX {
+		xrn += g.instruction("mov", x64Reg("R9"), x64Reg("RAX"))
+	}
+	move := func(to string, arg int) string {
+		from := x64Reg(g.register(arg, t))
+		switch {
+		case wide == t && x64TypedRegister(to, t) == from.name:
+			return ""
+		case wide == t:
+			return g.instruction("mov", x64Reg(x64TypedRegister(to, t)), from)
+		case signed:
+			return g.instruction("movsx", x64Reg(x64TypedRegister(to, wide)), from)
+		default:
+			return g.instruction("movzx", x64Reg(x64TypedRegister(to, wide)), from)
+		}
+	}
+	// The divisor first, in case it is in RAX
+	xrn += move("RCX", instr.arg2.value)
+	xrn += move("RAX", instr.arg1.value)
+	divisor := x64Reg(x64TypedRegister("RCX", wide))
+	dividend := x64Reg(x64TypedRegister("RAX", wide))
+	// idiv also faults computing the quotient of srem, which is 0
+	zeroCheck := instr.traps == WrapFaults
+	negCheck := signed && wide == t && (instr.traps == WrapFaults || (instr.traps == TrapFaults && op == sremGenOp))
+	overflowCheck := instr.traps == TrapFaults && op == divGenOp && wide != t
+	if zeroCheck || negCheck || overflowCheck {
+		g.divisions++
+	}
+	label := func(name string) x64Operand {
+		return x64Label(g.getDivisionLabel(name))
+	}
+	if zeroCheck {
+		xrn += g.instruction("test", divisor, divisor) + g.instruction("jz", label("zero"))
+	}
+	if negCheck {
+		xrn += g.instruction("cmp", divisor, x64Imm(-1)) + g.instruction("je", label("neg"))
+	}
+	switch {
+	case signed && wide == I64:
+		xrn += g.instruction("cqo") + g.instruction("idiv", x64Reg("RCX"))
+	case signed:
+		xrn += g.instruction("cdq") + g.instruction("idiv", x64Reg("ECX"))
+	default:
+		xrn += g.instruction("xor", x64Reg("EDX"), x64Reg("EDX")) + g.instruction("div", divisor)
+	}
+	if overflowCheck {
+		// Only the minimum divided by -1 is one past the type's maximum
+		xrn += g.instruction("cmp", x64Reg("EAX"), x64Imm(-t.minimum())) +
+			g.instruction("jne", label("div")) + g.instruction("ud2")
+	}
+	if zeroCheck || negCheck {
+		xrn += g.instruction("jmp", label("div"))
+	}
+	if zeroCheck {
+		xrn += label("zero").name + ":\n" +
+			g.instruction("mov", x64Reg(x64TypedRegister("RDX", wide)), dividend) +
+			g.instruction("xor", x64Reg("EAX"), x64Reg("EAX"))
+		if negCheck {
+			xrn += g.instruction("jmp", label("div"))
+		}
+	}
+	if negCheck {
+		xrn += label("neg").name + ":\n" + g.instruction("neg", dividend) + g.instruction("xor", x64Reg("EDX"), x64Reg("EDX"))
+	}
+	if zeroCheck || negCheck || overflowCheck {
+		xrn += label("div").name + ":\n"
+	}
+	result := "RAX"
+	if op == sremGenOp || op == uremGenOp {
+		result = "RDX"
+	}
+	if result = x64TypedRegister(result, t); result != retRegister {
+		xrn += g.instruction("mov", x64Reg(retRegister), x64Reg(result))
+	}
+	if saveRAX {
+		xrn += g.instruction("mov", x64Reg("RAX"), x64Reg("R9"))
+	}
+	return xrn
+}
+
+// The label of a branch GetDivision adds. NASM allows @ in names, which IR
+// labels cannot contain, and GAS allows $.
+func (g *WinGenerator) getDivisionLabel(name string) string {
+	if g.gas() {
+		return ".L" + g.ir.Name() + "$" + name + "$" + strconv.Itoa(g.divisions)
+	}
+	return "." + name + "@" + strconv.Itoa(g.divisions)
+}
+
+// The sub-register holding a value of type t. Float registers have no
+// narrower names.
+func (g *WinGenerator) register(value int, t Type) string {
+	register := g.arch.GetPhysicalRegister(value)
+	if g.arch.isFloatRegister(value) {
+		return register
+	}
+	return x64TypedRegister(register, t)
+}
+
+// The sub-register of a 64 bit register holding a value of type t
+func x64TypedRegister(register string, t Type) string {
+	switch t {
+	case I8:
+		return x64ByteRegister(register)
+	case I16:
+		return x64WordRegister(register)
+	case I32:
+		return x64DwordRegister(register)
+	default:
+		return register
+	}
+}
+
+func (g *WinGenerator) getTypedArg(arg Arg, t Type) x64Operand {
 	switch arg.argType {
 	case constant:
-		return g.GetConstant(arg.value)
+		return x64Imm(g.ir.constants[arg.value])
 	case registerArg:
 		if arg.isVirtualRegister {
 			panic("Virtual register not allowed at code generation time")
 		}
-		return g.arch.GetPhysicalRegister(arg.value)
+		return x64Reg(g.register(arg.value, t))
 	case address:
-		return g.GetAddress(arg)
+		return g.getAddress(arg, t.Size())
 	default:
 		panic("Unknown argument type")
 	}
 }
 
+// An access of size bytes at a register plus a constant displacement
+func (g *WinGenerator) getAddress(arg Arg, size int) x64Operand {
+	return x64Mem(size, g.arch.GetPhysicalRegister(arg.value), g.ir.constants[arg.offsetConstant])
+}
+
+func (g *WinGenerator) GetAddress(arg Arg) string {
+	return g.operand(g.getAddress(arg, 8))
+}
+
+func (g *WinGenerator) GetConstant(i int) string {
+	return g.operand(x64Imm(g.ir.constants[i]))
+}
+
+func (g *WinGenerator) GetArg(arg Arg) string {
+	return g.operand(g.getTypedArg(arg, I64))
+}
+
+// Labels starting with . are local to the preceding function in NASM. GAS
+// has no such scope, so its .L labels, which are left out of the object
+// file, also name the function. IR names cannot contain $.
+func (g *WinGenerator) GetLabelName(l int) string {
+	if g.gas() {
+		return ".L" + g.ir.Name() + "$" + g.ir.labels[l]
+	}
+	return "." + g.ir.labels[l]
+}
+
+func (g *WinGenerator) GetLabel(instr Instruction) string {
+	return g.GetLabelName(instr.arg2.value) + ":\n"
+}
+
+func (g *WinGenerator) GetJump(instr Instruction) string {
+	return g.instruction("jmp", x64Label(g.GetLabelName(instr.arg2.value)))
+}
+
+func (g *WinGenerator) GetBranch(instr Instruction) string {
+	cond := x64Reg(g.register(instr.arg1.value, instr.typ))
+	return g.instruction("test", cond, cond) + g.instruction("jnz", x64Label(g.GetLabelName(instr.arg2.value)))
+}
+
+// setcc only writes the low byte, so the result is zero extended afterwards.
+// Constants are wrapped to the type, as the interpreter does.
+func (g *WinGenerator) GetCompareInstruction(op GenOp, instr Instruction) string {
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	retByte := x64Reg(x64ByteRegister(retRegister))
+	arg1 := x64Reg(g.register(instr.arg1.value, instr.typ))
+	arg2 := g.getTypedArg(instr.arg2, instr.typ)
+	if instr.arg2.argType == constant {
+		arg2 = x64Imm(instr.typ.wrap(g.ir.constants[instr.arg2.value]))
+	}
+	return g.instruction("cmp", arg1, arg2) +
+		g.instruction("set"+g.GetCondition(op), retByte) +
+		g.instruction("movzx", x64Reg(retRegister), retByte)
+}
+
+func (g *WinGenerator) GetCondition(op GenOp) string {
+	switch op {
+	case eqGenOp:
+		return "e"
+	case neGenOp:
+		return "ne"
+	case ltGenOp:
+		return "l"
+	case leGenOp:
+		return "le"
+	case gtGenOp:
+		return "g"
+	case geGenOp:
+		return "ge"
+	case ultGenOp:
+		return "b"
+	case uleGenOp:
+		return "be"
+	case ugtGenOp:
+		return "a"
+	case ugeGenOp:
+		return "ae"
+	default:
+		panic("Unknown comparison")
+	}
+}
+
+// movzx and movsx extend bytes and words. A 32 bit mov zeroes the top half of
+// the register, and movsxd sign extends a dword.
+func (g *WinGenerator) GetSizedLoad(instr Instruction) string {
+	size, signed := instr.op.memoryAccess()
+	retRegister := g.arch.GetPhysicalRegister(instr.ret.value)
+	addr := g.getAddress(instr.arg2, size)
+	switch {
+	case size == 4 && signed:
+		return g.instruction("movsxd", x64Reg(retRegister), addr)
+	case size == 4:
+		return g.instruction("mov", x64Reg(x64DwordRegister(retRegister)), addr)
+	case signed:
+		return g.instruction("movsx", x64Reg(retRegister), addr)
+	default:
+		return g.instruction("movzx", x64Reg(retRegister), addr)
+	}
+}
+
+func (g *WinGenerator) GetSizedStore(instr Instruction) string {
+	size, _ := instr.op.memoryAccess()
+	arg1Register := g.arch.GetPhysicalRegister(instr.arg1.value)
+	switch size {
+	case 1:
+		arg1Register = x64ByteRegister(arg1Register)
+	case 2:
+		arg1Register = x64WordRegister(arg1Register)
+	case 4:
+		arg1Register = x64DwordRegister(arg1Register)
+	}
+	return g.instruction("mov", g.getAddress(instr.arg2, size), x64Reg(arg1Register))
+}
+
+// movsx and movzx extend bytes and words, and a 32 bit mov zero extends.
+// Truncation is a mov of the narrower sub-registers.
+func (g *WinGenerator) GetConversion(instr Instruction) string {
+	if _, _, ok := instr.op.floatConversion(); ok {
+		return g.getFloatConversion(instr)
+	}
+	retRegister := x64Reg(g.register(instr.ret.value, instr.typ))
+	arg2 := g.arch.GetPhysicalRegister(instr.arg2.value)
+	switch instr.op {
+	case sext8:
+		return g.instruction("movsx", retRegister, x64Reg(x64ByteRegister(arg2)))
+	case sext16:
+		return g.instruction("movsx", retRegister, x64Reg(x64WordRegister(arg2)))
+	case sext32:
+		return g.instruction("movsxd", retRegister, x64Reg(x64DwordRegister(arg2)))
+	case zext8:
+		return g.instruction("movzx", retRegister, x64Reg(x64ByteRegister(arg2)))
+	case zext16:
+		return g.instruction("movzx", retRegister, x64Reg(x64WordRegister(arg2)))
+	case zext32:
+		return g.instruction("mov", x64Reg(x64DwordRegister(g.arch.GetPhysicalRegister(instr.ret.value))), x64Reg(x64DwordRegister(arg2)))
+	case trunc:
+		return g.instruction("mov", retRegister, x64Reg(g.register(instr.arg2.value, instr.typ)))
+	default:
+		panic("Unknown conversion: " + instr.op.String())
+	}
+}
+
+// movq and movd move the bits of an integer register into an XMM register
+func (g *WinGenerator) getFloatMove(instr Instruction) string {
+	retRegister := x64Reg(g.arch.GetPhysicalRegister(instr.ret.value))
+	switch {
+	case g.arch.isFloatRegister(instr.arg2.value):
+		return g.instruction("movaps", retRegister, x64Reg(g.arch.GetPhysicalRegister(instr.arg2.value)))
+	case instr.typ == F32:
+		return g.instruction("movd", retRegister, x64Reg(g.register(instr.arg2.value, I32)))
+	default:
+		return g.instruction("movq", retRegister, x64Reg(g.arch.GetPhysicalRegister(instr.arg2.value)))
+	}
+}
+
+// The truncating conversions give the integer indefinite 0x8000000000000000
+// for NaN and out of range values, as IndefiniteFloats describes
+func (g *WinGenerator) getFloatConversion(instr Instruction) string {
+	var name string
+	switch instr.op {
+	case sitof32:
+		name = "cvtsi2ss"
+	case sitof64:
+		name = "cvtsi2sd"
+	case f32tosi:
+		name = "cvttss2si"
+	case f64tosi:
+		name = "cvttsd2si"
+	case f32tof64:
+		name = "cvtss2sd"
+	case f64tof32:
+		name = "cvtsd2ss"
+	default:
+		panic("Unknown conversion: " + instr.op.String())
+	}
+	return g.instruction(name, x64Reg(g.arch.GetPhysicalRegister(instr.ret.value)), x64Reg(g.arch.GetPhysicalRegister(instr.arg2.value)))
+}
+
+func (g *WinGenerator) GetFloatInstruction(op GenOp, instr Instruction) string {
+	var name string
+	switch op {
+	case addGenOp:
+		name = "add"
+	case subGenOp:
+		name = "sub"
+	case multGenOp:
+		name = "mul"
+	case divGenOp:
+		name = "div"
+	default:
+		panic("Unknown float operation: " + strconv.Itoa(int(op)))
+	}
+	name += x64FloatSuffix(instr.typ)
+	return g.instruction(name, x64Reg(g.arch.GetPhysicalRegister(instr.ret.value)), x64Reg(g.arch.GetPhysicalRegister(instr.arg2.value)))
+}
+
+func (g *WinGenerator) GetFloatLoad(instr Instruction) string {
+	t := instr.op.floatAccess()
+	retRegister := x64Reg(g.arch.GetPhysicalRegister(instr.ret.value))
+	return g.instruction("mov"+x64FloatSuffix(t), retRegister, g.getAddress(instr.arg2, t.Size()))
+}
+
+func (g *WinGenerator) GetFloatStore(instr Instruction) string {
+	t := instr.op.floatAccess()
+	arg1Register := x64Reg(g.arch.GetPhysicalRegister(instr.arg1.value))
+	return g.instruction("mov"+x64FloatSuffix(t), g.getAddress(instr.arg2, t.Size()), arg1Register)
+}
+
+// Scalar single or double precision
+func x64FloatSuffix(t Type) string {
+	if t == F32 {
+		return "ss"
+	}
+	return "sd"
+}
+
+// The operand size keyword for a memory access of size bytes
+func x64SizeName(size int) string {
+	switch size {
+	case 1:
+		return "byte"
+	case 2:
+		return "word"
+	case 4:
+		return "dword"
+	case 8:
+		return "qword"
+	default:
+		panic("Unknown access size: " + strconv.Itoa(size))
+	}
+}
+
+// The AT&T suffix for an operand of size bytes
+func x64AttSuffix(size int) string {
+	switch size {
+	case 1:
+		return "b"
+	case 2:
+		return "w"
+	case 4:
+		return "l"
+	default:
+		return "q"
+	}
+}
+
+// The low byte of a 64 bit register
+func x64ByteRegister(register string) string {
+	switch register {
+	case "RAX":
+		return "AL"
+	case "RBX":
+		return "BL"
+	case "RCX":
+		return "CL"
+	case "RDX":
+		return "DL"
+	case "RSI":
+		return "SIL"
+	case "RDI":
+		return "DIL"
+	case "RBP":
+		return "BPL"
+	case "RSP":
+		return "SPL"
+	default:
+		return register + "B"
+	}
+}
+
+// The low 16 bits of a 64 bit register
+func x64WordRegister(register string) string {
+	switch register {
+	case "RAX", "RBX", "RCX", "RDX", "RSI", "RDI", "RBP", "RSP":
+		return register[1:]
+	default:
+		return register + "W"
+	}
+}
+
+// The low 32 bits of a 64 bit register
+func x64DwordRegister(register string) string {
+	switch register {
+	case "RAX", "RBX", "RCX", "RDX", "RSI", "RDI", "RBP", "RSP":
+		return "E" + register[1:]
+	default:
+		return register + "D"
+	}
+}
+
+// The size in bytes of a general purpose register named as by the functions
+// above
+func x64RegisterSize(register string) int {
+	switch {
+	case strings.HasSuffix(register, "L") || strings.HasSuffix(register, "B"):
+		return 1
+	case strings.HasSuffix(register, "W") || (len(register) == 2 && register[0] != 'R'):
+		return 2
+	case strings.HasSuffix(register, "D") || register[0] == 'E':
+		return 4
+	default:
+		return 8
+	}
+}
+
 func (g *WinGenerator) GetTargetInstruction(op GenOp) string {
 	switch op {
 	case addGenOp:
@@ -76,16 +615,157 @@ func (g *WinGenerator) GetTargetInstruction(op GenOp) string {
 	case subGenOp:
 		return "sub"
 	case multGenOp:
-		return "mul"
+		return "imul"
 	case divGenOp:
-		return "div"
+		return "idiv"
 	case loadGenOp:
-		return "ldr"
+		return "mov"
 	case storeGenOp:
-		return "str"
+		return "mov"
 	case movGenOp:
 		return "mov"
+	case andGenOp:
+		return "and"
+	case orGenOp:
+		return "or"
+	case xorGenOp:
+		return "xor"
+	case shlGenOp:
+		return "shl"
+	case lshrGenOp:
+		return "shr"
+	case ashrGenOp:
+		return "sar"
+	case notGenOp:
+		return "not"
+	case negGenOp:
+		return "neg"
 	default:
 		panic("Unknown instruction")
 	}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+// Dialects
+
+type x64OperandKind int
+
+const (
+	x64RegisterOperand  x64OperandKind = iota
+	x64ImmediateOperand x64OperandKind = iota
+	x64MemoryOperand    x64OperandKind = iota
+	x64LabelOperand     x64OperandKind = iota
+)
+
+// An instruction operand, written out in the generator's Dialect by operand.
+// Registers are named in upper case, as in Architecture.
+type x64Operand struct {
+	kind  x64OperandKind
+	name  string // the register, memory base register or label
+	value int    // the immediate or displacement
+	size  int    // of a memory access, in bytes
+}
+
+func x64Reg(name string) x64Operand {
+	return x64Operand{kind: x64RegisterOperand, name: name}
+}
+
+func x64Imm(value int) x64Operand {
+	return x64Operand{kind: x64ImmediateOperand, value: value}
+}
+
+func x64Mem(size int, base string, displacement int) x64Operand {
+	return x64Operand{kind: x64MemoryOperand, name: base, value: displacement, size: size}
+}
+
+func x64Label(name string) x64Operand {
+	return x64Operand{kind: x64LabelOperand, name: name}
+}
+
+func (g *WinGenerator) gas() bool {
+	return g.arch.Dialect == GasIntelDialect || g.arch.Dialect == GasAttDialect
+}
+
+// e.g. qword [R10 + 8] in NASM, qword ptr [r10 + 8] in GAS Intel syntax and
+// 8(%r10) in AT&T syntax
+func (g *WinGenerator) operand(o x64Operand) string {
+	att := g.arch.Dialect == GasAttDialect
+	switch o.kind {
+	case x64RegisterOperand:
+		switch {
+		case att:
+			return "%" + strings.ToLower(o.name)
+		case g.gas():
+			return strings.ToLower(o.name)
+		default:
+			return o.name
+		}
+	case x64ImmediateOperand:
+		if att {
+			return "$" + strconv.Itoa(o.value)
+		}
+		return strconv.Itoa(o.value)
+	case x64MemoryOperand:
+		base := g.operand(x64Reg(o.name))
+		if att {
+			if o.value == 0 {
+				return "(" + base + ")"
+			}
+			return strconv.Itoa(o.value) + "(" + base + ")"
+		}
+		addr := "[" + base + "]"
+		if o.value > 0 {
+			addr = "[" + base + " + " + strconv.Itoa(o.value) + "]"
+		} else if o.value < 0 {
+			addr = "[" + base + " - " + strconv.Itoa(-o.value) + "]"
+		}
+		if g.gas() {
+			return x64SizeName(o.size) + " ptr " + addr
+		}
+		return x64SizeName(o.size) + " " + addr
+	default:
+		return o.name
+	}
+}
+
+// Writes an instruction, given in Intel operand order. AT&T syntax reverses
+// the operands, and names the sizes of extensions in the mnemonic.
+func (g *WinGenerator) instruction(name string, operands ...x64Operand) string {
+	if g.arch.Dialect == GasAttDialect {
+		name = x64AttMnemonic(name, operands)
+		reversed := make([]x64Operand, len(operands))
+		for i, o := range operands {
+			reversed[len(operands)-1-i] = o
+		}
+		operands = reversed
+	}
+	xrn := "  " + name
+	for i, o := range operands {
+		if i == 0 {
+			xrn += " "
+		} else {
+			xrn += ", "
+		}
+		xrn += g.operand(o)
+	}
+	return xrn + "\n"
+}
+
+func x64AttMnemonic(name string, operands []x64Operand) string {
+	switch name {
+	case "cqo":
+		return "cqto"
+	case "cdq":
+		return "cltd"
+	case "movsx", "movsxd", "movzx":
+		size := func(o x64Operand) int {
+			if o.kind == x64MemoryOperand {
+				return o.size
+			}
+			return x64RegisterSize(o.name)
+		}
+		return name[:4] + x64AttSuffix(size(operands[1])) + x64AttSuffix(size(operands[0]))
+	default:
+		return name
+	}
+}